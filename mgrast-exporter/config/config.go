@@ -0,0 +1,146 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var PROFILES_KEY = "profiles"
+var FORMATS = []string{"yaml", "toml", "json"}
+
+// settings file of recurring exports, keys are option names. settings at
+// top level apply to all profiles, a named profile adds to or overrides them.
+type Config struct {
+	Path     string
+	Settings map[string]interface{}
+	Profiles map[string]map[string]interface{}
+}
+
+// format is taken from file extension: .yaml / .yml, .toml or .json
+func Load(path string) (c *Config, err error) {
+	format := Format(path)
+	if format == "" {
+		err = fmt.Errorf("unknown config format of %s, must be one of: %v", path, FORMATS)
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	raw := make(map[string]interface{})
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(data, &raw)
+	case "toml":
+		err = toml.Unmarshal(data, &raw)
+	case "json":
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		err = fmt.Errorf("config %s: %s", path, err.Error())
+		return
+	}
+	c = &Config{Path: path, Settings: make(map[string]interface{}), Profiles: make(map[string]map[string]interface{})}
+	for key, value := range raw {
+		if key != PROFILES_KEY {
+			c.Settings[key] = value
+			continue
+		}
+		profiles, ok := value.(map[string]interface{})
+		if !ok {
+			err = fmt.Errorf("config %s: %s must be a table of named profiles", path, PROFILES_KEY)
+			return
+		}
+		for name, p := range profiles {
+			settings, ok := p.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("config %s: profile %s must be a table of settings", path, name)
+				return
+			}
+			c.Profiles[name] = settings
+		}
+	}
+	return
+}
+
+func Format(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	case ".json":
+		return "json"
+	}
+	return ""
+}
+
+func (c *Config) ProfileNames() (names []string) {
+	for n := range c.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return
+}
+
+// settings of profile as option values, empty name is top level only
+func (c *Config) Resolve(profile string) (settings map[string]string, err error) {
+	merged := make(map[string]interface{})
+	for key, value := range c.Settings {
+		merged[key] = value
+	}
+	if profile != "" {
+		p, ok := c.Profiles[profile]
+		if !ok {
+			err = fmt.Errorf("unknown profile %s in config %s, must be one of: %v", profile, c.Path, c.ProfileNames())
+			return
+		}
+		for key, value := range p {
+			merged[key] = value
+		}
+	}
+	settings = make(map[string]string)
+	for key, value := range merged {
+		if settings[key], err = valueString(value); err != nil {
+			err = fmt.Errorf("config %s: setting %s: %s", c.Path, key, err.Error())
+			return
+		}
+	}
+	return
+}
+
+// lists are comma separated, like a list of stages
+func valueString(value interface{}) (s string, err error) {
+	switch v := value.(type) {
+	case string:
+		s = v
+	case bool:
+		s = strconv.FormatBool(v)
+	case int:
+		s = strconv.Itoa(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			var is string
+			if is, err = valueString(item); err != nil {
+				return
+			}
+			items = append(items, is)
+		}
+		s = strings.Join(items, ",")
+	default:
+		err = fmt.Errorf("value %v can not be used as option", value)
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// same settings in each format
+var configFiles = map[string]string{
+	"yaml": `
+directory: /data/export
+size: 500
+threads: 4
+sample-fraction: 0.25
+stage: [upload, preprocess]
+debug: false
+profiles:
+  nightly:
+    size: 1000
+    debug: true
+  sample:
+    sample-fraction: 0.1
+`,
+	"toml": `
+directory = "/data/export"
+size = 500
+threads = 4
+sample-fraction = 0.25
+stage = ["upload", "preprocess"]
+debug = false
+
+[profiles.nightly]
+size = 1000
+debug = true
+
+[profiles.sample]
+sample-fraction = 0.1
+`,
+	"json": `{
+	"directory": "/data/export",
+	"size": 500,
+	"threads": 4,
+	"sample-fraction": 0.25,
+	"stage": ["upload", "preprocess"],
+	"debug": false,
+	"profiles": {
+		"nightly": {"size": 1000, "debug": true},
+		"sample": {"sample-fraction": 0.1}
+	}
+}`,
+}
+
+func writeConfig(t *testing.T, name string, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// profiles override top level settings, top level applies to all profiles
+func TestLoadResolve(t *testing.T) {
+	top := map[string]string{
+		"directory":       "/data/export",
+		"size":            "500",
+		"threads":         "4",
+		"sample-fraction": "0.25",
+		"stage":           "upload,preprocess",
+		"debug":           "false",
+	}
+	tests := map[string]map[string]string{
+		"":        top,
+		"nightly": {"size": "1000", "debug": "true"},
+		"sample":  {"sample-fraction": "0.1"},
+	}
+	for format, data := range configFiles {
+		c, err := Load(writeConfig(t, "export."+format, data))
+		if err != nil {
+			t.Fatalf("%s: %s", format, err.Error())
+		}
+		if names := c.ProfileNames(); !reflect.DeepEqual(names, []string{"nightly", "sample"}) {
+			t.Errorf("%s: profiles %v", format, names)
+		}
+		if _, ok := c.Settings[PROFILES_KEY]; ok {
+			t.Errorf("%s: profiles in top level settings", format)
+		}
+		for profile, overrides := range tests {
+			expected := make(map[string]string)
+			for k, v := range top {
+				expected[k] = v
+			}
+			for k, v := range overrides {
+				expected[k] = v
+			}
+			settings, err := c.Resolve(profile)
+			if err != nil {
+				t.Errorf("%s, profile %q: %s", format, profile, err.Error())
+				continue
+			}
+			if !reflect.DeepEqual(settings, expected) {
+				t.Errorf("%s, profile %q: settings %v, expected %v", format, profile, settings, expected)
+			}
+		}
+		if _, err = c.Resolve("weekly"); (err == nil) || !strings.Contains(err.Error(), "unknown profile weekly") {
+			t.Errorf("%s: unknown profile resolved: %v", format, err)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]string{
+		"export.ini":  "size = 500\n",
+		"export.yaml": "size: [500\n",
+		"list.json":   `{"profiles": ["nightly"]}`,
+		"value.toml":  "profiles = { nightly = 1 }\n",
+	}
+	expected := map[string]string{
+		"export.ini":  "unknown config format",
+		"export.yaml": "config ",
+		"list.json":   "must be a table of named profiles",
+		"value.toml":  "profile nightly must be a table of settings",
+	}
+	for name, data := range tests {
+		if _, err := Load(writeConfig(t, name, data)); (err == nil) || !strings.Contains(err.Error(), expected[name]) {
+			t.Errorf("%s: loaded with %v", name, err)
+		}
+	}
+}
+
+func TestValueString(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		s     string
+	}{
+		{"fasta", "fasta"},
+		{true, "true"},
+		{42, "42"},
+		{int64(1) << 40, "1099511627776"},
+		{float64(500), "500"},
+		{0.25, "0.25"},
+		{1e-7, "0.0000001"},
+		{[]interface{}{"upload", "preprocess"}, "upload,preprocess"},
+		{[]interface{}{1, 2.5, false}, "1,2.5,false"},
+		{[]interface{}{}, ""},
+	}
+	for _, tt := range tests {
+		s, err := valueString(tt.value)
+		if err != nil {
+			t.Errorf("%v: %s", tt.value, err.Error())
+			continue
+		}
+		if s != tt.s {
+			t.Errorf("%v is %q, expected %q", tt.value, s, tt.s)
+		}
+	}
+	for _, value := range []interface{}{nil, map[string]interface{}{"a": 1}, []interface{}{"a", map[string]interface{}{}}} {
+		if _, err := valueString(value); err == nil {
+			t.Errorf("%v used as option", value)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var TARGET_DEFAULT = "fasta"
+var TARGET_BLASTDB = "blastdb-fasta"
+var TARGETS = []string{TARGET_DEFAULT, TARGET_BLASTDB}
+
+// accession of record is its project, metagenome and number in metagenome
+var BLASTDB_HEADER_TEMPLATE = "{project}_{metagenome}_{id}"
+var BLASTDB_PROFILE = "none"
+var BLASTDB_TAXID_MAP = "blastdb.taxid_map.txt"
+var BLASTDB_ACCESSIONS = "blastdb.accessions.tsv"
+
+// node attributes looked up for taxid, top level first then in metadata
+var BLASTDB_TAXID_KEYS = []string{"taxid", "tax_id", "ncbi_taxid"}
+
+func checkTarget(target string) (err error) {
+	for _, t := range TARGETS {
+		if t == target {
+			return
+		}
+	}
+	err = fmt.Errorf("unknown export target %s, must be one of: %v", target, TARGETS)
+	return
+}
+
+// numbers records of each metagenome of a project in write order, so the
+// accessions of a metagenome are known from its record count in the index
+type accessions struct {
+	hf     *file.HeaderFormat
+	counts map[string]int
+	id     []byte
+	header []byte
+}
+
+func newAccessions(hf *file.HeaderFormat) *accessions {
+	return &accessions{hf: hf, counts: make(map[string]int)}
+}
+
+// forget numbers of previous project
+func (a *accessions) Reset() {
+	a.counts = make(map[string]int)
+}
+
+// record of sequence under next accession of metagenome
+func (a *accessions) Record(p string, m string, seq []byte, wrap int) []byte {
+	a.counts[m] += 1
+	a.id = strconv.AppendInt(a.id[:0], int64(a.counts[m]), 10)
+	a.header = a.hf.AppendFormat(a.header[:0], accessionID(p), accessionID(m), &file.Seq{ID: a.id})
+	return (&file.Seq{ID: a.header, Seq: seq}).WrappedRecord(wrap)
+}
+
+// makeblastdb -parse_seqids reads a dot as start of a version, so mgm1.3
+// is mgm1_3 in accessions. headers parse back to the metagenome ID.
+func accessionID(id string) string {
+	return strings.Replace(id, ".", "_", -1)
+}
+
+// write accession to taxid map for makeblastdb -taxid_map and per metagenome
+// accession table from the index, taxids are taken from metadata sidecars.
+// only written for blastdb target, rewritten whenever the index changes.
+func (e *Exporter) writeTargetMaps() (err error) {
+	if e.Target != TARGET_BLASTDB {
+		return
+	}
+	taxids, names, err := e.sidecarTaxids()
+	if err != nil {
+		return
+	}
+	fh, err := e.FS.Create(BLASTDB_TAXID_MAP)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	bw := bufio.NewWriter(fh)
+	var table bytes.Buffer
+	fmt.Fprintf(&table, "accession_prefix\tproject\tmetagenome\trecords\ttaxid\tname\tstart_file\tend_file\n")
+	hf, err := file.NewHeaderFormat(BLASTDB_HEADER_TEMPLATE)
+	if err != nil {
+		return
+	}
+	var acc []byte
+	for _, i := range *e.Indexes {
+		if i.Removed || !i.Completed {
+			continue
+		}
+		for _, m := range i.Metagenomes {
+			count, ok := i.Records[m]
+			if !ok {
+				fmt.Fprintf(os.Stderr, fmt.Sprintf("no record count for metagenome %s in index, left out of %s\n", m, BLASTDB_TAXID_MAP))
+				continue
+			}
+			taxid := taxids[m]
+			if taxid == "" {
+				taxid = "0"
+			}
+			prefix := hf.Format(accessionID(i.Project), accessionID(m), &file.Seq{})
+			fmt.Fprintf(&table, "%s\t%s\t%s\t%d\t%s\t%s\t%d\t%d\n", prefix, i.Project, m, count, taxid, tsvValue(names[m]), i.StartFile, i.EndFile)
+			for n := 1; n <= count; n++ {
+				acc = strconv.AppendInt(append(acc[:0], prefix...), int64(n), 10)
+				acc = append(append(append(acc, ' '), taxid...), '\n')
+				if _, err = bw.Write(acc); err != nil {
+					return
+				}
+			}
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		return
+	}
+	if err = fh.Close(); err != nil {
+		return
+	}
+	err = writeFile(e.FS, BLASTDB_ACCESSIONS, table.Bytes())
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("blastdb taxid map: %s\n", e.FS.Location(BLASTDB_TAXID_MAP)))
+	return
+}
+
+func (e *Exporter) deleteTargetMaps() {
+	for _, name := range []string{BLASTDB_TAXID_MAP, BLASTDB_ACCESSIONS} {
+		if e.FS.Exists(name) {
+			e.FS.Delete(name)
+		}
+	}
+}
+
+// taxid and name of each metagenome with a metadata sidecar
+func (e *Exporter) sidecarTaxids() (taxids map[string]string, names map[string]interface{}, err error) {
+	taxids = make(map[string]string)
+	names = make(map[string]interface{})
+	for _, i := range *e.Indexes {
+		if i.Removed || (i.Metadata == "") {
+			continue
+		}
+		fh, oerr := e.FS.Open(i.Metadata)
+		if oerr != nil {
+			err = oerr
+			return
+		}
+		data, rerr := ioutil.ReadAll(fh)
+		fh.Close()
+		if rerr != nil {
+			err = rerr
+			return
+		}
+		for _, line := range bytes.Split(bytes.TrimSpace(data), []byte{'\n'}) {
+			n := new(NodeMetadata)
+			if err = json.Unmarshal(line, n); err != nil {
+				err = fmt.Errorf("metadata file %s: %s", e.FS.Location(i.Metadata), err.Error())
+				return
+			}
+			names[n.Metagenome] = n.Attributes["name"]
+			taxids[n.Metagenome] = attributeTaxid(n.Attributes)
+		}
+	}
+	return
+}
+
+func attributeTaxid(attr map[string]interface{}) string {
+	nested, _ := attr["metadata"].(map[string]interface{})
+	for _, a := range []map[string]interface{}{attr, nested} {
+		for _, k := range BLASTDB_TAXID_KEYS {
+			switch v := a[k].(type) {
+			case string:
+				if _, err := strconv.Atoi(v); err == nil {
+					return v
+				}
+			case float64:
+				return strconv.FormatInt(int64(v), 10)
+			}
+		}
+	}
+	return ""
+}
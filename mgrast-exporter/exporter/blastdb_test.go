@@ -0,0 +1,80 @@
+package exporter
+
+import (
+	"bufio"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// accessions number on across nodes of a metagenome, without dots, and the
+// taxid map lists them in the order of the fasta
+func TestExportBlastdbAccessions(t *testing.T) {
+	opts := NewOptions()
+	opts.Path = t.TempDir()
+	opts.Target = TARGET_BLASTDB
+	nodes := []testNode{
+		{"n1", "mgp1", "mgm1.3", 0, ">r1\nAACGG\n>r2\nTTTTT\n"},
+		{"n2", "mgp1", "mgm1.3", 0, ">r1\nGGGGG\n>r2\nCCCCC\n>r3\nACACA\n"},
+		{"n3", "mgp1", "mgm2.3", 0, ">r1\nAACGG\n"},
+	}
+	e, err := runTestExport(t, opts, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testRecordCounts(e); !reflect.DeepEqual(got, map[string]int{"mgm1.3": 5, "mgm2.3": 1}) {
+		t.Errorf("records %v", got)
+	}
+	fh, err := e.FS.Open(e.Files.FileName(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	var accs []string
+	seen := make(map[string]bool)
+	fr := file.NewReader(fh, false)
+	for {
+		seq, rerr := fr.Read()
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		acc := string(seq.ID)
+		if seen[acc] {
+			t.Errorf("accession %s repeated", acc)
+		}
+		seen[acc] = true
+		accs = append(accs, acc)
+	}
+	expected := []string{"mgp1_mgm1_3_1", "mgp1_mgm1_3_2", "mgp1_mgm1_3_3", "mgp1_mgm1_3_4", "mgp1_mgm1_3_5", "mgp1_mgm2_3_1"}
+	if !reflect.DeepEqual(accs, expected) {
+		t.Errorf("accessions %v, expected %v", accs, expected)
+	}
+	mh, err := e.FS.Open(BLASTDB_TAXID_MAP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mh.Close()
+	var mapped []string
+	scanner := bufio.NewScanner(mh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if (len(fields) != 2) || (fields[1] != "0") {
+			t.Errorf("taxid map line %q", scanner.Text())
+			continue
+		}
+		mapped = append(mapped, fields[0])
+	}
+	if !reflect.DeepEqual(mapped, accs) {
+		t.Errorf("taxid map lists %v, fasta has %v", mapped, accs)
+	}
+	for _, acc := range accs {
+		if _, m, perr := e.Header.ParseHeader(acc); (perr != nil) || !strings.HasPrefix(acc, "mgp1_"+strings.Replace(m, ".", "_", 1)+"_") {
+			t.Errorf("accession %s parsed as %s: %v", acc, m, perr)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package exporter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var BUNDLE_README = "README"
+var BUNDLE_MANIFEST = "SHA256SUMS"
+
+// one file in bundle, content is either in memory or in export set
+type bundleEntry struct {
+	name string
+	fs   storage.Storage
+	data []byte
+	size int64
+}
+
+// write completed export set as deterministic tar, gzipped if output ends in .gz or .tgz.
+// summary, index and checksum manifest come first, then numbered files in order.
+// with volumeSize (GB) > 0 the bundle is split into standalone tar volumes
+// holding whole files.
+func (e *Exporter) Bundle(output string, volumeSize int64) (err error) {
+	if output == "" {
+		err = fmt.Errorf("output must be set for bundle")
+		return
+	}
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	if !e.Store.Exists() {
+		err = fmt.Errorf("no index in %s", e.Path)
+		return
+	}
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+
+	// only bundle a complete and clean set
+	if ok, proj, pos := e.Indexes.IsComplete(); !ok {
+		err = fmt.Errorf("export set in bad state: project %s (%d out of %d exports) is incomplete", proj, pos, e.Indexes.Len())
+		return
+	}
+	if ok, missing := e.Files.DirHasFiles(e.Indexes.FileList(0), e.FS); !ok {
+		err = fmt.Errorf("export set in bad state: directory missing files\n\t%s\n", strings.Join(missing, "\n\t"))
+		return
+	}
+	if ok, missing := e.Indexes.HasFiles(e.allExportFiles()); !ok {
+		err = fmt.Errorf("export set in bad state: index missing files\n\t%s\n", strings.Join(missing, "\n\t"))
+		return
+	}
+	for _, i := range *e.Indexes {
+		if i.Removed {
+			err = fmt.Errorf("export set has removed project %s, run repack before bundling", i.Project)
+			return
+		}
+	}
+
+	// numbered files in order
+	var entries []*bundleEntry
+	files := e.Indexes.FileList(0)
+	sort.Ints(files)
+	for _, fnum := range files {
+		for _, fname := range e.Files.fileNames(fnum) {
+			size, serr := e.FS.Size(fname)
+			if serr != nil {
+				err = serr
+				return
+			}
+			entries = append(entries, &bundleEntry{name: fname, fs: e.FS, size: size})
+		}
+	}
+
+	// metadata sidecars follow numbered files
+	for _, i := range *e.Indexes {
+		if i.Metadata == "" {
+			continue
+		}
+		for _, name := range []string{i.Metadata, MetadataTSVName(i.Metadata)} {
+			size, serr := e.FS.Size(name)
+			if serr != nil {
+				err = serr
+				return
+			}
+			entries = append(entries, &bundleEntry{name: name, fs: e.FS, size: size})
+		}
+	}
+
+	// index is always bundled as json
+	indexData, err := index.MarshalIndex(e.Indexes, e.Meta)
+	if err != nil {
+		return
+	}
+	indexEntry := &bundleEntry{name: index.INDEX_FILE, data: indexData, size: int64(len(indexData))}
+
+	// checksums of index and numbered files
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("computing checksums of %d files\n", len(entries)))
+	var manifest bytes.Buffer
+	for _, be := range append([]*bundleEntry{indexEntry}, entries...) {
+		sum, serr := be.checksum()
+		if serr != nil {
+			err = serr
+			return
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", sum, be.name)
+	}
+	manifestEntry := &bundleEntry{name: BUNDLE_MANIFEST, data: manifest.Bytes(), size: int64(manifest.Len())}
+	summary := e.bundleSummary(entries)
+	summaryEntry := &bundleEntry{name: BUNDLE_README, data: summary, size: int64(len(summary))}
+
+	// split into volumes of whole files
+	volumes := [][]*bundleEntry{{summaryEntry, indexEntry, manifestEntry}}
+	var volBytes int64
+	limit := volumeSize * 1024 * 1024 * 1024
+	for _, be := range entries {
+		last := len(volumes) - 1
+		if (limit > 0) && (volBytes > 0) && (volBytes+be.size > limit) {
+			volumes = append(volumes, []*bundleEntry{})
+			last += 1
+			volBytes = 0
+		}
+		volumes[last] = append(volumes[last], be)
+		volBytes += be.size
+	}
+
+	// fixed timestamp keeps output identical for identical set
+	modTime := e.Meta.Created.UTC().Truncate(time.Second)
+	prefix := bundleName(output)
+	for n, vol := range volumes {
+		vpath := output
+		if len(volumes) > 1 {
+			vpath = volumePath(output, n+1)
+		}
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("writing bundle: %s (%d files)\n", vpath, len(vol)))
+		err = writeTar(vpath, prefix, vol, modTime)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (be *bundleEntry) open() (io.ReadCloser, error) {
+	if be.fs == nil {
+		return ioutil.NopCloser(bytes.NewReader(be.data)), nil
+	}
+	return be.fs.Open(be.name)
+}
+
+func (be *bundleEntry) checksum() (sum string, err error) {
+	r, err := be.open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+func (e *Exporter) bundleSummary(entries []*bundleEntry) []byte {
+	meta := e.Meta
+	var totalSize int64
+	for _, be := range entries {
+		totalSize += be.size
+	}
+	mgCount := 0
+	records := 0
+	for _, i := range *e.Indexes {
+		mgCount += len(i.Metagenomes)
+		if records >= 0 {
+			if n := i.RecordCount(); n >= 0 {
+				records += n
+			} else {
+				records = -1
+			}
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "MG-RAST export set\n\n")
+	fmt.Fprintf(&b, "created:          %s\n", meta.Created.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "exporter version: %s\n", meta.Version)
+	fmt.Fprintf(&b, "pipeline stage:   %s\n", meta.Stage)
+	if meta.ShockHost != "" {
+		fmt.Fprintf(&b, "source:           %s\n", meta.ShockHost)
+	}
+	fmt.Fprintf(&b, "header format:    %s\n", meta.Header)
+	if meta.Profile != nil {
+		fmt.Fprintf(&b, "compression:      %s\n", meta.Profile.String())
+	}
+	fmt.Fprintf(&b, "projects:         %d\n", e.Indexes.Len())
+	fmt.Fprintf(&b, "metagenomes:      %d\n", mgCount)
+	if records >= 0 {
+		fmt.Fprintf(&b, "records:          %d\n", records)
+	}
+	fmt.Fprintf(&b, "files:            %d (%d bytes)\n", len(entries), totalSize)
+	fmt.Fprintf(&b, "\n%s lists project, metagenomes and file:record ranges of each project.\n", index.INDEX_FILE)
+	for _, i := range *e.Indexes {
+		if i.Metadata != "" {
+			fmt.Fprintf(&b, "<project>%s.jsonl and .tsv hold shock attributes of project metagenomes.\n", METADATA_SUFFIX)
+			break
+		}
+	}
+	fmt.Fprintf(&b, "Verify files with: sha256sum -c %s\n", BUNDLE_MANIFEST)
+	return b.Bytes()
+}
+
+func writeTar(path string, prefix string, entries []*bundleEntry, modTime time.Time) (err error) {
+	fh, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	// no partial output is left behind
+	defer func() {
+		if err != nil {
+			fh.Close()
+			os.Remove(path)
+		}
+	}()
+	var w io.Writer = fh
+	var gw *gzip.Writer
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		// no name or time in gzip header
+		gw = gzip.NewWriter(fh)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	for _, be := range entries {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     prefix + "/" + be.name,
+			Mode:     0644,
+			Size:     be.size,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return
+		}
+		r, oerr := be.open()
+		if oerr != nil {
+			err = oerr
+			return
+		}
+		_, err = io.Copy(tw, r)
+		r.Close()
+		if err != nil {
+			return
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return
+	}
+	if gw != nil {
+		if err = gw.Close(); err != nil {
+			return
+		}
+	}
+	err = fh.Close()
+	return
+}
+
+// top directory in tar, output name without extensions
+func bundleName(output string) string {
+	name := filepath.Base(output)
+	for _, ext := range []string{".gz", ".tgz", ".tar"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// release.tar.gz -> release.001.tar.gz
+func volumePath(output string, n int) string {
+	dir, name := filepath.Split(output)
+	base := bundleName(output)
+	return filepath.Join(dir, fmt.Sprintf("%s.%03d%s", base, n, strings.TrimPrefix(name, base)))
+}
@@ -0,0 +1,87 @@
+package exporter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var bundleSegments = []testSegment{
+	{"mgp1", "mgm1.3", 1, 3},
+	{"mgp2", "mgm2.3", 1, 2},
+	{"mgp2", "mgm2.3", 2, 4},
+}
+
+// tar member names of gzipped bundle
+func bundleMembers(t *testing.T, data []byte) (names []string) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("bundle is not gzipped: %s", err.Error())
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+// same set gives same bytes, .tgz is gzipped like .tar.gz
+func TestBundleDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSet(t, dir, bundleSegments)
+	output := filepath.Join(t.TempDir(), "release.tgz")
+	var bundles [][]byte
+	for n := 0; n < 2; n++ {
+		opts := NewOptions()
+		opts.Path = dir
+		if err := New(opts).Bundle(output, 0); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundles = append(bundles, data)
+	}
+	members := bundleMembers(t, bundles[0])
+	want := []string{"release/README", "release/export.index", "release/SHA256SUMS", "release/1.fasta.gz", "release/2.fasta.gz"}
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("bundle holds %v, expected %v", members, want)
+	}
+	if !bytes.Equal(bundles[0], bundles[1]) {
+		t.Errorf("bundling same set twice gave different bytes")
+	}
+}
+
+// failed bundle leaves no partial output
+func TestBundleWriteFailed(t *testing.T) {
+	empty, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(t.TempDir(), "release.tar.gz")
+	entries := []*bundleEntry{
+		{name: "README", data: []byte("export set\n"), size: 11},
+		{name: "1.fasta.gz", fs: empty, size: 100},
+	}
+	if err = writeTar(output, "release", entries, time.Time{}); err == nil {
+		t.Fatal("bundle of missing file written")
+	}
+	if _, serr := os.Stat(output); !os.IsNotExist(serr) {
+		t.Errorf("partial bundle %s left", output)
+	}
+}
@@ -0,0 +1,169 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// compare export set against an older index (file, directory or s3 prefix),
+// or against a shock node listing, from a json file or live query.
+// older index is the old side, a shock listing is the new side.
+func (e *Exporter) Diff(ctx context.Context, against string, listing string, w io.Writer) (err error) {
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	if !e.Store.Exists() {
+		err = fmt.Errorf("no index in %s", e.Path)
+		return
+	}
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+
+	other := index.NewExportIndex()
+	var d *index.Diff
+	switch {
+	case against != "":
+		err = e.loadOtherIndex(against, other)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "comparing %s (old) to %s (new)\n", against, e.Store.Path())
+		d = index.Compare(other, e.Indexes)
+	case listing != "":
+		err = listingIndex(listing, other)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "comparing %s (old) to shock listing %s (new)\n", e.Store.Path(), listing)
+		d = index.Compare(e.Indexes, other)
+	case e.SC.Host != "":
+		err = e.shockIndex(ctx, other)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "comparing %s (old) to shock %s (new)\n", e.Store.Path(), e.SC.Host)
+		d = index.Compare(e.Indexes, other)
+	default:
+		err = fmt.Errorf("nothing to compare against, set an index, listing or shock url")
+		return
+	}
+	d.Write(w)
+	return
+}
+
+func (e *Exporter) loadOtherIndex(path string, idx *index.Indexes) (err error) {
+	var b index.Backend
+	if storage.IsRemote(path) {
+		b, err = openOtherBackend(storage.NewStorage(path, e.S3Endpoint))
+	} else if info, serr := os.Stat(path); serr != nil {
+		err = serr
+	} else if info.IsDir() {
+		b, err = openOtherBackend(storage.NewLocalStorage(path))
+	} else if strings.HasSuffix(path, filepath.Ext(index.INDEX_DB_FILE)) {
+		b = index.NewSQLiteBackend(path)
+	} else {
+		var fs storage.Storage
+		fs, err = storage.NewLocalStorage(filepath.Dir(path))
+		if err == nil {
+			b = index.NewJSONBackend(fs, filepath.Base(path))
+		}
+	}
+	if err != nil {
+		return
+	}
+	defer b.Close()
+	if !b.Exists() {
+		err = fmt.Errorf("no index found at %s", path)
+		return
+	}
+	err = b.Load(idx, index.NewMeta())
+	return
+}
+
+// backend of index in export set
+func openOtherBackend(fs storage.Storage, err error) (index.Backend, error) {
+	if err != nil {
+		return nil, err
+	}
+	return index.OpenBackend(fs, "")
+}
+
+// json array of shock nodes, or shock response with nodes in data
+func listingIndex(path string, idx *index.Indexes) (err error) {
+	jsonstream, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var nodes []interface{}
+	if err = json.Unmarshal(jsonstream, &nodes); err != nil {
+		response := struct {
+			Data []interface{} `json:"data"`
+		}{}
+		if err = json.Unmarshal(jsonstream, &response); err != nil {
+			return
+		}
+		nodes = response.Data
+	}
+	projects := make(map[string]*index.Index)
+	for _, node := range nodes {
+		_, projID, mgID, nerr := parseNode(node)
+		if nerr != nil {
+			err = nerr
+			return
+		}
+		addNode(idx, projects, projID, mgID)
+	}
+	return
+}
+
+// query nodes of export set stage, as export does
+func (e *Exporter) shockIndex(ctx context.Context, idx *index.Indexes) (err error) {
+	e.Query.Set("stage_name", e.Stage)
+	listing, err := e.queryNodes(ctx, e.Query)
+	if err != nil {
+		return
+	}
+	projects := make(map[string]*index.Index)
+	for {
+		item, er := listing.Next(ctx)
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			return
+		}
+		_, projID, mgID, nerr := parseNode(item.Data)
+		if nerr != nil {
+			err = nerr
+			return
+		}
+		addNode(idx, projects, projID, mgID)
+	}
+}
+
+// listing index has no file positions or record counts
+func addNode(idx *index.Indexes, projects map[string]*index.Index, projID string, mgID string) {
+	if (projID == "") || (mgID == "") {
+		return
+	}
+	if i, ok := projects[projID]; ok {
+		i.Update(mgID)
+		return
+	}
+	i := new(index.Index)
+	i.Init(projID, mgID, 0, 0)
+	idx.Add(i)
+	projects[projID] = i
+}
@@ -0,0 +1,52 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// shock listing as json array or as query response is the new side,
+// paths are printed as given
+func TestDiffListing(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSet(t, dir, removeSegments)
+	nodes := `[
+		{"id": "n1", "attributes": {"id": "mgm1.3", "project_id": "mgp1"}},
+		{"id": "n2", "attributes": {"id": "mgm2.3", "project_id": "mgp2"}},
+		{"id": "n3", "attributes": {"id": "mgm4.3", "project_id": "mgp3"}},
+		{"id": "n4", "attributes": {"id": "mgm6.3", "project_id": "mgp3"}},
+		{"id": "n5", "attributes": {"id": "mgm7.3", "project_id": "mgp5"}}
+	]`
+	listings := map[string]string{
+		"array":    nodes,
+		"response": fmt.Sprintf(`{"data": %s, "total_count": 5}`, nodes),
+	}
+	for name, listing := range listings {
+		path := filepath.Join(t.TempDir(), "listing%s.json")
+		if err := ioutil.WriteFile(path, []byte(listing), 0666); err != nil {
+			t.Fatal(err)
+		}
+		opts := NewOptions()
+		opts.Path = dir
+		e := New(opts)
+		var buf bytes.Buffer
+		if err := e.Diff(context.Background(), "", path, &buf); err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		expected := fmt.Sprintf("comparing %s (old) to shock listing %s (new)\n", e.Store.Path(), path) +
+			"+ project mgp5: 1 metagenome(s)\n" +
+			"- project mgp4: 1 metagenome(s), 2 record(s)\n" +
+			"~ project mgp2\n" +
+			"    - metagenome mgm3.3\n" +
+			"~ project mgp3\n" +
+			"    + metagenome mgm6.3\n" +
+			"1 project(s) added, 1 removed, 2 changed\n"
+		if buf.String() != expected {
+			t.Errorf("%s: diff is\n%s\nexpected\n%s", name, buf.String(), expected)
+		}
+	}
+}
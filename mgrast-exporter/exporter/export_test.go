@@ -0,0 +1,159 @@
+package exporter
+
+import (
+	"context"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/golib/httpclient"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// shock node with the fasta it downloads as
+type testNode struct {
+	id         string
+	project    string
+	metagenome string
+	mate       int
+	fasta      string
+}
+
+// nodes in order of the shock query
+type testNodes struct {
+	items []*httpclient.Item
+}
+
+func (s *testNodes) Next(ctx context.Context) (item *httpclient.Item, err error) {
+	if len(s.items) == 0 {
+		err = io.EOF
+		return
+	}
+	item, s.items = s.items[0], s.items[1:]
+	return
+}
+
+// export nodes served by a fake shock into opts.Path
+func runTestExport(t *testing.T, opts Options, nodes []testNode) (e *Exporter, err error) {
+	downloads := make(map[string]string)
+	src := &testNodes{}
+	for _, n := range nodes {
+		downloads["/"+RESOURCE+"/"+n.id] = n.fasta
+		attr := map[string]interface{}{"id": n.metagenome, "project_id": n.project}
+		if n.mate > 0 {
+			attr["mate"] = float64(n.mate)
+		}
+		src.items = append(src.items, &httpclient.Item{Data: map[string]interface{}{"id": n.id, "attributes": attr}})
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fasta, ok := downloads[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, fasta)
+	}))
+	defer srv.Close()
+	e = New(opts)
+	if err = e.Init("", srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	e.nodes = src
+	err = e.Export(context.Background())
+	return
+}
+
+// pair rejected for its mate is logged with both sequences as read
+func TestExportRejectsMates(t *testing.T) {
+	opts := NewOptions()
+	opts.Path = t.TempDir()
+	opts.Paired = PAIRED_INTERLEAVED
+	opts.Valid = file.NewValidator(file.IUPAC_NUCLEOTIDES, 1, 0, false)
+	fasta := ">read_1/1\nacgtacgt\n>read_1/2\nACGTXACGT\n>read_2/1\nACGT\n>read_2/2\nTTGG\n"
+	e, err := runTestExport(t, opts, []testNode{{"n1", "mgp1", "mgm1.3", 0, fasta}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := e.FS.List(REJECTS_PREFIX + ".*.fasta")
+	if len(names) != 1 {
+		t.Fatalf("rejects files: %v", names)
+	}
+	fh, err := e.FS.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	data, err := ioutil.ReadAll(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ">mgp1|mgm1.3|read_1/1 reason=invalid character 'X'\nacgtacgt\n>mgp1|mgm1.3|read_1/2 reason=invalid character 'X'\nACGTXACGT\n"
+	if string(data) != expected {
+		t.Errorf("rejects are\n%s\nexpected\n%s", data, expected)
+	}
+	if files := readTestSet(t, e.FS); strings.Join(files["1.fasta.gz"], ",") != "mgp1|mgm1.3|read_2/1,mgp1|mgm1.3|read_2/2" {
+		t.Errorf("exported records: %v", files)
+	}
+}
+
+// record count of each metagenome in index
+func testRecordCounts(e *Exporter) map[string]int {
+	counts := make(map[string]int)
+	for _, i := range *e.Indexes {
+		for m, n := range i.Records {
+			counts[m] = n
+		}
+	}
+	return counts
+}
+
+// duplicates are dropped within metagenome, or within project
+func TestExportDedupScope(t *testing.T) {
+	nodes := []testNode{
+		{"n1", "mgp1", "mgm1.3", 0, ">r1\nAACGG\n>r2\nTTTTT\n>r3\nAACGG\n"},
+		{"n2", "mgp1", "mgm2.3", 0, ">r1\nAACGG\n>r2\nGGGGG\n"},
+		{"n3", "mgp2", "mgm3.3", 0, ">r1\nAACGG\n>r2\nTTTTT\n"},
+	}
+	expected := map[string]map[string]int{
+		"metagenome": {"mgm1.3": 2, "mgm2.3": 2, "mgm3.3": 2},
+		"project":    {"mgm1.3": 2, "mgm2.3": 1, "mgm3.3": 2},
+	}
+	for scope, counts := range expected {
+		opts := NewOptions()
+		opts.Path = t.TempDir()
+		opts.Dedup, _ = file.NewDedup("exact", 1)
+		opts.DedupScope = scope
+		e, err := runTestExport(t, opts, nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := testRecordCounts(e); !reflect.DeepEqual(got, counts) {
+			t.Errorf("scope %s: records %v, expected %v", scope, got, counts)
+		}
+	}
+}
+
+// pairs are duplicates by both mates, with revcomp also read from the other strand
+func TestExportDedupPairs(t *testing.T) {
+	fasta := ">a/1\nAACGG\n>a/2\nTTGCA\n" +
+		">b/1\nAACGG\n>b/2\nTTGCC\n" +
+		">c/1\nTTGCA\n>c/2\nAACGG\n" +
+		">d/1\nAACGG\n>d/2\nTTGCA\n"
+	expected := map[string]int{"exact": 6, "revcomp": 4}
+	for mode, records := range expected {
+		opts := NewOptions()
+		opts.Path = t.TempDir()
+		opts.Paired = PAIRED_INTERLEAVED
+		opts.Dedup, _ = file.NewDedup(mode, 1)
+		e, err := runTestExport(t, opts, []testNode{{"n1", "mgp1", "mgm1.3", 0, fasta}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := testRecordCounts(e)["mgm1.3"]; got != records {
+			t.Errorf("%s: %d records, expected %d", mode, got, records)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package exporter
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
 	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
 	"github.com/MG-RAST/go-shock-client"
 	"github.com/MG-RAST/golib/httpclient"
 	"io"
@@ -12,42 +13,121 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var RESOURCE = "node"
 var PAGE_SIZE = 50
 
+// R2 is mate of R, written after it or to the parallel file
 type Record struct {
-	R []byte
-	P string
-	M string
+	R  []byte
+	R2 []byte
+	P  string
+	M  string
 }
 
+// settings of an export set and its exports. settings stored in index
+// metadata are taken from it when not set. validator, sampling and dedup
+// keep state, they are not shared between exporters.
+type Options struct {
+	Path        string
+	S3Endpoint  string
+	Stage       string
+	SeqType     *file.SeqType
+	Size        int64
+	Debug       bool
+	Valid       *file.Validator
+	Header      *file.HeaderFormat
+	Wrap        int
+	Threads     int
+	Profile     *file.Profile
+	Backend     string
+	Metadata    bool
+	Sample      *file.Sampling
+	Dedup       *file.Dedup
+	DedupScope  string
+	ReadIndex   bool
+	Target      string
+	Paired      string
+	OnError     string
+	NodeTimeout time.Duration
+	IdleTimeout time.Duration
+}
+
+func NewOptions() Options {
+	return Options{
+		Path:        "",
+		S3Endpoint:  "",
+		Stage:       "",
+		SeqType:     nil,
+		Size:        0,
+		Debug:       false,
+		Valid:       nil,
+		Header:      nil,
+		Wrap:        -1,
+		Threads:     1,
+		Profile:     nil,
+		Backend:     "",
+		Metadata:    true,
+		Sample:      nil,
+		Dedup:       nil,
+		DedupScope:  "metagenome",
+		ReadIndex:   false,
+		Target:      "",
+		Paired:      "",
+		OnError:     POLICY_FAIL,
+		NodeTimeout: 0,
+		IdleTimeout: 0,
+	}
+}
+
+// exporter owns the index and writer of its export set, exporters of
+// different sets can run in one process
 type Exporter struct {
-	SC    shock.ShockClient
-	RC    *httpclient.RestClient
-	Path  string
-	Stage string
-	Size  int64
-	Debug bool
-	Query url.Values
+	Options
+	SC      shock.ShockClient
+	RC      *httpclient.RestClient
+	FS      storage.Storage
+	Query   url.Values
+	Store   index.Backend
+	Indexes *index.Indexes
+	Meta    *index.Meta
+	Files   *FileNaming
+	writer  *RWBuffer
+	nodes   nodeSource
+	retry   map[string]bool
 }
 
-func NewExporter(dir string, stage string, size int64, debug bool) *Exporter {
+func New(opts Options) *Exporter {
 	return &Exporter{
-		SC:    shock.ShockClient{},
-		RC:    &httpclient.RestClient{},
-		Path:  dir,
-		Stage: stage,
-		Size:  size,
-		Debug: debug,
-		Query: url.Values{},
+		Options: opts,
+		SC:      shock.ShockClient{},
+		RC:      &httpclient.RestClient{},
+		FS:      nil,
+		Query:   url.Values{},
+		Store:   nil,
+		Indexes: index.NewExportIndex(),
+		Meta:    index.NewMeta(),
+		Files:   NewFileNaming(),
+		writer:  NewRecordWriter(),
+		nodes:   nil,
+		retry:   nil,
 	}
 }
 
+func NewExporter(dir string, stage string, size int64, debug bool) *Exporter {
+	opts := NewOptions()
+	opts.Path = dir
+	opts.Stage = stage
+	opts.Size = size
+	opts.Debug = debug
+	return New(opts)
+}
+
+// node query is run by Export once stage is checked against index metadata
 func (e *Exporter) Init(project string, shockhost string) (err error) {
 	e.Query.Set("type", "metagenome")
-	e.Query.Set("stage_name", e.Stage)
 	e.Query.Set("direction", "asc")
 	e.Query.Set("order", "project_id")
 	if project != "" {
@@ -55,39 +135,72 @@ func (e *Exporter) Init(project string, shockhost string) (err error) {
 	}
 	e.SC.Host = shockhost
 	e.SC.Debug = e.Debug
-	e.RC, err = e.SC.QueryPaginated(RESOURCE, e.Query, PAGE_SIZE, 0)
 	return
 }
 
 func (e *Exporter) Index(force bool) (err error) {
-	ifile := IndexFile(e.Path)
-	if _, oerr := os.Stat(ifile); oerr == nil {
-		if !force {
-			err = fmt.Errorf("index file %s already exists, use --force to overwrite", ifile)
-			return
-		} else {
-			os.Remove(ifile)
-		}
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	if e.Store.Exists() && !force {
+		err = fmt.Errorf("index file %s already exists, use --force to overwrite", e.Store.Path())
+		return
 	}
-	err = index.ExportIndex.Init(ifile)
+	// keep metadata of existing index, rebuild the indexes
+	err = e.loadIndex()
 	if err != nil {
 		return
 	}
+	e.Indexes.Reset()
 	files := e.exportFiles()
 	if len(files) > 0 {
-		err = index.ExportIndex.IndexAllFiles(files)
+		err = e.Indexes.IndexAllFiles(e.FS, files, e.Header, e.Paired == PAIRED_INTERLEAVED)
 		if err != nil {
 			return
 		}
 	}
-	err = index.ExportIndex.Save(ifile)
+	// records of split files are pairs
+	if e.Files.Mates {
+		for _, i := range *e.Indexes {
+			for m, n := range i.Records {
+				i.AddPairs(m, n)
+			}
+		}
+	}
+	// link sidecars found for indexed projects
+	for _, i := range *e.Indexes {
+		if name := MetadataName(i.Project); e.FS.Exists(name) {
+			i.Link(name)
+		}
+	}
+	err = e.Store.Save(e.Indexes, e.Meta)
+	if err != nil {
+		return
+	}
+	err = e.writeTargetMaps()
 	return
 }
 
 func (e *Exporter) Clean() (err error) {
+	// directory may be missing until a stopped repack swap is finished
+	if !storage.IsRemote(e.Path) {
+		if err = finishRepack(e.Path); err != nil {
+			return
+		}
+	}
 	// retrieve index
-	ifile := IndexFile(e.Path)
-	err = index.ExportIndex.Init(ifile)
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	err = e.loadIndexPending()
+	if err != nil {
+		return
+	}
+	err = e.cleanRemove()
 	if err != nil {
 		return
 	}
@@ -96,49 +209,87 @@ func (e *Exporter) Clean() (err error) {
 	var extra []string
 	var indexFiles []string
 
-	for _, fint := range index.ExportIndex.FileList(0) {
-		indexFiles = append(indexFiles, FileFromInt(fint, e.Path))
+	for _, fint := range e.Indexes.FileList(0) {
+		indexFiles = append(indexFiles, e.Files.fileNames(fint)...)
 	}
-	for _, f := range e.exportFiles() {
+	for _, f := range e.allExportFiles() {
 		pos := SliceIndex(len(indexFiles), func(i int) bool { return indexFiles[i] == f })
 		if pos == -1 {
 			extra = append(extra, f)
 		}
 	}
 	for _, f := range extra {
-		fmt.Fprintf(os.Stdout, fmt.Sprintf("removing non-indexed file: %s\n", f))
-		os.Remove(f)
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("removing non-indexed file: %s\n", e.FS.Location(f)))
+		e.FS.Delete(f)
+	}
+	// read indexes of files not in index
+	indexReads := make(map[string]bool)
+	for _, fint := range e.Indexes.FileList(0) {
+		indexReads[ReadIndexName(fint)] = true
+	}
+	readIndexes, _ := e.FS.List(fmt.Sprintf("*%s", READ_INDEX_SUFFIX))
+	for _, f := range readIndexes {
+		if !indexReads[f] {
+			fmt.Fprintf(os.Stdout, fmt.Sprintf("removing non-indexed read index: %s\n", e.FS.Location(f)))
+			e.FS.Delete(f)
+		}
+	}
+	// sidecars of projects not in index
+	linked := make(map[string]bool)
+	for _, i := range *e.Indexes {
+		if i.Metadata != "" {
+			linked[i.Metadata] = true
+			linked[MetadataTSVName(i.Metadata)] = true
+		}
+	}
+	sidecars, _ := e.FS.List(fmt.Sprintf("*%s.*", METADATA_SUFFIX))
+	for _, f := range sidecars {
+		if !linked[f] {
+			fmt.Fprintf(os.Stdout, fmt.Sprintf("removing non-indexed metadata file: %s\n", e.FS.Location(f)))
+			e.FS.Delete(f)
+		}
 	}
 
 	// truncate last index end file to correct length
-	lastIndex := index.ExportIndex.Get()
+	if e.Indexes.Len() == 0 {
+		return
+	}
+	lastIndex := e.Indexes.Get()
 	err = e.truncateExportFile(lastIndex.EndFile, lastIndex.EndRecord)
 	return
 }
 
 func (e *Exporter) Remove(count int) (err error) {
 	// retrieve index
-	ifile := IndexFile(e.Path)
-	err = index.ExportIndex.Init(ifile)
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	err = e.loadIndex()
 	if err != nil {
 		return
 	}
-	if index.ExportIndex.Len() == 0 {
+	if e.Indexes.Len() == 0 {
 		fmt.Fprintf(os.Stdout, "index is empty, nothing to remove\n")
 		// do nothing
-	} else if index.ExportIndex.Len() <= count {
+	} else if e.Indexes.Len() <= count {
 		fmt.Fprintf(os.Stdout, "removing all indexes / export files\n")
 		// delete all indexed export files and index
-		for _, fint := range index.ExportIndex.FileList(0) {
-			fname := FileFromInt(fint, e.Path)
-			os.Remove(fname)
+		for _, fint := range e.Indexes.FileList(0) {
+			e.Files.deleteFiles(e.FS, fint)
+			deleteReadIndex(e.FS, fint)
+		}
+		for _, i := range *e.Indexes {
+			deleteMetadata(e.FS, i.Metadata)
 		}
-		os.Remove(ifile)
+		e.deleteTargetMaps()
+		e.Store.Delete()
 	} else {
 		fmt.Fprintf(os.Stdout, fmt.Sprintf("removing last %d index(es) / file(s)\n", count))
-		newLastPos := index.ExportIndex.Len() - count - 1
-		newLastIndex := (*index.ExportIndex)[newLastPos]
-		filesRemove := index.ExportIndex.FileList(newLastPos + 1)
+		newLastPos := e.Indexes.Len() - count - 1
+		newLastIndex := (*e.Indexes)[newLastPos]
+		filesRemove := e.Indexes.FileList(newLastPos + 1)
 		lastFile := newLastIndex.EndFile
 		if lastFile == 0 || newLastIndex.EndRecord == 0 || !newLastIndex.Completed {
 			err = fmt.Errorf("export set in bad state, new last index (position=%d, project=%s) is incomplete", newLastPos, newLastIndex.Project)
@@ -150,51 +301,95 @@ func (e *Exporter) Remove(count int) (err error) {
 		}
 		// delete all but new last export files
 		for _, fint := range filesRemove {
-			fname := FileFromInt(fint, e.Path)
-			os.Remove(fname)
+			e.Files.deleteFiles(e.FS, fint)
+			deleteReadIndex(e.FS, fint)
+		}
+		for _, i := range (*e.Indexes)[newLastPos+1:] {
+			deleteMetadata(e.FS, i.Metadata)
 		}
 		// delete indexes from end
-		index.ExportIndex.RemoveFromEnd(count)
-		index.ExportIndex.Save(ifile)
+		e.Indexes.RemoveFromEnd(count)
+		err = e.Store.Save(e.Indexes, e.Meta)
+		if err != nil {
+			return
+		}
 
 		err = e.truncateExportFile(lastFile, newLastIndex.EndRecord)
 		if err != nil {
 			return
 		}
+		err = e.writeTargetMaps()
 	}
 	return
 }
 
-func (e *Exporter) Export() (err error) {
+// export stops once ctx is done. a stopped or failed export is cleaned
+// back to its last finished project, the next export resumes from there.
+func (e *Exporter) Export(ctx context.Context) (err error) {
 	// retrieve index
-	ifile := IndexFile(e.Path)
-	err = index.ExportIndex.Init(ifile)
+	err = e.openIndex()
 	if err != nil {
 		return
 	}
+	defer e.Store.Close()
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+	// nodes are queried here unless listed for several stages at once
+	if e.nodes == nil {
+		e.Query.Set("stage_name", e.Stage)
+		e.nodes, err = e.queryNodes(ctx, e.Query)
+		if err != nil {
+			return
+		}
+	}
 	// validate index
-	if ok, proj, pos := index.ExportIndex.IsComplete(); !ok {
-		err = fmt.Errorf("export set in bad state: project %s (%d out of %d exports) is incomplete", proj, pos, index.ExportIndex.Len())
+	if ok, proj, pos := e.Indexes.IsComplete(); !ok {
+		err = fmt.Errorf("export set in bad state: project %s (%d out of %d exports) is incomplete", proj, pos, e.Indexes.Len())
 		return
 	}
-	if ok, missing := DirHasFiles(index.ExportIndex.FileList(0), e.Path); !ok {
+	if ok, missing := e.Files.DirHasFiles(e.Indexes.FileList(0), e.FS); !ok {
 		err = fmt.Errorf("export set in bad state: directory missing files\n\t%s\n", strings.Join(missing, "\n\t"))
 		return
 	}
-	if ok, missing := index.ExportIndex.HasFiles(e.exportFiles()); !ok {
+	if ok, missing := e.Indexes.HasFiles(e.allExportFiles()); !ok {
 		err = fmt.Errorf("export set in bad state: index missing files\n\t%s\n", strings.Join(missing, "\n\t"))
 		return
 	}
+	if err = checkPolicy(e.OnError); err != nil {
+		return
+	}
+	ledger, err := LoadFailureLedger(e.FS)
+	if err != nil {
+		return
+	}
 
 	// start writer after index is good
 	// exporter doesn't touch index after this, only writer
-	RecordWriter.Init(e.Path, e.Size, e.Debug)
-	go RecordWriter.WriterHandle(false, 0, 0)
+	e.writer.Init(e.FS, e.Size, e.Threads, e.Profile, e.Store, e.Debug)
+	e.writer.SetIndex(e.Files, e.Indexes, e.Meta)
+	e.writer.Metadata = e.Metadata
+	e.writer.ReadIndex = e.ReadIndex
+	go e.writer.WriterHandle(false, 0, 0)
+
+	// records failing validation go here, counts of run in report
+	run := newExportRun(e)
+	run.ledger = ledger
+	defer run.abort(&err)
+	defer run.rejects.Close()
+	defer run.report.Close()
 
 	// export per metagenome
+	exported := e.Indexes.Projects()
 	prevProject := ""
+	// node attributes of current project, only kept for metadata
+	var nodes []*NodeMetadata
 	for {
-		item, er := e.RC.Next()
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		item, er := e.nodes.Next(ctx)
 		// non eof error
 		if er != nil {
 			if er != io.EOF {
@@ -204,173 +399,642 @@ func (e *Exporter) Export() (err error) {
 			break
 		}
 
-		node := item.Data.(map[string]interface{})
-		attr, aok := node["attributes"].(map[string]interface{})
-		nodeID, nok := node["id"].(string)
-		projID, pok := attr["project_id"].(string)
-		mgID, mok := attr["id"].(string)
-		if !(aok && nok && pok && mok) {
-			err = fmt.Errorf("Invalid shock node: %+v", node)
+		nodeID, projID, mgID, nerr := parseNode(item.Data)
+		if nerr != nil {
+			err = nerr
 			return
 		}
 
-		// skip missing IDs
+		// skip missing IDs, and projects not retried
 		if (projID == "") || (mgID == "") {
 			continue
 		}
+		if (e.retry != nil) && !e.retry[projID] {
+			continue
+		}
 		// skip first project if in index
-		if (prevProject == "") && index.ExportIndex.Contains(projID) {
+		if (prevProject == "") && exported[projID] {
 			fmt.Fprintf(os.Stdout, fmt.Sprintf("skipping: project=%s, metagenome=%s, node=%s\n", projID, mgID, nodeID))
 			continue
 		}
 		// new project, not first
 		if (prevProject != "") && (prevProject != projID) {
 			// skip projects already exported
-			if index.ExportIndex.Contains(projID) {
+			if exported[projID] {
 				fmt.Fprintf(os.Stdout, fmt.Sprintf("skipping: project=%s, metagenome=%s, node=%s\n", projID, mgID, nodeID))
 				continue
 			}
+			if err = run.flushMates(ctx, prevProject); err != nil {
+				return
+			}
+			if e.Metadata {
+				if err = writeMetadata(e.FS, prevProject, nodes); err != nil {
+					return
+				}
+				nodes = nil
+			}
 			// let writer know to finalize index for previous, then wait till done
-			RecordWriter.RecBuffer <- nil
-			_ = <-RecordWriter.Done
+			if err = run.endProject(ctx, prevProject); err != nil {
+				return
+			}
 		}
 		prevProject = projID
+		run.project = projID
+		if e.Metadata {
+			nodes = append(nodes, &NodeMetadata{Project: projID, Metagenome: mgID, Node: nodeID, Attributes: nodeAttributes(item.Data)})
+		}
 
-		fmt.Fprintf(os.Stdout, fmt.Sprintf("exporting: project=%s, metagenome=%s, node=%s\n", projID, mgID, nodeID))
-		downloadUrl := fmt.Sprintf("%s/%s/%s?download", e.SC.Host, RESOURCE, nodeID)
-		if e.Debug {
-			fmt.Fprintf(os.Stdout, downloadUrl+"\n")
+		// R1 and R2 nodes of a metagenome are exported together
+		mate := 0
+		if e.paired() {
+			mate = nodeMate(item.Data)
+		}
+		if mate == 0 {
+			err = run.exportMetagenome(ctx, projID, mgID, []string{nodeID})
+		} else {
+			err = run.addMate(ctx, projID, mgID, nodeID, mate)
 		}
+		if err != nil {
+			return
+		}
+	} // done with metagenome list
+	if err = run.flushMates(ctx, prevProject); err != nil {
+		return
+	}
+	if e.Metadata && (prevProject != "") {
+		if err = writeMetadata(e.FS, prevProject, nodes); err != nil {
+			return
+		}
+	}
+	// let writer know to finalize index for last projet, then wait till done
+	if err = run.endProject(ctx, prevProject); err != nil {
+		return
+	}
 
-		shockStream, serr := shock.FetchShockStream(downloadUrl, "")
-		if serr != nil {
-			err = serr
+	// 2nd nil in a row means all done exporting, writer can end
+	err = run.endProject(ctx, "")
+	run.ended = true
+	if err != nil {
+		return
+	}
+	err = e.writeTargetMaps()
+	return
+}
+
+// node holding one side of paired reads, waiting for the other
+type mateNode struct {
+	node string
+	mate int
+}
+
+// state of an export run shared by its metagenomes
+type exportRun struct {
+	e            *Exporter
+	rejects      *RejectLog
+	report       *RunReport
+	sampler      *file.Sampler
+	accs         *accessions
+	accsProject  string
+	dedupProject string
+	header       []byte
+	mateID       []byte
+	mates        map[string]*mateNode
+	mateOrder    []string
+	ledger       *FailureLedger
+	project      string
+	failed       map[string]bool
+	ended        bool
+	// writer has records of a project not ended yet
+	open bool
+}
+
+func newExportRun(e *Exporter) *exportRun {
+	run := time.Now().UTC().Format("20060102T150405Z")
+	r := &exportRun{
+		e:       e,
+		rejects: NewRejectLog(e.FS, run),
+		report:  NewRunReport(e.FS, run, e.SeqType),
+		mates:   make(map[string]*mateNode),
+		failed:  make(map[string]bool),
+		open:    true,
+	}
+	if e.Sample != nil {
+		r.sampler = file.NewSampler(e.Sample)
+	}
+	// accession headers are numbered in write order, after any sampling hold
+	if e.Target == TARGET_BLASTDB {
+		r.accs = newAccessions(e.Header)
+	}
+	return r
+}
+
+// send record to writer, writer errors received meanwhile go by policy
+func (r *exportRun) send(ctx context.Context, record *Record) (err error) {
+	for {
+		werr := r.e.writer.Send(ctx, record)
+		if werr == nil {
+			r.open = (record != nil)
 			return
 		}
+		if werr == ctx.Err() {
+			return werr
+		}
+		if err = r.fail(werr); err != nil {
+			return
+		}
+	}
+}
 
-		sr := file.NewReader(shockStream, false)
-		eof := false
-		rnum := 0
+// let writer finish project, or the run if projID is empty. failures of a
+// project exported again are resolved once it is done without any.
+func (r *exportRun) endProject(ctx context.Context, projID string) (err error) {
+	// writer takes 2nd nil in a row as end of run, a project with all its
+	// nodes skipped has nothing to finish
+	if r.open || (projID == "") {
+		if err = r.send(ctx, nil); err != nil {
+			return
+		}
+		errs, werr := r.e.writer.Wait(ctx)
+		err = werr
+		for _, werr := range errs {
+			if ferr := r.fail(werr); (ferr != nil) && (err == nil) {
+				err = ferr
+			}
+		}
+	}
+	if (err != nil) || (projID == "") || r.failed[projID] {
+		return
+	}
+	err = r.ledger.Resolve(projID)
+	return
+}
 
-		// process per record, push in buffer
-		for {
-			rnum += 1
-			seq, er := sr.Read()
-			if er != nil {
-				if er != io.EOF {
-					err = er
+// stop writer of failed export and clean set back to last finished project
+func (r *exportRun) abort(err *error) {
+	if (*err == nil) || r.ended {
+		return
+	}
+	for _, werr := range r.e.writer.Abort() {
+		r.fail(werr)
+	}
+	fmt.Fprintf(os.Stderr, fmt.Sprintf("export stopped: %s\n", (*err).Error()))
+	r.e.Indexes.Reset()
+	if cerr := r.e.Clean(); cerr != nil {
+		fmt.Fprintf(os.Stderr, fmt.Sprintf("error cleaning export set, run clean before next export: %s\n", cerr.Error()))
+	}
+}
+
+// failed node download goes by policy, unless the export is stopped
+func (r *exportRun) nodeFailed(ctx context.Context, projID string, mgID string, node string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == context.DeadlineExceeded {
+		err = fmt.Errorf("node timeout of %s exceeded", r.e.NodeTimeout)
+	}
+	return r.fail(&NodeError{Project: projID, Metagenome: mgID, Node: node, Err: err})
+}
+
+// failed node or record goes to ledger, with skip policy the export goes on.
+// writer errors other than a bad record always stop the export.
+func (r *exportRun) fail(err error) error {
+	werr, isWrite := err.(*WriteError)
+	if isWrite && (werr.Project == "") {
+		werr.Project = r.project
+	}
+	if lerr := r.ledger.Add(err); lerr != nil {
+		return fmt.Errorf("%s, failure ledger not saved: %s", err.Error(), lerr.Error())
+	}
+	r.failed[r.ledger.Failures[len(r.ledger.Failures)-1].Project] = true
+	if (isWrite && !werr.Skippable()) || (r.e.OnError != POLICY_SKIP) {
+		return err
+	}
+	return nil
+}
+
+// export metagenome once both its mate nodes are listed
+func (r *exportRun) addMate(ctx context.Context, projID string, mgID string, nodeID string, mate int) (err error) {
+	other, ok := r.mates[mgID]
+	if ok && (other.mate != mate) {
+		delete(r.mates, mgID)
+		nodeIDs := []string{other.node, nodeID}
+		if mate == 1 {
+			nodeIDs = []string{nodeID, other.node}
+		}
+		err = r.exportMetagenome(ctx, projID, mgID, nodeIDs)
+		return
+	}
+	// second node of same mate, first one has no pair
+	if ok {
+		fmt.Fprintf(os.Stderr, fmt.Sprintf("no mate node for node %s of metagenome %s, exported unpaired\n", other.node, mgID))
+		if err = r.exportMetagenome(ctx, projID, mgID, []string{other.node}); err != nil {
+			return
+		}
+	} else {
+		r.mateOrder = append(r.mateOrder, mgID)
+	}
+	r.mates[mgID] = &mateNode{node: nodeID, mate: mate}
+	return
+}
+
+// mate nodes of project left without their pair are exported unpaired
+func (r *exportRun) flushMates(ctx context.Context, projID string) (err error) {
+	for _, mgID := range r.mateOrder {
+		other, ok := r.mates[mgID]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, fmt.Sprintf("no mate node for node %s of metagenome %s, exported unpaired\n", other.node, mgID))
+		if err = r.exportMetagenome(ctx, projID, mgID, []string{other.node}); err != nil {
+			return
+		}
+	}
+	r.mates = make(map[string]*mateNode)
+	r.mateOrder = nil
+	return
+}
+
+// stream records of metagenome nodes into writer, two nodes are R1 and R2
+func (r *exportRun) exportMetagenome(ctx context.Context, projID string, mgID string, nodeIDs []string) (err error) {
+	e := r.e
+	nodeList := strings.Join(nodeIDs, ",")
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("exporting: project=%s, metagenome=%s, node=%s\n", projID, mgID, nodeList))
+	mr := r.report.Add(projID, mgID, nodeList)
+	// duplicates are found within metagenome, or within project
+	if (e.Dedup != nil) && ((e.DedupScope != "project") || (projID != r.dedupProject)) {
+		e.Dedup.Reset()
+		r.dedupProject = projID
+	}
+	// accessions number on across nodes of a metagenome
+	if (r.accs != nil) && (projID != r.accsProject) {
+		r.accs.Reset()
+		r.accsProject = projID
+	}
+	// downloads of metagenome nodes end with node timeout
+	nodeCtx := ctx
+	if e.NodeTimeout > 0 {
+		var cancel context.CancelFunc
+		nodeCtx, cancel = context.WithTimeout(ctx, e.NodeTimeout)
+		defer cancel()
+	}
+	var readers []*file.Reader
+	for _, nodeID := range nodeIDs {
+		shockStream, serr := e.fetchNode(nodeCtx, nodeID)
+		if serr != nil {
+			err = r.nodeFailed(ctx, projID, mgID, nodeID, serr)
+			return
+		}
+		defer shockStream.Close()
+		readers = append(readers, file.NewReader(shockStream, false))
+	}
+	var mates *file.Reader
+	if len(readers) > 1 {
+		mates = readers[1]
+	}
+	pr := newPairReader(readers[0], mates, e.paired())
+	sampler := r.sampler
+	accs := r.accs
+	rnum := 0
+
+	// process per read and its mate, push in buffer
+	// records read before a failed node are kept, its project is
+	// exported again on retry
+	for {
+		rp, er := pr.Read()
+		if er != nil {
+			if er != io.EOF {
+				if err = r.nodeFailed(ctx, projID, mgID, nodeList, er); err != nil {
 					return
 				}
-				eof = true
 			}
-			if seq == nil {
-				if eof {
+			break
+		}
+		rnum += 1
+		mr.Read += rp.Len()
+
+		// validate, reject bad records along with their mate
+		if e.Valid != nil {
+			var verr error
+			// rejects are logged as read, the mate checked first is sanitized
+			var orig [2][]byte
+			for n, seq := range rp.Seqs() {
+				orig[n] = seq.Seq
+			}
+			for n, seq := range rp.Seqs() {
+				if verr = e.Valid.Check(seq); verr != nil {
 					break
-				} else {
-					continue
+				}
+				// validator buffer is reused for the mate
+				if (n == 0) && (rp.R2 != nil) {
+					seq.Seq = append([]byte(nil), seq.Seq...)
 				}
 			}
+			if verr != nil {
+				for n, seq := range rp.Seqs() {
+					if err = r.rejects.Add(projID, mgID, seq.ID, orig[n], verr.Error()); err != nil {
+						return
+					}
+				}
+				mr.Rejected += rp.Len()
+				continue
+			}
+		}
+
+		// split files only hold pairs
+		if e.paired() && (rp.R2 == nil) {
+			mr.Unpaired += 1
+			if e.Paired == PAIRED_SPLIT {
+				continue
+			}
+		}
 
-			// get record, send to buffer
-			newHead := bytes.Join([][]byte{[]byte(projID), []byte(mgID), seq.ID}, []byte{'|'})
-			seq.ID = newHead
-			record := &Record{
-				R: seq.Record(),
-				P: projID,
-				M: mgID,
+		// drop sequences seen before, pairs by both mates
+		if (e.Dedup != nil) && rp.Duplicate(e.Dedup) {
+			mr.Duplicates += rp.Len()
+			continue
+		}
+
+		// sample on original record ID, mates on their shared key
+		var score uint64
+		if sampler != nil {
+			var keep bool
+			if keep, score = sampler.Keep(mgID, e.sampleID(rp.R1.ID)); !keep {
+				continue
 			}
+		}
+
+		// held accession records keep only their sequence until numbered
+		if (accs != nil) && (sampler != nil) && sampler.Holds() {
+			sampler.Hold(score, append([]byte(nil), rp.R1.Seq...))
+			continue
+		}
+
+		// get record, send to buffer
+		// header buffer is reused, record is a new copy
+		record := &Record{
+			P: projID,
+			M: mgID,
+		}
+		if accs != nil {
+			record.R = accs.Record(projID, mgID, rp.R1.Seq, e.Wrap)
+		} else if rp.R2 != nil {
+			record.R = r.record(projID, mgID, rp.R1, 1)
+			record.R2 = r.record(projID, mgID, rp.R2, 2)
+		} else {
+			record.R = r.record(projID, mgID, rp.R1, 0)
+		}
 
-			RecordWriter.RecBuffer <- record
+		if (sampler != nil) && sampler.Holds() {
+			if record.R2 != nil {
+				sampler.Hold(score, joinRecords(record.R, record.R2))
+			} else {
+				sampler.Hold(score, record.R)
+			}
+			continue
+		}
+		if err = r.send(ctx, record); err != nil {
+			return
+		}
+		mr.CountRecord(record)
 
-			if e.Debug && (rnum%100 == 0) {
-				fmt.Fprintf(os.Stdout, ".")
+		if e.Debug && (rnum%100 == 0) {
+			fmt.Fprintf(os.Stdout, ".")
+		}
+	} // done with file
+	if (sampler != nil) && sampler.Holds() {
+		for _, rec := range sampler.Release() {
+			record := &Record{R: rec, P: projID, M: mgID}
+			if accs != nil {
+				record.R = accs.Record(projID, mgID, rec, e.Wrap)
+			} else if e.paired() {
+				record.R, record.R2 = splitRecords(rec)
 			}
-			if eof {
-				break
+			if err = r.send(ctx, record); err != nil {
+				return
 			}
-		} // done with file
-		if e.Debug {
-			fmt.Fprintf(os.Stdout, fmt.Sprintf("\nmetagenome %s done exporting\n", mgID))
+			mr.CountRecord(record)
 		}
-	} // done with metagenome list
-	// let writer know to finalize index for last projet, then wait till done
-	RecordWriter.RecBuffer <- nil
-	_ = <-RecordWriter.Done
+	}
+	if e.Dedup != nil {
+		mr.DupFalseRate = e.Dedup.FalsePositiveRate()
+	}
+	if (e.Paired == PAIRED_SPLIT) && (mr.Pairs == 0) && (mr.Unpaired > 0) {
+		fmt.Fprintf(os.Stderr, fmt.Sprintf("metagenome %s has no read pairs, %d unpaired reads left out of split files\n", mgID, mr.Unpaired))
+	}
+	if e.Debug {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("\nmetagenome %s done exporting\n", mgID))
+	}
+	return
+}
 
-	// 2nd nil in a row means all done exporting, writer can end
-	RecordWriter.RecBuffer <- nil
-	_ = <-RecordWriter.Done
+// fasta record with header of template, mates get /1 and /2 IDs
+func (r *exportRun) record(projID string, mgID string, seq *file.Seq, mate int) []byte {
+	if mate > 0 {
+		r.mateID = file.AppendMateID(r.mateID[:0], seq.ID, mate)
+		seq.ID = r.mateID
+	}
+	r.header = r.e.Header.AppendFormat(r.header[:0], projID, mgID, seq)
+	seq.ID = r.header
+	return seq.WrappedRecord(r.e.Wrap)
+}
+
+// export set pairs mates
+func (e *Exporter) paired() bool {
+	return (e.Paired != "") && (e.Paired != PAIRED_NONE)
+}
+
+// record ID sampled on, mates share the ID without mate number
+func (e *Exporter) sampleID(id []byte) []byte {
+	if !e.paired() {
+		return id
+	}
+	key, _ := file.MateID(id)
+	return key
+}
+
+// node, project and metagenome IDs of shock node
+func parseNode(data interface{}) (nodeID string, projID string, mgID string, err error) {
+	node, dok := data.(map[string]interface{})
+	attr, aok := node["attributes"].(map[string]interface{})
+	nodeID, nok := node["id"].(string)
+	projID, pok := attr["project_id"].(string)
+	mgID, mok := attr["id"].(string)
+	if !(dok && aok && nok && pok && mok) {
+		err = fmt.Errorf("Invalid shock node: %+v", data)
+	}
 	return
 }
 
 func (e *Exporter) truncateExportFile(fint int, newRec int) (err error) {
-	filePath := FileFromInt(fint, e.Path)
-	tempFile := filePath + ".temp"
-	err = os.Rename(filePath, tempFile)
+	fname := e.Files.FileName(fint)
+	filePath := e.FS.Location(fname)
+	for _, f := range e.Files.fileNames(fint) {
+		err = e.FS.Rename(f, f+".temp")
+		if err != nil {
+			return
+		}
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("truncating file: %s\n", filePath))
+	err = truncateReadIndex(e.FS, fint, newRec)
 	if err != nil {
 		return
 	}
-	fmt.Fprintf(os.Stdout, fmt.Sprintf("truncating file: %s\n", filePath))
 
 	// start writehandle
-	RecordWriter.Init(e.Path, e.Size, e.Debug)
-	go RecordWriter.WriterHandle(true, fint, 1)
+	// last records are copied by a writer of its own
+	// truncate runs to its end, a stop would leave only .temp files
+	ctx := context.Background()
+	w := NewRecordWriter()
+	w.Init(e.FS, e.Size, e.Threads, e.Profile, nil, e.Debug)
+	w.SetIndex(e.Files, nil, nil)
+	go w.WriterHandle(true, fint, 1)
 
-	// open last file
-	tempHandle, terr := os.Open(tempFile)
-	if terr != nil {
-		err = terr
-		return
+	// open last file, and its mates
+	var readers []*file.Reader
+	for _, f := range e.Files.fileNames(fint) {
+		tempHandle, terr := e.FS.Open(f + ".temp")
+		if terr != nil {
+			err = terr
+			return
+		}
+		defer tempHandle.Close()
+		readers = append(readers, file.NewReader(tempHandle, true))
 	}
-	defer tempHandle.Close()
-	tempReader := file.NewReader(tempHandle, true)
 
 	// copy last records
 	for rnum := 1; rnum <= newRec; rnum++ {
-		seq, er := tempReader.Read()
-		if er != nil {
-			if er == io.EOF {
-				err = fmt.Errorf("file %s in bad state, reached EOF before last record read: %d of %d records", filePath, rnum, newRec)
+		record := &Record{
+			P: "",
+			M: "",
+		}
+		for n, tempReader := range readers {
+			seq, er := tempReader.Read()
+			if er != nil {
+				if er == io.EOF {
+					err = fmt.Errorf("file %s in bad state, reached EOF before last record read: %d of %d records", filePath, rnum, newRec)
+				} else {
+					err = fmt.Errorf("file %s in bad state, invalid record found: %d of %d records: %s", filePath, rnum, newRec, er.Error())
+				}
+				return
+			}
+			if n == 0 {
+				record.R = seq.WrappedRecord(e.Wrap)
 			} else {
-				err = er
+				record.R2 = seq.WrappedRecord(e.Wrap)
 			}
-			return
 		}
-		if seq == nil {
-			err = fmt.Errorf("file %s in bad state, invalid record found: %d of %d records", filePath, rnum, newRec)
+		if err = w.Send(ctx, record); err != nil {
 			return
 		}
-		record := &Record{
-			R: seq.Record(),
-			P: "",
-			M: "",
+	}
+	for n := 0; n < 2; n++ {
+		if err = w.Send(ctx, nil); err != nil {
+			return
 		}
-		RecordWriter.RecBuffer <- record
 	}
-	RecordWriter.RecBuffer <- nil
-	RecordWriter.RecBuffer <- nil
-	_ = <-RecordWriter.Done
+	if errs, _ := w.Wait(ctx); len(errs) > 0 {
+		err = errs[0]
+		return
+	}
 	// delete old
-	os.Remove(tempFile)
+	for _, f := range e.Files.fileNames(fint) {
+		e.FS.Delete(f + ".temp")
+	}
 	return
 }
 
-func (e *Exporter) indexFile() string {
-	return filepath.Join(e.Path, index.INDEX_FILE)
+// backend of existing index, or requested one for new index
+func (e *Exporter) openIndex() (err error) {
+	if e.Store != nil {
+		return
+	}
+	err = e.openStorage()
+	if err != nil {
+		return
+	}
+	e.Store, err = index.OpenBackend(e.FS, e.Backend)
+	if err != nil {
+		return
+	}
+	if (e.Backend != "") && (e.Backend != e.Store.Name()) {
+		err = fmt.Errorf("export set uses %s index backend, use 'index convert --backend %s' to change it", e.Store.Name(), e.Backend)
+	}
+	return
 }
 
+// local directory or s3 bucket prefix of export set
+func (e *Exporter) openStorage() (err error) {
+	if e.FS != nil {
+		return
+	}
+	// current directory is swapped with its repack, may not be there
+	if _, ok := repackSwapFile(e.Path); ok && !storage.IsRemote(e.Path) {
+		err = fmt.Errorf("export set in bad state: repack of %s not finished, run clean", e.Path)
+		return
+	}
+	e.FS, err = storage.NewStorage(e.Path, e.S3Endpoint)
+	return
+}
+
+// retrieve index and check settings against its metadata
+func (e *Exporter) loadIndex() (err error) {
+	err = e.loadIndexPending()
+	if err != nil {
+		return
+	}
+	// files do not match index until clean finishes the removal
+	if e.Meta.Removing != nil {
+		err = fmt.Errorf("export set in bad state: removal of project %s not finished, run clean", e.Meta.Removing.Project)
+	}
+	return
+}
+
+// retrieve index, even with a removal not finished
+func (e *Exporter) loadIndexPending() (err error) {
+	err = e.Store.Load(e.Indexes, e.Meta)
+	if err != nil {
+		return
+	}
+	err = e.setMeta()
+	return
+}
+
+// names of numbered files in export set
 func (e *Exporter) exportFiles() (files []string) {
-	files, _ = filepath.Glob(filepath.Join(e.Path, fmt.Sprintf("*%s", file.FILE_SUFFIX)))
+	names, _ := e.FS.List(fmt.Sprintf("*%s", e.Files.Suffix))
+	for _, name := range names {
+		if _, ok := e.Files.FileNumber(name); ok {
+			files = append(files, name)
+		}
+	}
 	return
 }
 
-func DirHasFiles(files []int, path string) (ok bool, missing []string) {
+// names of numbered files and their R2 mates
+func (e *Exporter) allExportFiles() (files []string) {
+	names, _ := e.FS.List(fmt.Sprintf("*%s", e.Files.Suffix))
+	for _, name := range names {
+		if _, ok := e.Files.fileNumberAny(name); ok {
+			files = append(files, name)
+		}
+	}
+	return
+}
+
+func (n *FileNaming) deleteFiles(fs storage.Storage, num int) {
+	for _, f := range n.fileNames(num) {
+		fs.Delete(f)
+	}
+}
+
+func (n *FileNaming) DirHasFiles(files []int, fs storage.Storage) (ok bool, missing []string) {
 	ok = true
 	for _, i := range files {
-		f := FileFromInt(i, path)
-		if _, oerr := os.Stat(f); oerr != nil {
-			ok = false
-			missing = append(missing, f)
+		for _, f := range n.fileNames(i) {
+			if !fs.Exists(f) {
+				ok = false
+				missing = append(missing, fs.Location(f))
+			}
 		}
 	}
 	return
@@ -380,8 +1044,56 @@ func IndexFile(path string) string {
 	return filepath.Join(path, index.INDEX_FILE)
 }
 
-func FileFromInt(num int, path string) string {
-	return filepath.Join(path, fmt.Sprintf("%d%s", num, file.FILE_SUFFIX))
+// names of numbered files of an export set, set from its metadata.
+// split read pairs are written to parallel files N_R1 and N_R2, N_R1 stands
+// for the numbered file.
+type FileNaming struct {
+	Suffix string
+	Mates  bool
+}
+
+func NewFileNaming() *FileNaming {
+	return &FileNaming{Suffix: file.FILE_SUFFIX}
+}
+
+func (n *FileNaming) FileFromInt(num int, path string) string {
+	return filepath.Join(path, n.FileName(num))
+}
+
+func (n *FileNaming) FileName(num int) string {
+	if n.Mates {
+		return n.MateFileName(num, 1)
+	}
+	return fmt.Sprintf("%d%s", num, n.Suffix)
+}
+
+func (n *FileNaming) MateFileName(num int, mate int) string {
+	return fmt.Sprintf("%d_R%d%s", num, mate, n.Suffix)
+}
+
+// all files of numbered file
+func (n *FileNaming) fileNames(num int) []string {
+	if n.Mates {
+		return []string{n.MateFileName(num, 1), n.MateFileName(num, 2)}
+	}
+	return []string{n.FileName(num)}
+}
+
+// number of numbered file, false for any other name
+func (n *FileNaming) FileNumber(name string) (num int, ok bool) {
+	num, err := index.FileNum(name)
+	ok = (err == nil) && (num > 0) && (name == n.FileName(num))
+	return
+}
+
+// number of any file of numbered file, also of R2 mates
+func (n *FileNaming) fileNumberAny(name string) (num int, ok bool) {
+	if num, ok = n.FileNumber(name); ok || !n.Mates {
+		return
+	}
+	num, err := index.FileNum(name)
+	ok = (err == nil) && (num > 0) && (name == n.MateFileName(num, 2))
+	return
 }
 
 func SliceIndex(limit int, predicate func(i int) bool) int {
@@ -0,0 +1,311 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"io"
+	"os"
+	"strings"
+)
+
+// move index to another backend, old index is removed
+func (e *Exporter) ConvertIndex(backend string) (err error) {
+	err = e.openStorage()
+	if err != nil {
+		return
+	}
+	e.Store, err = index.OpenBackend(e.FS, "")
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	if !e.Store.Exists() {
+		err = fmt.Errorf("no index in %s to convert", e.Path)
+		return
+	}
+	if e.Store.Name() == backend {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("index already uses %s backend\n", backend))
+		return
+	}
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+	target, err := index.NewBackend(e.FS, backend)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	e.Indexes.MarkDirty()
+	err = target.Save(e.Indexes, e.Meta)
+	if err != nil {
+		return
+	}
+	// old index is kept unless new one reads back the same
+	converted := index.NewExportIndex()
+	err = target.Load(converted, index.NewMeta())
+	if err != nil {
+		return
+	}
+	err = sameIndexes(e.Indexes, converted)
+	if err != nil {
+		err = fmt.Errorf("converted index %s differs, %s kept: %s", target.Path(), e.Store.Path(), err.Error())
+		return
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("converted index %s to %s\n", e.Store.Path(), target.Path()))
+	err = e.Store.Delete()
+	return
+}
+
+// same projects in same order, with same metagenomes and record counts
+func sameIndexes(a *index.Indexes, b *index.Indexes) (err error) {
+	if a.Len() != b.Len() {
+		err = fmt.Errorf("%d projects, expected %d", b.Len(), a.Len())
+		return
+	}
+	for pos, i := range *a {
+		n := (*b)[pos]
+		if n.Project != i.Project {
+			err = fmt.Errorf("project %s at position %d, expected %s", n.Project, pos, i.Project)
+			return
+		}
+		if strings.Join(n.Metagenomes, ",") != strings.Join(i.Metagenomes, ",") {
+			err = fmt.Errorf("project %s has metagenomes %v, expected %v", i.Project, n.Metagenomes, i.Metagenomes)
+			return
+		}
+		if n.RecordCount() != i.RecordCount() {
+			err = fmt.Errorf("project %s has %d records, expected %d", i.Project, n.RecordCount(), i.RecordCount())
+			return
+		}
+	}
+	return
+}
+
+// print matching indexes, one per line
+func (e *Exporter) List(q index.Query, w io.Writer) (err error) {
+	found, err := e.lookup(q)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "project\tmetagenomes\tstart\tend\tcompleted\tremoved\n")
+	for _, i := range found {
+		fmt.Fprintf(w, "%s\t%s\t%d:%d\t%d:%d\t%t\t%t\n", i.Project, strings.Join(i.Metagenomes, ","), i.StartFile, i.StartRecord, i.EndFile, i.EndRecord, i.Completed, i.Removed)
+	}
+	return
+}
+
+// write records of matching indexes as fasta, only records of
+// the metagenome if one is given
+func (e *Exporter) Extract(q index.Query, w io.Writer) (err error) {
+	if (q.Project == "") && (q.Metagenome == "") {
+		err = fmt.Errorf("project or metagenome must be set for extract")
+		return
+	}
+	found, err := e.lookup(q)
+	if err != nil {
+		return
+	}
+	if len(found) == 0 {
+		err = fmt.Errorf("no index found for project=%s metagenome=%s", q.Project, q.Metagenome)
+		return
+	}
+	for _, i := range found {
+		if i.Removed {
+			continue
+		}
+		if !i.Completed {
+			err = fmt.Errorf("project %s is incomplete, run clean first", i.Project)
+			return
+		}
+		err = e.extractIndex(i, q.Metagenome, w)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (e *Exporter) lookup(q index.Query) (found []*index.Index, err error) {
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	if !e.Store.Exists() {
+		err = fmt.Errorf("no index in %s", e.Path)
+		return
+	}
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+	found, err = e.Store.Lookup(q)
+	return
+}
+
+// with sampling, records are sampled per metagenome on their header.
+// mates are written after their read, and sampled with it.
+func (e *Exporter) extractIndex(i *index.Index, mg string, w io.Writer) (err error) {
+	var sampler *file.Sampler
+	if e.Sample != nil {
+		sampler = file.NewSampler(e.Sample)
+	}
+	var pairing *matePairing
+	if e.Paired == PAIRED_INTERLEAVED {
+		pairing = &matePairing{}
+	}
+	currMG := ""
+	release := func() (err error) {
+		if (sampler == nil) || !sampler.Holds() {
+			return
+		}
+		for _, r := range sampler.Release() {
+			if _, err = w.Write(r); err != nil {
+				return
+			}
+		}
+		return
+	}
+	write := func(rp *readPair, m string) (err error) {
+		rec := rp.R1.WrappedRecord(e.Wrap)
+		if rp.R2 != nil {
+			rec = append(rec, rp.R2.WrappedRecord(e.Wrap)...)
+		}
+		if sampler == nil {
+			_, err = w.Write(rec)
+			return
+		}
+		if m != currMG {
+			if err = release(); err != nil {
+				return
+			}
+			currMG = m
+		}
+		keep, score := sampler.Keep(m, e.sampleID(rp.R1.ID))
+		if !keep {
+			return
+		}
+		if sampler.Holds() {
+			sampler.Hold(score, rec)
+			return
+		}
+		_, err = w.Write(rec)
+		return
+	}
+	// interleaved mates are paired within their metagenome
+	pairMG := ""
+	flush := func() (err error) {
+		if pairing == nil {
+			return
+		}
+		for _, rp := range pairing.Flush() {
+			if err = write(rp, pairMG); err != nil {
+				return
+			}
+		}
+		return
+	}
+	err = e.readIndex(i, func(seq *file.Seq, mate *file.Seq, m string) (err error) {
+		if (mg != "") && (m != mg) {
+			return
+		}
+		if pairing == nil {
+			return write(&readPair{R1: seq, R2: mate}, m)
+		}
+		if m != pairMG {
+			if err = flush(); err != nil {
+				return
+			}
+			pairMG = m
+		}
+		for _, rp := range pairing.Add(seq) {
+			if err = write(rp, m); err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	if err = flush(); err != nil {
+		return
+	}
+	err = release()
+	return
+}
+
+// call fn with each record of index, its mate in split files and its metagenome
+func (e *Exporter) readIndex(i *index.Index, fn func(*file.Seq, *file.Seq, string) error) (err error) {
+	for fnum := i.StartFile; fnum <= i.EndFile; fnum++ {
+		first := 1
+		last := -1
+		if fnum == i.StartFile {
+			first = i.StartRecord
+		}
+		if fnum == i.EndFile {
+			last = i.EndRecord
+		}
+		err = e.readFile(fnum, first, last, fn)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// records first to last (-1 for end of file) of numbered file, with
+// mates of same record number read from the R2 file of split pairs
+func (e *Exporter) readFile(fnum int, first int, last int, fn func(*file.Seq, *file.Seq, string) error) (err error) {
+	fname := e.FS.Location(e.Files.FileName(fnum))
+	fh, err := e.FS.Open(e.Files.FileName(fnum))
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	fr := file.NewReader(fh, true)
+	var mr *file.Reader
+	if e.Files.Mates {
+		mh, merr := e.FS.Open(e.Files.MateFileName(fnum, 2))
+		if merr != nil {
+			err = merr
+			return
+		}
+		defer mh.Close()
+		mr = file.NewReader(mh, true)
+	}
+	for rnum := 1; (last == -1) || (rnum <= last); rnum++ {
+		seq, er := fr.Read()
+		if er != nil {
+			if er == io.EOF {
+				if last != -1 {
+					err = fmt.Errorf("file %s in bad state, reached EOF before last record read: %d of %d records", fname, rnum, last)
+				}
+			} else {
+				err = er
+			}
+			return
+		}
+		var mate *file.Seq
+		if mr != nil {
+			if mate, err = mr.Read(); err != nil {
+				err = fmt.Errorf("file %s record %d has no mate: %s", fname, rnum, err.Error())
+				return
+			}
+		}
+		if rnum < first {
+			continue
+		}
+		_, m, perr := e.Header.ParseHeader(string(seq.ID))
+		if perr != nil {
+			err = fmt.Errorf("file %s record %d: %s", fname, rnum, perr.Error())
+			return
+		}
+		err = fn(seq, mate, m)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,128 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// interleaved set of one file, ids are written in given order
+func writeInterleaved(t *testing.T, ids []string) (*Exporter, *index.Index) {
+	opts := NewOptions()
+	opts.Path = t.TempDir()
+	opts.Paired = PAIRED_INTERLEAVED
+	e := New(opts)
+	if err := e.openIndex(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Store.Close() })
+	if err := e.setMeta(); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, id := range ids {
+		data = append(data, (&file.Seq{ID: []byte(id), Seq: []byte("ACGT")}).Record()...)
+	}
+	fh, err := e.FS.Create(e.Files.FileName(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := file.NewWriter(fh, 1, e.Profile)
+	if err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	fh.Close()
+	return e, &index.Index{Project: "mgp1", StartFile: 1, StartRecord: 1, EndFile: 1, EndRecord: len(ids), Completed: true}
+}
+
+// pairs of read_1 to read_n in two metagenomes, pairs in given order
+func interleavedIDs(order []int) (ids []string) {
+	for _, mg := range []string{"mgm1.3", "mgm2.3"} {
+		for _, n := range order {
+			ids = append(ids, fmt.Sprintf("mgp1|%s|read_%d/1", mg, n), fmt.Sprintf("mgp1|%s|read_%d/2", mg, n))
+		}
+	}
+	return
+}
+
+func extractIDs(t *testing.T, e *Exporter, i *index.Index, s *file.Sampling) (ids []string) {
+	e.Sample = s
+	var buf bytes.Buffer
+	if err := e.extractIndex(i, "", &buf); err != nil {
+		t.Fatal(err)
+	}
+	r := file.NewReader(&buf, false)
+	for {
+		seq, err := r.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, string(seq.ID))
+	}
+}
+
+// every read is followed by its mate, returns pair keys per metagenome
+func checkPairs(t *testing.T, name string, ids []string) map[string][]string {
+	keys := make(map[string][]string)
+	if len(ids)%2 != 0 {
+		t.Fatalf("%s: odd number of records %d", name, len(ids))
+	}
+	for n := 0; n < len(ids); n += 2 {
+		if !strings.HasSuffix(ids[n], "/1") || (ids[n+1] != strings.TrimSuffix(ids[n], "/1")+"/2") {
+			t.Fatalf("%s: %s not followed by its mate, got %s", name, ids[n], ids[n+1])
+		}
+		mg := strings.Split(ids[n], "|")[1]
+		keys[mg] = append(keys[mg], strings.TrimSuffix(ids[n], "/1"))
+	}
+	return keys
+}
+
+func TestExtractSampleInterleaved(t *testing.T) {
+	var order, reversed []int
+	for n := 1; n <= 200; n++ {
+		order = append(order, n)
+		reversed = append([]int{n}, reversed...)
+	}
+	e, i := writeInterleaved(t, interleavedIDs(order))
+	r, ri := writeInterleaved(t, interleavedIDs(reversed))
+
+	for _, s := range []*file.Sampling{{Fraction: 0.3, Seed: 5}, {MaxReads: 7, Seed: 5}, {Fraction: 0.5, MaxReads: 7, Seed: 5}} {
+		name := s.String()
+		kept := checkPairs(t, name, extractIDs(t, e, i, s))
+		again := checkPairs(t, name+" reversed", extractIDs(t, r, ri, s))
+		for _, mg := range []string{"mgm1.3", "mgm2.3"} {
+			if len(kept[mg]) == 0 {
+				t.Errorf("%s: no pairs of %s kept", name, mg)
+			}
+			if (s.MaxReads > 0) && (len(kept[mg]) > s.MaxReads) {
+				t.Errorf("%s: %d pairs of %s kept, expected at most %d", name, len(kept[mg]), mg, s.MaxReads)
+			}
+			// pairs are written in input order
+			if !sort.SliceIsSorted(kept[mg], func(a, b int) bool { return readNum(kept[mg][a]) < readNum(kept[mg][b]) }) {
+				t.Errorf("%s: pairs of %s not in input order: %v", name, mg, kept[mg])
+			}
+			// same seed keeps same pairs in any input order
+			sorted, other := append([]string{}, kept[mg]...), append([]string{}, again[mg]...)
+			sort.Strings(sorted)
+			sort.Strings(other)
+			if !reflect.DeepEqual(sorted, other) {
+				t.Errorf("%s: reversed input kept other pairs of %s: %v, expected %v", name, mg, other, sorted)
+			}
+		}
+	}
+}
+
+func readNum(key string) (n int) {
+	fmt.Sscanf(key[strings.LastIndex(key, "_")+1:], "%d", &n)
+	return
+}
@@ -0,0 +1,242 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var FAILURE_LEDGER = "failures.json"
+
+// what happens on a failed node or record: stop the export, or leave it
+// out and go on. either way it is recorded in the failure ledger.
+var POLICY_FAIL = "fail"
+var POLICY_SKIP = "skip"
+var POLICIES = []string{POLICY_FAIL, POLICY_SKIP}
+
+// writer operations that fail
+var (
+	OP_OPEN   = "open"
+	OP_WRITE  = "write"
+	OP_CLOSE  = "close"
+	OP_RECORD = "record"
+	OP_INDEX  = "index"
+)
+
+func checkPolicy(policy string) (err error) {
+	for _, p := range POLICIES {
+		if p == policy {
+			return
+		}
+	}
+	err = fmt.Errorf("unknown error policy %s, must be one of: %v", policy, POLICIES)
+	return
+}
+
+// failure of record writer, sent back to the exporter
+type WriteError struct {
+	Op         string
+	Path       string
+	Project    string
+	Metagenome string
+	File       int
+	Record     int
+	Err        error
+}
+
+func (e *WriteError) Error() string {
+	switch e.Op {
+	case OP_WRITE, OP_RECORD:
+		return fmt.Sprintf("error in %s: project=%s metagenome=%s file=%d record=%d: %s", e.Op, e.Project, e.Metagenome, e.File, e.Record, e.Err.Error())
+	}
+	return fmt.Sprintf("error in %s of %s: %s", e.Op, e.Path, e.Err.Error())
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// only a single record is lost, the writer goes on. a failed write
+// leaves the file unusable past its last good record.
+func (e *WriteError) Skippable() bool {
+	return e.Op == OP_RECORD
+}
+
+// failure reading a shock node, its project is incomplete
+type NodeError struct {
+	Project    string
+	Metagenome string
+	Node       string
+	Err        error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("error in node %s: project=%s metagenome=%s: %s", e.Node, e.Project, e.Metagenome, e.Err.Error())
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// failed node or record, kept until its project is exported again
+type Failure struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Project    string    `json:"project,omitempty"`
+	Metagenome string    `json:"metagenome,omitempty"`
+	Node       string    `json:"node,omitempty"`
+	File       int       `json:"file,omitempty"`
+	Record     int       `json:"record,omitempty"`
+	Error      string    `json:"error"`
+}
+
+func newFailure(err error) *Failure {
+	f := &Failure{Time: time.Now().UTC(), Kind: "export", Error: err.Error()}
+	switch e := err.(type) {
+	case *NodeError:
+		f.Kind = "node"
+		f.Project = e.Project
+		f.Metagenome = e.Metagenome
+		f.Node = e.Node
+	case *WriteError:
+		f.Kind = e.Op
+		f.Project = e.Project
+		f.Metagenome = e.Metagenome
+		f.File = e.File
+		f.Record = e.Record
+	}
+	return f
+}
+
+// persistent list of failures of export set
+type FailureLedger struct {
+	Failures []*Failure
+	fs       storage.Storage
+}
+
+func LoadFailureLedger(fs storage.Storage) (l *FailureLedger, err error) {
+	l = &FailureLedger{fs: fs}
+	if !fs.Exists(FAILURE_LEDGER) {
+		return
+	}
+	fh, err := fs.Open(FAILURE_LEDGER)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	data, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &l.Failures); err != nil {
+		err = fmt.Errorf("failure ledger %s: %s", fs.Location(FAILURE_LEDGER), err.Error())
+	}
+	return
+}
+
+// add failure and save ledger
+func (l *FailureLedger) Add(err error) error {
+	f := newFailure(err)
+	l.Failures = append(l.Failures, f)
+	if err := l.Save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, fmt.Sprintf("%s, recorded in %s\n", f.Error, l.fs.Location(FAILURE_LEDGER)))
+	return nil
+}
+
+// projects with failures, in ledger order
+func (l *FailureLedger) Projects() (projects []string) {
+	seen := make(map[string]bool)
+	for _, f := range l.Failures {
+		if (f.Project != "") && !seen[f.Project] {
+			projects = append(projects, f.Project)
+			seen[f.Project] = true
+		}
+	}
+	return
+}
+
+// drop failures of project once it is exported, project "" drops
+// failures that can not be replayed
+func (l *FailureLedger) Resolve(project string) (err error) {
+	var kept []*Failure
+	for _, f := range l.Failures {
+		if f.Project != project {
+			kept = append(kept, f)
+		}
+	}
+	if len(kept) == len(l.Failures) {
+		return
+	}
+	l.Failures = kept
+	err = l.Save()
+	return
+}
+
+// ledger file is removed once empty
+func (l *FailureLedger) Save() (err error) {
+	if len(l.Failures) == 0 {
+		if l.fs.Exists(FAILURE_LEDGER) {
+			err = l.fs.Delete(FAILURE_LEDGER)
+		}
+		return
+	}
+	data, err := json.MarshalIndent(l.Failures, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFile(l.fs, FAILURE_LEDGER, data)
+	return
+}
+
+// export again the projects in failure ledger. files left by a failed run
+// are cleaned, projects exported with skipped nodes or records are removed
+// first, then only ledger projects are exported.
+func (e *Exporter) RetryFailed(ctx context.Context) (err error) {
+	err = e.openStorage()
+	if err != nil {
+		return
+	}
+	ledger, err := LoadFailureLedger(e.FS)
+	if err != nil {
+		return
+	}
+	projects := ledger.Projects()
+	if len(projects) == 0 {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("no failures to retry in %s\n", e.FS.Location(FAILURE_LEDGER)))
+		return
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("retrying %d failed project(s): %v\n", len(projects), projects))
+	err = e.Clean()
+	if err != nil {
+		return
+	}
+	e.retry = make(map[string]bool)
+	for _, p := range projects {
+		e.retry[p] = true
+		pos := SliceIndex(e.Indexes.Len(), func(i int) bool { return (*e.Indexes)[i].Project == p })
+		if (pos == -1) || (*e.Indexes)[pos].Removed {
+			continue
+		}
+		err = e.RemoveProject(p, false)
+		if err != nil {
+			return
+		}
+	}
+	err = e.Export(ctx)
+	if err != nil {
+		return
+	}
+	// failures without project can not be retried, dropped after a good run
+	ledger, err = LoadFailureLedger(e.FS)
+	if err != nil {
+		return
+	}
+	err = ledger.Resolve("")
+	return
+}
@@ -0,0 +1,222 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"net/url"
+	"os"
+	"time"
+)
+
+var VERSION = "0.2.0"
+var STAGE_DEFAULT = "screen"
+var SIZE_DEFAULT = int64(2)
+
+// settings not given (empty) are taken from index metadata, settings given must match it.
+// new or legacy export sets record the given or default settings.
+func (e *Exporter) setMeta() (err error) {
+	meta := e.Meta
+	// set without projects yet, settings that default to zero are taken as given
+	fresh := meta.Created.IsZero() || (e.Indexes.Len() == 0)
+	if meta.Created.IsZero() {
+		meta.Created = time.Now().UTC()
+		meta.Version = VERSION
+	}
+
+	// target layout, decides defaults of other settings
+	if e.Target != "" {
+		if err = checkTarget(e.Target); err != nil {
+			return
+		}
+	}
+	if meta.Target == "" {
+		if e.Target == "" {
+			e.Target = TARGET_DEFAULT
+		}
+		meta.Target = e.Target
+	} else if (e.Target != "") && (e.Target != meta.Target) {
+		err = metaMismatch("target", meta.Target, e.Target)
+		return
+	}
+	e.Target = meta.Target
+	blastdb := e.Target == TARGET_BLASTDB
+
+	// read pairs, sets from before pairing write every record on its own
+	if e.Paired != "" {
+		if err = checkPaired(e.Paired); err != nil {
+			return
+		}
+	}
+	if meta.Paired == "" {
+		if (e.Paired != "") && (e.Paired != PAIRED_NONE) && (e.Indexes.Len() > 0) {
+			err = metaMismatch("paired layout", PAIRED_NONE, e.Paired)
+			return
+		} else if (e.Paired == "") || (e.Indexes.Len() > 0) {
+			e.Paired = PAIRED_NONE
+		}
+		meta.Paired = e.Paired
+	} else if (e.Paired != "") && (e.Paired != meta.Paired) {
+		err = metaMismatch("paired layout", meta.Paired, e.Paired)
+		return
+	}
+	e.Paired = meta.Paired
+	if blastdb && e.paired() {
+		err = fmt.Errorf("%s target has one record per accession, no paired layout", TARGET_BLASTDB)
+		return
+	}
+
+	// stage
+	if meta.Stage == "" {
+		if e.Stage == "" {
+			e.Stage = STAGE_DEFAULT
+		}
+		meta.Stage = e.Stage
+	} else if (e.Stage != "") && (e.Stage != meta.Stage) {
+		err = metaMismatch("stage", meta.Stage, e.Stage)
+		return
+	}
+	e.Stage = meta.Stage
+
+	// sequence type, default from stage. sets from before sequence types
+	// only have nucleotide files.
+	if meta.SeqType == "" {
+		if (e.SeqType != nil) && !e.SeqType.IsNucleotide() && (e.Indexes.Len() > 0) {
+			err = metaMismatch("sequence type", file.DEFAULT_SEQ_TYPE, e.SeqType.Name)
+			return
+		} else if e.Indexes.Len() > 0 {
+			e.SeqType = file.SeqTypes[file.DEFAULT_SEQ_TYPE]
+		} else if e.SeqType == nil {
+			e.SeqType = file.StageSeqType(e.Stage)
+		}
+		meta.SeqType = e.SeqType.Name
+	} else if (e.SeqType != nil) && (e.SeqType.Name != meta.SeqType) {
+		err = metaMismatch("sequence type", meta.SeqType, e.SeqType.Name)
+		return
+	}
+	e.SeqType, err = file.GetSeqType(meta.SeqType)
+	if err != nil {
+		return
+	}
+	if e.Valid != nil {
+		e.Valid.SetType(e.SeqType)
+	}
+	if (e.Dedup != nil) && e.Dedup.RevComp && !e.SeqType.IsNucleotide() {
+		err = fmt.Errorf("reverse complement dedup needs nucleotide sequences, export set has %s", e.SeqType.Name)
+		return
+	}
+
+	// file size
+	if meta.Size == 0 {
+		if e.Size == 0 {
+			e.Size = SIZE_DEFAULT
+		}
+		meta.Size = e.Size
+	} else if (e.Size != 0) && (e.Size != meta.Size) {
+		err = metaMismatch("size", meta.Size, e.Size)
+		return
+	}
+	e.Size = meta.Size
+
+	// header template
+	if meta.Header == "" {
+		if (e.Header == nil) && blastdb {
+			e.Header, _ = file.NewHeaderFormat(BLASTDB_HEADER_TEMPLATE)
+		} else if e.Header == nil {
+			e.Header = file.DefaultHeader
+		}
+		meta.Header = e.Header.Template
+	} else if (e.Header != nil) && (e.Header.Template != meta.Header) {
+		err = metaMismatch("header template", meta.Header, e.Header.Template)
+		return
+	}
+	e.Header, err = file.NewHeaderFormat(meta.Header)
+	if err != nil {
+		return
+	}
+	// accessions are numbered by exporter, no other template can hold them
+	if blastdb && (e.Header.Template != BLASTDB_HEADER_TEMPLATE) {
+		err = fmt.Errorf("%s target needs header template %s, not %s", TARGET_BLASTDB, BLASTDB_HEADER_TEMPLATE, e.Header.Template)
+		return
+	}
+
+	// line wrap, legacy sets are unwrapped
+	if fresh && (e.Wrap >= 0) {
+		meta.Wrap = e.Wrap
+	} else if (e.Wrap >= 0) && (e.Wrap != meta.Wrap) {
+		err = metaMismatch("wrap", meta.Wrap, e.Wrap)
+		return
+	}
+	e.Wrap = meta.Wrap
+
+	// compression
+	if meta.Profile == nil {
+		if (e.Profile == nil) && blastdb {
+			e.Profile = file.Profiles[BLASTDB_PROFILE]
+		} else if e.Profile == nil {
+			e.Profile = file.Profiles[file.DEFAULT_PROFILE]
+		}
+		meta.Profile = e.Profile
+	} else if (e.Profile != nil) && !e.Profile.Equal(meta.Profile) {
+		err = metaMismatch("compression profile", meta.Profile.String(), e.Profile.String())
+		return
+	}
+	e.Profile = meta.Profile
+	e.Files.Suffix = file.FileSuffix(e.SeqType, e.Profile)
+	e.Files.Mates = e.Paired == PAIRED_SPLIT
+
+	// source, only known when exporting
+	if e.SC.Host != "" {
+		if meta.ShockHost == "" {
+			meta.ShockHost = e.SC.Host
+		} else if e.SC.Host != meta.ShockHost {
+			err = metaMismatch("shock host", meta.ShockHost, e.SC.Host)
+			return
+		}
+		filters := queryFilters(e.Query)
+		if meta.Query == nil {
+			meta.Query = filters
+		} else if filters.Encode() != meta.Query.Encode() {
+			err = metaMismatch("query filters", meta.Query.Encode(), filters.Encode())
+			return
+		}
+		// sampling of a set can not change once it has projects
+		if meta.Sample == nil {
+			if (e.Sample != nil) && (e.Indexes.Len() > 0) {
+				err = metaMismatch("sampling", "none", e.Sample.String())
+				return
+			}
+			meta.Sample = e.Sample
+		} else if (e.Sample != nil) && !e.Sample.Equal(meta.Sample) {
+			err = metaMismatch("sampling", meta.Sample.String(), e.Sample.String())
+			return
+		}
+		e.Sample = meta.Sample
+	}
+
+	// read index sidecars, once on they stay on
+	if e.ReadIndex {
+		meta.ReadIndex = true
+	}
+	e.ReadIndex = meta.ReadIndex
+
+	if e.Debug {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("index metadata: version=%s, target=%s, paired=%s, stage=%s, seq_type=%s, size=%d, header=%s, wrap=%d, profile=%s\n", meta.Version, meta.Target, meta.Paired, meta.Stage, meta.SeqType, meta.Size, meta.Header, meta.Wrap, meta.Profile.String()))
+	}
+	return
+}
+
+// project and stage are not filters of the export set
+func queryFilters(q url.Values) url.Values {
+	filters := url.Values{}
+	for k, v := range q {
+		if (k == "project_id") || (k == "stage_name") {
+			continue
+		}
+		filters[k] = v
+	}
+	return filters
+}
+
+func metaMismatch(name string, stored interface{}, given interface{}) error {
+	return fmt.Errorf("export set was created with %s %v, cannot use %v", name, stored, given)
+}
@@ -0,0 +1,41 @@
+package exporter
+
+import (
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"testing"
+)
+
+func TestSetMetaWrap(t *testing.T) {
+	// new set stores given wrap
+	opts := NewOptions()
+	opts.Wrap = 60
+	e := New(opts)
+	if err := e.setMeta(); err != nil {
+		t.Fatalf("new set with wrap 60: %s", err.Error())
+	}
+	if e.Meta.Wrap != 60 {
+		t.Errorf("meta wrap is %d, expected 60", e.Meta.Wrap)
+	}
+
+	// existing set keeps its wrap, another one is rejected
+	meta := *e.Meta
+	for _, tt := range []struct {
+		wrap int
+		ok   bool
+	}{{-1, true}, {60, true}, {80, false}, {0, false}} {
+		opts := NewOptions()
+		opts.Wrap = tt.wrap
+		e := New(opts)
+		*e.Meta = meta
+		e.Indexes.Add(&index.Index{Project: "mgp1"})
+		err := e.setMeta()
+		if tt.ok && (err != nil) {
+			t.Errorf("existing set with wrap %d: %s", tt.wrap, err.Error())
+		} else if !tt.ok && (err == nil) {
+			t.Errorf("existing set with wrap %d: expected mismatch", tt.wrap)
+		}
+		if tt.ok && (e.Wrap != 60) {
+			t.Errorf("existing set with wrap %d: exporter wrap is %d, expected 60", tt.wrap, e.Wrap)
+		}
+	}
+}
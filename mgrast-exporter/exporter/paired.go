@@ -0,0 +1,220 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var PAIRED_NONE = "none"
+var PAIRED_INTERLEAVED = "interleaved"
+var PAIRED_SPLIT = "split"
+var PAIRED_LAYOUTS = []string{PAIRED_NONE, PAIRED_INTERLEAVED, PAIRED_SPLIT}
+
+// node attributes naming the mate of an R1 / R2 node, else taken from file name
+var PAIRED_MATE_KEYS = []string{"mate", "paired_end", "read"}
+var mateFileName = regexp.MustCompile(`(?:^|[._])R([12])(?:[._]|$)`)
+
+func checkPaired(layout string) (err error) {
+	for _, l := range PAIRED_LAYOUTS {
+		if l == layout {
+			return
+		}
+	}
+	err = fmt.Errorf("unknown paired layout %s, must be one of: %v", layout, PAIRED_LAYOUTS)
+	return
+}
+
+// mate of node holding one side of paired reads, 0 if not marked
+func nodeMate(data interface{}) int {
+	node, _ := data.(map[string]interface{})
+	attr, _ := node["attributes"].(map[string]interface{})
+	for _, k := range PAIRED_MATE_KEYS {
+		switch v := attr[k].(type) {
+		case float64:
+			if (v == 1) || (v == 2) {
+				return int(v)
+			}
+		case string:
+			if n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(v), "R")); (err == nil) && ((n == 1) || (n == 2)) {
+				return n
+			}
+		}
+	}
+	nf, _ := node["file"].(map[string]interface{})
+	name, _ := nf["name"].(string)
+	if m := mateFileName.FindStringSubmatch(name); m != nil {
+		return int(m[1][0] - '0')
+	}
+	return 0
+}
+
+// read and its mate, mate is nil for unpaired reads
+type readPair struct {
+	R1 *file.Seq
+	R2 *file.Seq
+}
+
+func (p *readPair) Len() int {
+	if p.R2 == nil {
+		return 1
+	}
+	return 2
+}
+
+func (p *readPair) Seqs() []*file.Seq {
+	if p.R2 == nil {
+		return []*file.Seq{p.R1}
+	}
+	return []*file.Seq{p.R1, p.R2}
+}
+
+// read, or both mates, was seen before
+func (p *readPair) Duplicate(d *file.Dedup) bool {
+	if p.R2 == nil {
+		return d.Seen(p.R1.Seq)
+	}
+	return d.SeenPair(p.R1.Seq, p.R2.Seq)
+}
+
+// pairs adjacent mates of interleaved records, anything else passes unpaired
+type matePairing struct {
+	held *file.Seq
+	key  []byte
+}
+
+// pairs ready after seq, seq is copied
+func (m *matePairing) Add(seq *file.Seq) (out []*readPair) {
+	key, mate := file.MateID(seq.ID)
+	if (m.held != nil) && (mate == 2) && bytes.Equal(key, m.key) {
+		out = append(out, &readPair{R1: m.held, R2: seq.Copy()})
+		m.held = nil
+		return
+	}
+	out = m.Flush()
+	if mate == 1 {
+		m.held = seq.Copy()
+		m.key, _ = file.MateID(m.held.ID)
+		return
+	}
+	out = append(out, &readPair{R1: seq.Copy()})
+	return
+}
+
+// held mate without its pair
+func (m *matePairing) Flush() (out []*readPair) {
+	if m.held != nil {
+		out = append(out, &readPair{R1: m.held})
+		m.held = nil
+	}
+	return
+}
+
+// records of a node as pairs. with a mates reader the two nodes of R1 and R2
+// are read in step, with pairing only adjacent mates of one node are paired.
+type pairReader struct {
+	r       *file.Reader
+	mates   *file.Reader
+	pairing *matePairing
+	queue   []*readPair
+	rnum    int
+}
+
+func newPairReader(r *file.Reader, mates *file.Reader, pairing bool) *pairReader {
+	p := &pairReader{r: r, mates: mates}
+	if pairing && (mates == nil) {
+		p.pairing = &matePairing{}
+	}
+	return p
+}
+
+// next pair, or nil and io.EOF when both nodes are done. unpaired
+// records of a single node are only valid until the next Read.
+func (p *pairReader) Read() (rp *readPair, err error) {
+	if p.mates != nil {
+		return p.readMates()
+	}
+	for len(p.queue) == 0 {
+		seq, er := p.r.Read()
+		if er != nil {
+			if er != io.EOF {
+				err = er
+				return
+			}
+			if p.pairing != nil {
+				p.queue = p.pairing.Flush()
+			}
+			if len(p.queue) == 0 {
+				err = io.EOF
+				return
+			}
+			break
+		}
+		if p.pairing == nil {
+			rp = &readPair{R1: seq}
+			return
+		}
+		p.queue = p.pairing.Add(seq)
+	}
+	rp = p.queue[0]
+	p.queue = p.queue[1:]
+	return
+}
+
+// mates of R1 and R2 nodes are in the same order, reads left over in one
+// node are unpaired
+func (p *pairReader) readMates() (rp *readPair, err error) {
+	s1, err1 := p.r.Read()
+	if (err1 != nil) && (err1 != io.EOF) {
+		err = err1
+		return
+	}
+	rp = &readPair{}
+	if err1 == nil {
+		rp.R1 = s1.Copy()
+	}
+	s2, err2 := p.mates.Read()
+	if (err2 != nil) && (err2 != io.EOF) {
+		err = err2
+		return
+	}
+	p.rnum += 1
+	switch {
+	case (err1 == io.EOF) && (err2 == io.EOF):
+		rp = nil
+		err = io.EOF
+	case err2 == io.EOF:
+	case err1 == io.EOF:
+		rp.R1 = s2.Copy()
+	default:
+		k1, _ := file.MateID(rp.R1.ID)
+		k2, _ := file.MateID(s2.ID)
+		if !bytes.Equal(k1, k2) {
+			rp = nil
+			err = fmt.Errorf("mate nodes out of step at record %d: %s and %s", p.rnum, k1, k2)
+			return
+		}
+		rp.R2 = s2.Copy()
+	}
+	return
+}
+
+// records of pair as held for sampling, split again on release
+func joinRecords(r1 []byte, r2 []byte) []byte {
+	return append(append(make([]byte, 0, len(r1)+len(r2)), r1...), r2...)
+}
+
+// first fasta record and the rest, nil if there is no second record
+func splitRecords(rec []byte) (r1 []byte, r2 []byte) {
+	n := bytes.Index(rec, []byte("\n>"))
+	if n == -1 {
+		r1 = rec
+		return
+	}
+	r1, r2 = rec[:n+1], rec[n+1:]
+	return
+}
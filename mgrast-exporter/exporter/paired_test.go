@@ -0,0 +1,68 @@
+package exporter
+
+import (
+	"reflect"
+	"testing"
+)
+
+// mate nodes are paired by metagenome in either listing order, a mate node
+// left without its pair at the end of the project is exported unpaired
+var pairedNodes = []testNode{
+	{"n1", "mgp1", "mgm1.3", 2, ">r1 x\nTTTT\n>r2/2\nGGGG\n"},
+	{"n2", "mgp1", "mgm1.3", 1, ">r1/1 x\nAAAA\n>r2/1\nCCCC\n>r3/1\nACGT\n"},
+	{"n3", "mgp1", "mgm2.3", 1, ">s1\nAAAC\n"},
+	{"n4", "mgp2", "mgm3.3", 0, ">t1/1\nAAAG\n>t1/2\nCTTT\n>t2\nGGGA\n"},
+}
+
+func TestExportPairedLayouts(t *testing.T) {
+	tests := []struct {
+		layout  string
+		files   map[string][]string
+		records map[string]int
+		pairs   map[string]int
+	}{
+		{
+			layout: PAIRED_INTERLEAVED,
+			files: map[string][]string{
+				"1.fasta.gz": {
+					"mgp1|mgm1.3|r1/1 x", "mgp1|mgm1.3|r1/2 x", "mgp1|mgm1.3|r2/1", "mgp1|mgm1.3|r2/2", "mgp1|mgm1.3|r3/1",
+					"mgp1|mgm2.3|s1",
+					"mgp2|mgm3.3|t1/1", "mgp2|mgm3.3|t1/2", "mgp2|mgm3.3|t2",
+				},
+			},
+			records: map[string]int{"mgm1.3": 5, "mgm2.3": 1, "mgm3.3": 3},
+			pairs:   map[string]int{"mgm1.3": 2, "mgm3.3": 1},
+		},
+		{
+			layout: PAIRED_SPLIT,
+			files: map[string][]string{
+				"1_R1.fasta.gz": {"mgp1|mgm1.3|r1/1 x", "mgp1|mgm1.3|r2/1", "mgp2|mgm3.3|t1/1"},
+				"1_R2.fasta.gz": {"mgp1|mgm1.3|r1/2 x", "mgp1|mgm1.3|r2/2", "mgp2|mgm3.3|t1/2"},
+			},
+			records: map[string]int{"mgm1.3": 2, "mgm3.3": 1},
+			pairs:   map[string]int{"mgm1.3": 2, "mgm3.3": 1},
+		},
+	}
+	for _, tt := range tests {
+		opts := NewOptions()
+		opts.Path = t.TempDir()
+		opts.Paired = tt.layout
+		e, err := runTestExport(t, opts, pairedNodes)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.layout, err.Error())
+		}
+		if files := readTestSet(t, e.FS); !reflect.DeepEqual(files, tt.files) {
+			t.Errorf("%s: exported %v, expected %v", tt.layout, files, tt.files)
+		}
+		records := testRecordCounts(e)
+		pairs := make(map[string]int)
+		for _, i := range *e.Indexes {
+			for m, n := range i.Pairs {
+				pairs[m] = n
+			}
+		}
+		if !reflect.DeepEqual(records, tt.records) || !reflect.DeepEqual(pairs, tt.pairs) {
+			t.Errorf("%s: index records %v pairs %v, expected %v and %v", tt.layout, records, pairs, tt.records, tt.pairs)
+		}
+	}
+}
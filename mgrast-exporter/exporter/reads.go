@@ -0,0 +1,242 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"io"
+	"os"
+	"strings"
+)
+
+var READ_INDEX_SUFFIX = ".ids.gz"
+
+// read index sidecar of numbered file
+func ReadIndexName(num int) string {
+	return fmt.Sprintf("%d%s", num, READ_INDEX_SUFFIX)
+}
+
+func isReadIndexFile(name string) bool {
+	return strings.HasSuffix(name, READ_INDEX_SUFFIX)
+}
+
+// stale once its file is rewritten or truncated
+func deleteReadIndex(fs storage.Storage, fnum int) {
+	if fs.Exists(ReadIndexName(fnum)) {
+		fs.Delete(ReadIndexName(fnum))
+	}
+}
+
+// keep read index in step with truncated file
+func truncateReadIndex(fs storage.Storage, fnum int, last int) (err error) {
+	name := ReadIndexName(fnum)
+	if !fs.Exists(name) {
+		return
+	}
+	ri, err := index.LoadReadIndex(fs, name)
+	if err != nil {
+		// rebuilt on demand
+		fs.Delete(name)
+		err = nil
+		return
+	}
+	ri.Truncate(last)
+	err = ri.Save(fs, name)
+	return
+}
+
+// read keys of records 1 to last (-1 for all) of numbered file,
+// mates in R2 file of split pairs are under record of their read
+func (n *FileNaming) scanReadIndex(fs storage.Storage, fnum int, last int) (ri *index.ReadIndex, err error) {
+	ri = index.NewReadIndex()
+	for _, name := range n.fileNames(fnum) {
+		fh, oerr := fs.Open(name)
+		if oerr != nil {
+			err = oerr
+			return
+		}
+		fr := file.NewReader(fh, true)
+		for rnum := 1; (last == -1) || (rnum <= last); rnum++ {
+			seq, er := fr.Read()
+			if er != nil {
+				if er != io.EOF {
+					err = er
+				}
+				break
+			}
+			ri.Add(index.ReadKey(seq.ID), rnum)
+		}
+		fh.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// sidecar of numbered file if there is one, else built from file
+func (n *FileNaming) loadReadIndex(fs storage.Storage, fnum int) (ri *index.ReadIndex, err error) {
+	name := ReadIndexName(fnum)
+	if !fs.Exists(name) {
+		fmt.Fprintf(os.Stderr, "no read index for %s, reading it in full\n", fs.Location(n.FileName(fnum)))
+		return n.scanReadIndex(fs, fnum, -1)
+	}
+	ri, err = index.LoadReadIndex(fs, name)
+	if err == index.ErrReadIndexVersion {
+		fmt.Fprintf(os.Stderr, "read index %s is of an older version, reading %s in full, rebuild it with 'index ids'\n", fs.Location(name), fs.Location(n.FileName(fnum)))
+		return n.scanReadIndex(fs, fnum, -1)
+	}
+	return
+}
+
+// build read index sidecars missing for indexed files, or of older version
+func (e *Exporter) IndexReads() (err error) {
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	if !e.Store.Exists() {
+		err = fmt.Errorf("no index in %s", e.Path)
+		return
+	}
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+	if ok, proj, pos := e.Indexes.IsComplete(); !ok {
+		err = fmt.Errorf("export set in bad state: project %s (%d out of %d exports) is incomplete", proj, pos, e.Indexes.Len())
+		return
+	}
+	built := 0
+	for _, fnum := range e.Indexes.FileList(0) {
+		name := ReadIndexName(fnum)
+		if e.FS.Exists(name) && (index.CheckReadIndex(e.FS, name) != index.ErrReadIndexVersion) {
+			continue
+		}
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("indexing reads of file: %s\n", e.FS.Location(e.Files.FileName(fnum))))
+		ri, serr := e.Files.scanReadIndex(e.FS, fnum, -1)
+		if serr != nil {
+			err = serr
+			return
+		}
+		if err = ri.Save(e.FS, name); err != nil {
+			return
+		}
+		built += 1
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("built %d read index file(s)\n", built))
+	return
+}
+
+// candidate record of a looked up ID
+type readMatch struct {
+	id  string
+	key []byte
+	rec int
+}
+
+// print file, record number and sequence of each ID. an ID is the record key,
+// its whole header, or the key without project if the header template starts
+// with project and metagenome.
+func (e *Exporter) Lookup(ids []string, w io.Writer) (err error) {
+	if len(ids) == 0 {
+		err = fmt.Errorf("no read IDs to look up")
+		return
+	}
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	if !e.Store.Exists() {
+		err = fmt.Errorf("no index in %s", e.Path)
+		return
+	}
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+
+	// project of each metagenome, to complete IDs without project
+	mgProject := make(map[string]string)
+	for _, i := range *e.Indexes {
+		if i.Removed {
+			continue
+		}
+		for _, m := range i.Metagenomes {
+			mgProject[m] = i.Project
+		}
+	}
+	keys := make(map[string][][]byte)
+	for _, id := range ids {
+		keys[id] = append(keys[id], []byte(id))
+		parts := strings.SplitN(id, "|", 2)
+		if p, ok := mgProject[parts[0]]; ok && (len(parts) == 2) {
+			header := e.Header.AppendFormat(nil, p, parts[0], &file.Seq{ID: []byte(parts[1])})
+			keys[id] = append(keys[id], index.ReadKey(header))
+		}
+	}
+
+	// candidates by hash, confirmed when reading records
+	found := make(map[string]bool)
+	for _, fnum := range e.Indexes.FileList(0) {
+		ri, lerr := e.Files.loadReadIndex(e.FS, fnum)
+		if lerr != nil {
+			err = lerr
+			return
+		}
+		var matches []*readMatch
+		last := 0
+		for id, candidates := range keys {
+			for _, key := range candidates {
+				for _, rec := range ri.Find(key) {
+					matches = append(matches, &readMatch{id: id, key: key, rec: rec})
+					if rec > last {
+						last = rec
+					}
+				}
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		rnum := 0
+		err = e.readFile(fnum, 1, last, func(seq *file.Seq, mate *file.Seq, mg string) (err error) {
+			rnum += 1
+			for _, m := range matches {
+				if m.rec != rnum {
+					continue
+				}
+				s := seq
+				if (mate != nil) && bytes.Equal(m.key, index.ReadKey(mate.ID)) {
+					s = mate
+				} else if !bytes.Equal(m.key, index.ReadKey(seq.ID)) {
+					continue
+				}
+				found[m.id] = true
+				_, err = fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", m.id, fnum, rnum, bytes.Join(bytes.Fields(s.Seq), nil))
+				if err != nil {
+					return
+				}
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	var missing []string
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		err = fmt.Errorf("%d of %d read IDs not found: %s", len(missing), len(ids), strings.Join(missing, ", "))
+	}
+	return
+}
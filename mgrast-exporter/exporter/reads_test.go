@@ -0,0 +1,32 @@
+package exporter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// IDs are found with or without read index sidecars, missing ones are reported
+func TestLookup(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSet(t, dir, removeSegments)
+	opts := NewOptions()
+	opts.Path = dir
+	ids := []string{"mgp2|mgm2.3|read_5", "mgm1.3|read_2", "mgp2|mgm2.3|read_9"}
+	expected := "mgm1.3|read_2\t1\t2\tACGTACGT\nmgp2|mgm2.3|read_5\t2\t3\tACGTACGT\n"
+	for _, sidecars := range []bool{false, true} {
+		if sidecars {
+			if err := New(opts).IndexReads(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		err := New(opts).Lookup(ids, &buf)
+		if (err == nil) || !strings.Contains(err.Error(), "1 of 3 read IDs not found: mgp2|mgm2.3|read_9") {
+			t.Errorf("sidecars %v: missing ID gave %v", sidecars, err)
+		}
+		if buf.String() != expected {
+			t.Errorf("sidecars %v: found\n%s\nexpected\n%s", sidecars, buf.String(), expected)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"os"
+)
+
+var REJECTS_PREFIX = "rejects"
+
+// per-run log of records that failed validation
+type RejectLog struct {
+	Name   string
+	Counts map[string]int
+	order  []string
+	mgProj map[string]string
+	fs     storage.Storage
+	fh     storage.Writer
+}
+
+// run is timestamp of export run
+func NewRejectLog(fs storage.Storage, run string) *RejectLog {
+	name := fmt.Sprintf("%s.%s", REJECTS_PREFIX, run)
+	return &RejectLog{
+		Name:   name,
+		Counts: make(map[string]int),
+		mgProj: make(map[string]string),
+		fs:     fs,
+	}
+}
+
+// record is written as fasta with reason appended to header
+func (r *RejectLog) Add(proj string, mg string, id []byte, seq []byte, reason string) (err error) {
+	if r.fh == nil {
+		r.fh, err = r.fs.Create(r.Name + ".fasta")
+		if err != nil {
+			return
+		}
+	}
+	if _, ok := r.Counts[mg]; !ok {
+		r.order = append(r.order, mg)
+		r.mgProj[mg] = proj
+	}
+	r.Counts[mg] += 1
+	_, err = fmt.Fprintf(r.fh, ">%s|%s|%s reason=%s\n%s\n", proj, mg, id, reason, seq)
+	return
+}
+
+func (r *RejectLog) Total() (total int) {
+	for _, c := range r.Counts {
+		total += c
+	}
+	return
+}
+
+// close rejects file and write per metagenome counts, no files if nothing rejected
+func (r *RejectLog) Close() (err error) {
+	if r.fh == nil {
+		return
+	}
+	err = r.fh.Close()
+	r.fh = nil
+	if err != nil {
+		return
+	}
+	ch, err := r.fs.Create(r.Name + ".tsv")
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(ch, "project\tmetagenome\trejected\n")
+	for _, mg := range r.order {
+		fmt.Fprintf(ch, "%s\t%s\t%d\n", r.mgProj[mg], mg, r.Counts[mg])
+	}
+	err = ch.Close()
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("rejected %d records from %d metagenomes, see %s\n", r.Total(), len(r.order), r.fs.Location(r.Name+".fasta")))
+	return
+}
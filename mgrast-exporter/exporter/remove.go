@@ -0,0 +1,289 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"io"
+	"os"
+	"sort"
+)
+
+var REMOVE_SUFFIX = ".remove"
+var RENUMBER_SUFFIX = ".renumber"
+
+// removal phases: new content is staged under temp names, then renamed
+var REMOVE_PHASE_STAGE = "stage"
+var REMOVE_PHASE_RENAME = "rename"
+
+// remove one project from anywhere in the export set.
+// its records are dropped from the numbered files, emptied files are removed,
+// later files are renumbered and later indexes moved to their new positions.
+// with tombstone the files are not touched, the index is only marked removed
+// and its records are dropped on next repack.
+func (e *Exporter) RemoveProject(project string, tombstone bool) (err error) {
+	// retrieve index
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+	if ok, proj, pos := e.Indexes.IsComplete(); !ok {
+		err = fmt.Errorf("export set in bad state: project %s (%d out of %d exports) is incomplete", proj, pos, e.Indexes.Len())
+		return
+	}
+	pos := SliceIndex(e.Indexes.Len(), func(i int) bool { return (*e.Indexes)[i].Project == project })
+	if pos == -1 {
+		err = fmt.Errorf("project %s not in index", project)
+		return
+	}
+	target := (*e.Indexes)[pos]
+	if target.Removed {
+		err = fmt.Errorf("project %s already removed", project)
+		return
+	}
+
+	if tombstone {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("marking project %s as removed\n", project))
+		target.Tombstone()
+		err = e.Store.Save(e.Indexes, e.Meta)
+		if err != nil {
+			return
+		}
+		err = e.writeTargetMaps()
+		return
+	}
+
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("removing project %s: files %d to %d\n", project, target.StartFile, target.EndFile))
+	// files holding the project get new content next to the current one,
+	// nothing is renamed before the index of the new layout is saved
+	removal := &index.Removal{Project: project, Phase: REMOVE_PHASE_STAGE, Files: e.Indexes.FileList(0), Metadata: target.Metadata}
+	for fnum := target.StartFile; fnum <= target.EndFile; fnum++ {
+		keep := func(rnum int) bool {
+			if (fnum == target.StartFile) && (rnum < target.StartRecord) {
+				return true
+			}
+			if (fnum == target.EndFile) && (rnum > target.EndRecord) {
+				return true
+			}
+			return false
+		}
+		var kept int
+		kept, err = e.filterExportFile(fnum, keep)
+		if err != nil {
+			return
+		}
+		if kept == 0 {
+			removal.Emptied = append(removal.Emptied, fnum)
+		} else {
+			removal.Rewritten = append(removal.Rewritten, fnum)
+		}
+	}
+
+	// move later indexes, then drop project
+	removed := target.EndRecord - target.StartRecord + 1
+	remap := func(f int, r int) (int, int) {
+		if (target.StartFile == target.EndFile) && (f == target.StartFile) && (r > target.EndRecord) {
+			r -= removed
+		} else if (target.StartFile < target.EndFile) && (f == target.EndFile) && (r > target.EndRecord) {
+			r -= target.EndRecord
+		}
+		return f, r
+	}
+	for n, i := range *e.Indexes {
+		if n <= pos {
+			continue
+		}
+		sf, sr := remap(i.StartFile, i.StartRecord)
+		ef, er := remap(i.EndFile, i.EndRecord)
+		i.Move(renumber(removal.Emptied, sf), sr, renumber(removal.Emptied, ef), er)
+	}
+	e.Indexes.RemoveAt(pos)
+	e.Meta.Removing = removal
+	err = e.Store.Save(e.Indexes, e.Meta)
+	if err != nil {
+		return
+	}
+	err = e.finishRemove()
+	if err != nil {
+		return
+	}
+	err = e.writeTargetMaps()
+	return
+}
+
+// rename files of removal saved in index, then clear it. each phase can
+// be run again after an interruption.
+func (e *Exporter) finishRemove() (err error) {
+	r := e.Meta.Removing
+	sort.Ints(r.Files)
+	rewritten := make(map[int]bool)
+	for _, fnum := range r.Rewritten {
+		rewritten[fnum] = true
+	}
+	if r.Phase == REMOVE_PHASE_STAGE {
+		// new content and renumbered files go to temp names of their new number
+		for _, fnum := range r.Files {
+			fnew := renumber(r.Emptied, fnum)
+			names, newNames := e.Files.fileNames(fnum), e.Files.fileNames(fnew)
+			for n := range names {
+				from := names[n]
+				if rewritten[fnum] {
+					from = names[n] + REMOVE_SUFFIX
+				} else if (fnew == fnum) || emptiedFile(r.Emptied, fnum) {
+					continue
+				}
+				if e.FS.Exists(from) {
+					if err = e.FS.Rename(from, newNames[n]+RENUMBER_SUFFIX); err != nil {
+						return
+					}
+				}
+			}
+			if !rewritten[fnum] && (fnew != fnum) && e.FS.Exists(ReadIndexName(fnum)) {
+				if err = e.FS.Rename(ReadIndexName(fnum), ReadIndexName(fnew)+RENUMBER_SUFFIX); err != nil {
+					return
+				}
+			}
+		}
+		// old content of changed files, no file has its new name yet
+		for _, fnum := range append(append([]int{}, r.Rewritten...), r.Emptied...) {
+			e.Files.deleteFiles(e.FS, fnum)
+			deleteReadIndex(e.FS, fnum)
+		}
+		r.Phase = REMOVE_PHASE_RENAME
+		if err = e.Store.Save(e.Indexes, e.Meta); err != nil {
+			return
+		}
+	}
+	for _, fnum := range r.Files {
+		if emptiedFile(r.Emptied, fnum) {
+			continue
+		}
+		fnew := renumber(r.Emptied, fnum)
+		for _, name := range append(e.Files.fileNames(fnew), ReadIndexName(fnew)) {
+			if e.FS.Exists(name + RENUMBER_SUFFIX) {
+				if err = e.FS.Rename(name+RENUMBER_SUFFIX, name); err != nil {
+					return
+				}
+			}
+		}
+		// read index of rewritten file is made again
+		if rewritten[fnum] && e.ReadIndex {
+			ri, rerr := e.Files.scanReadIndex(e.FS, fnew, -1)
+			if rerr != nil {
+				err = rerr
+				return
+			}
+			if err = ri.Save(e.FS, ReadIndexName(fnew)); err != nil {
+				return
+			}
+		}
+	}
+	deleteMetadata(e.FS, r.Metadata)
+	e.Meta.Removing = nil
+	err = e.Store.Save(e.Indexes, e.Meta)
+	return
+}
+
+// finish removal left by an interrupted remove, or drop new content of
+// one that was interrupted before its index was saved
+func (e *Exporter) cleanRemove() (err error) {
+	if e.Meta.Removing != nil {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("finishing removal of project %s\n", e.Meta.Removing.Project))
+		err = e.finishRemove()
+		return
+	}
+	left, _ := e.FS.List(fmt.Sprintf("*%s", REMOVE_SUFFIX))
+	for _, f := range left {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("removing file of unfinished removal: %s\n", e.FS.Location(f)))
+		e.FS.Delete(f)
+	}
+	return
+}
+
+// write records of numbered file where keep is true next to it, return kept
+// count. nothing is written if nothing is kept. mates of split pairs are
+// filtered alike.
+func (e *Exporter) filterExportFile(fnum int, keep func(int) bool) (kept int, err error) {
+	for _, fname := range e.Files.fileNames(fnum) {
+		kept, err = e.filterFile(fname, keep)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (e *Exporter) filterFile(fname string, keep func(int) bool) (kept int, err error) {
+	filePath := e.FS.Location(fname)
+	outFile := fname + REMOVE_SUFFIX
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("rewriting file: %s\n", filePath))
+
+	inHandle, err := e.FS.Open(fname)
+	if err != nil {
+		return
+	}
+	defer inHandle.Close()
+	outHandle, err := e.FS.Create(outFile)
+	if err != nil {
+		return
+	}
+	defer outHandle.Close()
+	inReader := file.NewReader(inHandle, true)
+	outWriter := file.NewWriter(outHandle, e.Threads, e.Profile)
+
+	for rnum := 1; ; rnum++ {
+		seq, er := inReader.Read()
+		if er != nil {
+			if er != io.EOF {
+				err = fmt.Errorf("file %s in bad state, invalid record found: %d: %s", filePath, rnum, er.Error())
+				return
+			}
+			break
+		}
+		if !keep(rnum) {
+			continue
+		}
+		err = outWriter.Write(seq.WrappedRecord(e.Wrap))
+		if err != nil {
+			return
+		}
+		kept += 1
+	}
+	err = outWriter.Close()
+	if err != nil {
+		return
+	}
+	err = outHandle.Close()
+	if err != nil {
+		return
+	}
+	if kept == 0 {
+		e.FS.Delete(outFile)
+	}
+	return
+}
+
+// file number after removing emptied files
+func renumber(emptied []int, f int) int {
+	shift := 0
+	for _, n := range emptied {
+		if n < f {
+			shift += 1
+		}
+	}
+	return f - shift
+}
+
+func emptiedFile(emptied []int, f int) bool {
+	for _, n := range emptied {
+		if n == f {
+			return true
+		}
+	}
+	return false
+}
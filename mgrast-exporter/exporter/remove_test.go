@@ -0,0 +1,219 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// records of one metagenome written to a numbered file
+type testSegment struct {
+	project    string
+	metagenome string
+	file       int
+	records    int
+}
+
+// export set with files and json index as the writer leaves them
+func writeTestSet(t *testing.T, dir string, segments []testSegment) *Exporter {
+	opts := NewOptions()
+	opts.Path = dir
+	return writeTestSetOpts(t, opts, segments)
+}
+
+// export set with settings of opts
+func writeTestSetOpts(t *testing.T, opts Options, segments []testSegment) *Exporter {
+	e := New(opts)
+	if err := e.openIndex(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Store.Close()
+	if err := e.setMeta(); err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[int][]byte)
+	recNum := make(map[int]int)
+	var curr *index.Index
+	for _, s := range segments {
+		if (curr == nil) || (curr.Project != s.project) {
+			if curr != nil {
+				e.Indexes.Add(curr)
+			}
+			curr = &index.Index{Project: s.project, StartFile: s.file, StartRecord: recNum[s.file] + 1, Completed: true, Records: make(map[string]int)}
+		}
+		curr.Update(s.metagenome)
+		for n := 0; n < s.records; n++ {
+			recNum[s.file] += 1
+			seq := &file.Seq{ID: []byte(fmt.Sprintf("%s|%s|read_%d", s.project, s.metagenome, curr.Records[s.metagenome]+1)), Seq: []byte("ACGTACGT")}
+			contents[s.file] = append(contents[s.file], seq.Record()...)
+			curr.Records[s.metagenome] += 1
+		}
+		curr.EndFile, curr.EndRecord = s.file, recNum[s.file]
+	}
+	e.Indexes.Add(curr)
+	for fnum, data := range contents {
+		fh, err := e.FS.Create(e.Files.FileName(fnum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := file.NewWriter(fh, 1, e.Profile)
+		if err = w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		fh.Close()
+	}
+	if err := e.Store.Save(e.Indexes, e.Meta); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// record headers of each numbered file
+func readTestSet(t *testing.T, fs storage.Storage) map[string][]string {
+	files := make(map[string][]string)
+	names, _ := fs.List("*" + file.FILE_SUFFIX)
+	for _, name := range names {
+		fh, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := file.NewReader(fh, true)
+		files[name] = []string{}
+		for {
+			seq, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[name] = append(files[name], string(seq.ID))
+		}
+		fh.Close()
+	}
+	return files
+}
+
+func testIndexLayout(idx *index.Indexes) (layout []string) {
+	for _, i := range *idx {
+		layout = append(layout, fmt.Sprintf("%s %d:%d-%d:%d", i.Project, i.StartFile, i.StartRecord, i.EndFile, i.EndRecord))
+	}
+	return
+}
+
+var removeSegments = []testSegment{
+	{"mgp1", "mgm1.3", 1, 3},
+	{"mgp2", "mgm2.3", 1, 2},
+	{"mgp2", "mgm2.3", 2, 4},
+	{"mgp2", "mgm3.3", 3, 2},
+	{"mgp3", "mgm4.3", 3, 3},
+	{"mgp3", "mgm4.3", 4, 2},
+	{"mgp4", "mgm5.3", 4, 2},
+}
+
+// mgp2 leaves file 1 and 3 shorter, file 2 empty and file 4 renumbered
+var removeFiles = map[string][]string{
+	"1.fasta.gz": {"mgp1|mgm1.3|read_1", "mgp1|mgm1.3|read_2", "mgp1|mgm1.3|read_3"},
+	"2.fasta.gz": {"mgp3|mgm4.3|read_1", "mgp3|mgm4.3|read_2", "mgp3|mgm4.3|read_3"},
+	"3.fasta.gz": {"mgp3|mgm4.3|read_4", "mgp3|mgm4.3|read_5", "mgp4|mgm5.3|read_1", "mgp4|mgm5.3|read_2"},
+}
+var removeLayout = []string{"mgp1 1:1-1:3", "mgp3 2:1-3:2", "mgp4 3:3-3:4"}
+
+func checkRemoved(t *testing.T, name string, dir string) {
+	opts := NewOptions()
+	opts.Path = dir
+	e := New(opts)
+	if err := e.openIndex(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Store.Close()
+	if err := e.loadIndex(); err != nil {
+		t.Fatalf("%s: %s", name, err.Error())
+	}
+	if layout := testIndexLayout(e.Indexes); !reflect.DeepEqual(layout, removeLayout) {
+		t.Errorf("%s: index is %v, expected %v", name, layout, removeLayout)
+	}
+	if files := readTestSet(t, e.FS); !reflect.DeepEqual(files, removeFiles) {
+		t.Errorf("%s: files are %v, expected %v", name, files, removeFiles)
+	}
+	if left, _ := e.FS.List("*.re*"); len(left) > 0 {
+		t.Errorf("%s: temp files left: %v", name, left)
+	}
+}
+
+func TestRemoveProjectRenumber(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSet(t, dir, removeSegments)
+	opts := NewOptions()
+	opts.Path = dir
+	if err := New(opts).RemoveProject("mgp2", false); err != nil {
+		t.Fatal(err)
+	}
+	checkRemoved(t, "remove", dir)
+}
+
+// storage failing on a given rename, as if the process stopped there
+type failingRename struct {
+	storage.Storage
+	fail    int
+	renames int
+}
+
+func (s *failingRename) Rename(from string, to string) error {
+	s.renames += 1
+	if s.renames == s.fail {
+		return fmt.Errorf("stopped at rename %d", s.renames)
+	}
+	return s.Storage.Rename(from, to)
+}
+
+// remove stopped at any rename is finished by clean
+func TestRemoveProjectInterrupted(t *testing.T) {
+	for fail := 1; ; fail++ {
+		dir := t.TempDir()
+		writeTestSet(t, dir, removeSegments)
+		local, err := storage.NewLocalStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := NewOptions()
+		opts.Path = dir
+		e := New(opts)
+		fs := &failingRename{Storage: local, fail: fail}
+		e.FS = fs
+		err = e.RemoveProject("mgp2", false)
+		if err == nil {
+			// every rename was interrupted once
+			checkRemoved(t, "no failure", dir)
+			if fail == 1 {
+				t.Fatal("remove did not rename any file")
+			}
+			return
+		}
+		name := fmt.Sprintf("stopped at rename %d", fail)
+		if !strings.Contains(err.Error(), name) {
+			t.Fatalf("%s: unexpected error %s", name, err.Error())
+		}
+
+		// index is not used until clean
+		b := New(opts)
+		if err = b.openIndex(); err != nil {
+			t.Fatal(err)
+		}
+		if err = b.loadIndex(); err == nil {
+			t.Errorf("%s: index loaded with removal not finished", name)
+		}
+		b.Store.Close()
+
+		if err = New(opts).Clean(); err != nil {
+			t.Fatalf("%s: clean: %s", name, err.Error())
+		}
+		checkRemoved(t, name, dir)
+	}
+}
@@ -0,0 +1,410 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var REPACK_SUFFIX = ".repack"
+var REPACK_COUNTS = "repack.counts"
+var REPACK_OLD_SUFFIX = ".old"
+
+// files of current directory moving into the verified repack, written
+// before the swap starts and removed once the old directory is gone
+var REPACK_SWAP = "repack.swap"
+
+// renames of the swap, stopped part way in tests
+var swapRename = os.Rename
+
+// stream whole export set into a new directory with uniform file sizes,
+// removed projects are dropped. the new set is written like an export, with
+// its index saved per project, so an interrupted repack continues where it
+// stopped. output is verified before it replaces the current directory.
+// only local export sets can be repacked.
+func (e *Exporter) Repack(size int64) (err error) {
+	// retrieve index, size may differ from stored one
+	e.Size = 0
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	if _, ok := e.FS.LocalDir(); !ok {
+		err = fmt.Errorf("repack needs a local export directory, not %s", e.Path)
+		return
+	}
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+	if ok, proj, pos := e.Indexes.IsComplete(); !ok {
+		err = fmt.Errorf("export set in bad state: project %s (%d out of %d exports) is incomplete", proj, pos, e.Indexes.Len())
+		return
+	}
+	if size == 0 {
+		size = e.Size
+	}
+	source := append(index.Indexes{}, (*e.Indexes)...)
+
+	// new set keeps settings of current one
+	repackDir := filepath.Clean(e.Path) + REPACK_SUFFIX
+	err = os.MkdirAll(repackDir, 0777)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("repacking %s into %s with file size %d GB\n", e.Path, repackDir, size))
+	r := NewExporter(repackDir, e.Stage, size, e.Debug)
+	r.Header = e.Header
+	r.Wrap = e.Wrap
+	r.Threads = e.Threads
+	r.Profile = e.Profile
+	r.Paired = e.Paired
+	r.Backend = e.Store.Name()
+
+	*r.Meta = *e.Meta
+	r.Meta.Size = size
+	err = r.openIndex()
+	if err != nil {
+		return
+	}
+	defer r.Store.Close()
+	err = r.loadIndex()
+	if err != nil {
+		return
+	}
+
+	// continue interrupted repack
+	counts := make(map[string]int)
+	countsFile := filepath.Join(repackDir, REPACK_COUNTS)
+	if cstream, cerr := ioutil.ReadFile(countsFile); cerr == nil {
+		if err = json.Unmarshal(cstream, &counts); err != nil {
+			return
+		}
+	}
+	if r.Store.Exists() {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("resuming repack after %d project(s)\n", r.Indexes.Len()))
+		err = r.Clean()
+		if err != nil {
+			return
+		}
+	}
+	done := r.Indexes.Projects()
+
+	ctx := context.Background()
+	w := r.writer
+	w.Init(r.FS, r.Size, r.Threads, r.Profile, r.Store, r.Debug)
+	w.SetIndex(r.Files, r.Indexes, r.Meta)
+	w.ReadIndex = r.ReadIndex
+	go w.WriterHandle(false, 0, 0)
+
+	// finalize project, keep its count for verify
+	prevProject := ""
+	count := 0
+	finish := func() error {
+		if err := w.Send(ctx, nil); err != nil {
+			return err
+		}
+		if errs, _ := w.Wait(ctx); len(errs) > 0 {
+			return errs[0]
+		}
+		if prevProject == "" {
+			return nil
+		}
+		counts[prevProject] = count
+		return writeJSON(countsFile, counts)
+	}
+	for _, i := range source {
+		if i.Removed || done[i.Project] {
+			continue
+		}
+		if prevProject != "" {
+			if err = finish(); err != nil {
+				return
+			}
+		}
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("repacking: project=%s\n", i.Project))
+		prevProject = i.Project
+		count = 0
+		// interleaved mates stay pairs, in the same file
+		var pairing *matePairing
+		if e.Paired == PAIRED_INTERLEAVED {
+			pairing = &matePairing{}
+		}
+		pairMG := ""
+		send := func(rp *readPair, mg string) error {
+			record := &Record{
+				R: rp.R1.WrappedRecord(e.Wrap),
+				P: i.Project,
+				M: mg,
+			}
+			if rp.R2 != nil {
+				record.R2 = rp.R2.WrappedRecord(e.Wrap)
+			}
+			return w.Send(ctx, record)
+		}
+		flush := func() error {
+			if pairing != nil {
+				for _, rp := range pairing.Flush() {
+					if err := send(rp, pairMG); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		err = e.readIndex(i, func(seq *file.Seq, mate *file.Seq, mg string) error {
+			count += 1
+			if pairing == nil {
+				return send(&readPair{R1: seq, R2: mate}, mg)
+			}
+			if mg != pairMG {
+				if err := flush(); err != nil {
+					return err
+				}
+				pairMG = mg
+			}
+			for _, rp := range pairing.Add(seq) {
+				if err := send(rp, mg); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		if err = flush(); err != nil {
+			return
+		}
+	}
+	if err = finish(); err != nil {
+		return
+	}
+	// 2nd nil in a row means all done, writer can end
+	if err = w.Send(ctx, nil); err != nil {
+		return
+	}
+	if errs, _ := w.Wait(ctx); len(errs) > 0 {
+		err = errs[0]
+		return
+	}
+
+	// count source of projects finished before an interruption left no count
+	for _, i := range source {
+		if _, ok := counts[i.Project]; ok || i.Removed {
+			continue
+		}
+		count := 0
+		err = e.readIndex(i, func(seq *file.Seq, mate *file.Seq, mg string) error {
+			count += 1
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		counts[i.Project] = count
+	}
+
+	// sidecars move along with other files, removed projects drop theirs
+	links := make(map[string]string)
+	for _, i := range source {
+		if i.Removed {
+			deleteMetadata(e.FS, i.Metadata)
+		} else {
+			links[i.Project] = i.Metadata
+		}
+	}
+	for _, i := range *r.Indexes {
+		i.Link(links[i.Project])
+	}
+	err = r.Store.Save(r.Indexes, r.Meta)
+	if err != nil {
+		return
+	}
+
+	// check new set before replacing current
+	err = r.verifyRepack(source, counts)
+	if err != nil {
+		err = fmt.Errorf("repack verify failed, %s kept for inspection: %s", repackDir, err.Error())
+		return
+	}
+	os.Remove(countsFile)
+	moves, err := e.repackMoves(repackDir)
+	if err != nil {
+		return
+	}
+	err = writeJSON(filepath.Join(repackDir, REPACK_SWAP), moves)
+	if err != nil {
+		return
+	}
+	err = swapRepack(e.Path, moves)
+	if err != nil {
+		err = fmt.Errorf("repack stopped replacing %s, run clean to finish it: %s", e.Path, err.Error())
+		return
+	}
+	e.Indexes, e.Meta = r.Indexes, r.Meta
+	err = e.writeTargetMaps()
+	return
+}
+
+// every kept project has its metagenomes and record count, every record has project of its index
+func (e *Exporter) verifyRepack(source index.Indexes, counts map[string]int) (err error) {
+	if ok, proj, pos := e.Indexes.IsComplete(); !ok {
+		err = fmt.Errorf("project %s (%d out of %d exports) is incomplete", proj, pos, e.Indexes.Len())
+		return
+	}
+	repacked := make(map[string]*index.Index)
+	for _, i := range *e.Indexes {
+		repacked[i.Project] = i
+	}
+	for _, i := range source {
+		if i.Removed {
+			continue
+		}
+		n, ok := repacked[i.Project]
+		if !ok {
+			err = fmt.Errorf("project %s missing", i.Project)
+			return
+		}
+		if len(n.Metagenomes) != len(i.Metagenomes) {
+			err = fmt.Errorf("project %s has %d metagenomes, expected %d", i.Project, len(n.Metagenomes), len(i.Metagenomes))
+			return
+		}
+		count := 0
+		err = e.readIndex(n, func(seq *file.Seq, mate *file.Seq, mg string) error {
+			p, _, _ := e.Header.ParseHeader(string(seq.ID))
+			if p != n.Project {
+				return fmt.Errorf("record %s found in range of project %s", seq.ID, n.Project)
+			}
+			count += 1
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		if count != counts[i.Project] {
+			err = fmt.Errorf("project %s has %d records, expected %d", i.Project, count, counts[i.Project])
+			return
+		}
+	}
+	if ok, missing := e.Files.DirHasFiles(e.Indexes.FileList(0), e.FS); !ok {
+		err = fmt.Errorf("missing files: %v", missing)
+	}
+	return
+}
+
+// other files of the current directory, they move along into the repack
+func (e *Exporter) repackMoves(repackDir string) (moves []string, err error) {
+	entries, err := ioutil.ReadDir(filepath.Clean(e.Path))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if e.isExportFile(name) || isReadIndexFile(name) || (name == index.INDEX_FILE) || (name == index.INDEX_DB_FILE) {
+			continue
+		}
+		if _, serr := os.Stat(filepath.Join(repackDir, name)); serr == nil {
+			continue
+		}
+		moves = append(moves, name)
+	}
+	return
+}
+
+// replace current directory with its repack: moves go into the repack,
+// current is renamed .old, the repack takes its place and .old is removed.
+// each step is skipped when done before, so a stopped swap is finished by
+// running it again.
+func swapRepack(path string, moves []string) (err error) {
+	current := filepath.Clean(path)
+	repackDir := current + REPACK_SUFFIX
+	oldDir := current + REPACK_OLD_SUFFIX
+	if _, serr := os.Stat(repackDir); serr == nil {
+		if _, serr = os.Stat(current); serr == nil {
+			for _, name := range moves {
+				from := filepath.Join(current, name)
+				if _, serr = os.Stat(from); os.IsNotExist(serr) {
+					continue
+				}
+				err = swapRename(from, filepath.Join(repackDir, name))
+				if err != nil {
+					return
+				}
+			}
+			err = swapRename(current, oldDir)
+			if err != nil {
+				return
+			}
+		}
+		err = swapRename(repackDir, current)
+		if err != nil {
+			return
+		}
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("repack done, removing old export set %s\n", oldDir))
+	err = os.RemoveAll(oldDir)
+	if err != nil {
+		return
+	}
+	err = os.Remove(filepath.Join(current, REPACK_SWAP))
+	return
+}
+
+// swap file of repack not finished, in the repack directory until it
+// replaced the current one
+func repackSwapFile(path string) (name string, ok bool) {
+	current := filepath.Clean(path)
+	for _, dir := range []string{current + REPACK_SUFFIX, current} {
+		name = filepath.Join(dir, REPACK_SWAP)
+		if _, err := os.Stat(name); err == nil {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// finish swap of a repack that stopped after it was verified
+func finishRepack(path string) (err error) {
+	name, ok := repackSwapFile(path)
+	if !ok {
+		return
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	var moves []string
+	if err = json.Unmarshal(data, &moves); err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("finishing repack of %s\n", path))
+	err = swapRepack(path, moves)
+	return
+}
+
+func (e *Exporter) isExportFile(name string) bool {
+	_, ok := e.Files.fileNumberAny(name)
+	return ok
+}
+
+func writeJSON(path string, v interface{}) (err error) {
+	jsonstream, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	temp := path + ".temp"
+	err = ioutil.WriteFile(temp, jsonstream, 0666)
+	if err != nil {
+		return
+	}
+	err = os.Rename(temp, path)
+	return
+}
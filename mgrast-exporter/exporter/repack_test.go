@@ -0,0 +1,100 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// export set with a file that is not part of the index, as a ledger or sidecar
+func writeRepackSet(t *testing.T, dir string) Options {
+	writeTestSet(t, dir, removeSegments)
+	if err := ioutil.WriteFile(filepath.Join(dir, "extra.txt"), []byte("kept"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	opts := NewOptions()
+	opts.Path = dir
+	return opts
+}
+
+func checkRepacked(t *testing.T, name string, dir string, files map[string][]string) {
+	opts := NewOptions()
+	opts.Path = dir
+	e := New(opts)
+	if err := e.openIndex(); err != nil {
+		t.Fatalf("%s: %s", name, err.Error())
+	}
+	defer e.Store.Close()
+	if err := e.loadIndex(); err != nil {
+		t.Fatalf("%s: %s", name, err.Error())
+	}
+	if got := readTestSet(t, e.FS); !reflect.DeepEqual(got, files) {
+		t.Errorf("%s: files are %v, expected %v", name, got, files)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "extra.txt")); string(data) != "kept" {
+		t.Errorf("%s: other file not moved along: %v", name, err)
+	}
+	for _, left := range []string{dir + REPACK_SUFFIX, dir + REPACK_OLD_SUFFIX, filepath.Join(dir, REPACK_SWAP)} {
+		if _, err := os.Stat(left); err == nil {
+			t.Errorf("%s: %s left", name, left)
+		}
+	}
+}
+
+// repack stopped at any rename of the swap is finished by clean
+func TestRepackSwapInterrupted(t *testing.T) {
+	defer func() { swapRename = os.Rename }()
+	base := filepath.Join(t.TempDir(), "set")
+	if err := New(writeRepackSet(t, base)).Repack(0); err != nil {
+		t.Fatal(err)
+	}
+	local, err := storage.NewLocalStorage(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := readTestSet(t, local)
+	checkRepacked(t, "no failure", base, expected)
+
+	for fail := 1; ; fail++ {
+		dir := filepath.Join(t.TempDir(), "set")
+		opts := writeRepackSet(t, dir)
+		renames := 0
+		swapRename = func(from string, to string) error {
+			renames += 1
+			if renames == fail {
+				return fmt.Errorf("stopped at rename %d", renames)
+			}
+			return os.Rename(from, to)
+		}
+		err := New(opts).Repack(0)
+		swapRename = os.Rename
+		if err == nil {
+			if fail == 1 {
+				t.Fatal("swap did not rename anything")
+			}
+			return
+		}
+		name := fmt.Sprintf("stopped at rename %d", fail)
+		if !strings.Contains(err.Error(), name) {
+			t.Fatalf("%s: unexpected error %s", name, err.Error())
+		}
+
+		// set is not used, or created again, until clean
+		if err = New(opts).openIndex(); err == nil {
+			t.Errorf("%s: index opened with swap not finished", name)
+		}
+		if err = New(opts).Repack(0); err == nil {
+			t.Errorf("%s: repack ran with swap not finished", name)
+		}
+
+		if err = New(opts).Clean(); err != nil {
+			t.Fatalf("%s: clean: %s", name, err.Error())
+		}
+		checkRepacked(t, name, dir, expected)
+	}
+}
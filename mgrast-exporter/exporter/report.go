@@ -0,0 +1,117 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"os"
+)
+
+var REPORT_PREFIX = "report"
+
+// counts of one metagenome in an export run
+type MetagenomeReport struct {
+	Project    string
+	Metagenome string
+	Node       string
+	Read       int
+	Rejected   int
+	Duplicates int
+	Exported   int
+	// read pairs exported, reads without mate in paired export sets
+	Pairs    int
+	Unpaired int
+	// sequence length of exported records, GC only counted for nucleotides
+	Residues int64
+	GC       int64
+	gc       bool
+	// estimated share of new records taken for duplicates, -1 without dedup
+	DupFalseRate float64
+}
+
+// per-run report of exported metagenomes
+type RunReport struct {
+	Name    string
+	SeqType *file.SeqType
+	fs      storage.Storage
+	order   []*MetagenomeReport
+}
+
+func NewRunReport(fs storage.Storage, run string, seqType *file.SeqType) *RunReport {
+	return &RunReport{
+		Name:    fmt.Sprintf("%s.%s.tsv", REPORT_PREFIX, run),
+		SeqType: seqType,
+		fs:      fs,
+	}
+}
+
+func (r *RunReport) Add(proj string, mg string, node string) *MetagenomeReport {
+	mr := &MetagenomeReport{Project: proj, Metagenome: mg, Node: node, DupFalseRate: -1, gc: r.SeqType.IsNucleotide()}
+	r.order = append(r.order, mr)
+	return mr
+}
+
+// count exported record and its mate
+func (mr *MetagenomeReport) CountRecord(rec *Record) {
+	mr.Count(rec.R)
+	if rec.R2 != nil {
+		mr.Count(rec.R2)
+		mr.Pairs += 1
+	}
+}
+
+// count exported fasta record
+func (mr *MetagenomeReport) Count(rec []byte) {
+	mr.Exported += 1
+	body := rec[bytes.IndexByte(rec, '\n')+1:]
+	for _, c := range body {
+		switch c {
+		case '\n':
+			continue
+		case 'G', 'C':
+			if mr.gc {
+				mr.GC += 1
+			}
+		}
+		mr.Residues += 1
+	}
+}
+
+// write report, no file if nothing was exported
+func (r *RunReport) Close() (err error) {
+	if len(r.order) == 0 {
+		return
+	}
+	var b bytes.Buffer
+	dups := 0
+	dupMGs := 0
+	fmt.Fprintf(&b, "project\tmetagenome\tnode\tread\trejected\tduplicates\texported\tpairs\tunpaired\tresidues\tmean_length\tgc_percent\tdup_false_rate\n")
+	for _, mr := range r.order {
+		rate := ""
+		if mr.DupFalseRate >= 0 {
+			rate = fmt.Sprintf("%.3g", mr.DupFalseRate)
+		}
+		mean, gc := "", ""
+		if mr.Exported > 0 {
+			mean = fmt.Sprintf("%.1f", float64(mr.Residues)/float64(mr.Exported))
+		}
+		if mr.gc && (mr.Residues > 0) {
+			gc = fmt.Sprintf("%.2f", 100*float64(mr.GC)/float64(mr.Residues))
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", mr.Project, mr.Metagenome, mr.Node, mr.Read, mr.Rejected, mr.Duplicates, mr.Exported, mr.Pairs, mr.Unpaired, mr.Residues, mean, gc, rate)
+		if mr.Duplicates > 0 {
+			dups += mr.Duplicates
+			dupMGs += 1
+		}
+	}
+	err = writeFile(r.fs, r.Name, b.Bytes())
+	if err != nil {
+		return
+	}
+	if dups > 0 {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("dropped %d duplicate records from %d metagenomes\n", dups, dupMGs))
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("run report: %s\n", r.fs.Location(r.Name)))
+	return
+}
@@ -0,0 +1,358 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var SERVE_ADDR_DEFAULT = ":8080"
+
+// index entry of a project as served, with readable names
+type projectInfo struct {
+	Project     string         `json:"project"`
+	Metagenomes []string       `json:"metagenomes"`
+	StartFile   int            `json:"start_file"`
+	StartRecord int            `json:"start_record"`
+	EndFile     int            `json:"end_file"`
+	EndRecord   int            `json:"end_record"`
+	Files       []int          `json:"files"`
+	Records     map[string]int `json:"records,omitempty"`
+	Pairs       map[string]int `json:"pairs,omitempty"`
+	Completed   bool           `json:"completed"`
+	Removed     bool           `json:"removed,omitempty"`
+	Metadata    string         `json:"metadata,omitempty"`
+}
+
+type metagenomeInfo struct {
+	Metagenome string `json:"metagenome"`
+	Project    string `json:"project"`
+	Records    int    `json:"records"`
+	Pairs      int    `json:"pairs,omitempty"`
+	Files      []int  `json:"files"`
+}
+
+type fileInfo struct {
+	File     int      `json:"file"`
+	Name     string   `json:"name"`
+	Size     int64    `json:"size"`
+	MateName string   `json:"mate_name,omitempty"`
+	MateSize int64    `json:"mate_size,omitempty"`
+	Projects []string `json:"projects"`
+}
+
+func newProjectInfo(i *index.Index) *projectInfo {
+	pi := &projectInfo{
+		Project:     i.Project,
+		Metagenomes: i.Metagenomes,
+		StartFile:   i.StartFile,
+		StartRecord: i.StartRecord,
+		EndFile:     i.EndFile,
+		EndRecord:   i.EndRecord,
+		Records:     i.Records,
+		Pairs:       i.Pairs,
+		Completed:   i.Completed,
+		Removed:     i.Removed,
+		Metadata:    i.Metadata,
+	}
+	for f := i.StartFile; (f > 0) && (f <= i.EndFile); f++ {
+		pi.Files = append(pi.Files, f)
+	}
+	return pi
+}
+
+// serve export set over http. index is read on each request, so a set
+// being exported to is served as far as it is indexed.
+//
+//	GET /index                     index metadata and all indexes
+//	GET /projects                  project indexes
+//	GET /projects/<id>             one project
+//	GET /projects/<id>/fasta       records of project
+//	GET /metagenomes/<id>          project, record count and files of metagenome
+//	GET /metagenomes/<id>/fasta    records of metagenome
+//	GET /files                     numbered files with size and projects
+//	GET /files/<name>              numbered file or its R2 mate, range requests supported
+func (e *Exporter) Serve(addr string) (err error) {
+	err = e.openIndex()
+	if err != nil {
+		return
+	}
+	defer e.Store.Close()
+	if !e.Store.Exists() {
+		err = fmt.Errorf("no index in %s", e.Path)
+		return
+	}
+	err = e.loadIndex()
+	if err != nil {
+		return
+	}
+	if addr == "" {
+		addr = SERVE_ADDR_DEFAULT
+	}
+
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("serving %s on %s\n", e.FS.Location(""), addr))
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           e.serveHandler(),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	err = server.ListenAndServe()
+	return
+}
+
+// routes of export set with request logging, index must be open
+func (e *Exporter) serveHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index", e.serveIndex)
+	mux.HandleFunc("/projects", e.serveProjects)
+	mux.HandleFunc("/projects/", e.serveProject)
+	mux.HandleFunc("/metagenomes/", e.serveMetagenome)
+	mux.HandleFunc("/files", e.serveFiles)
+	mux.HandleFunc("/files/", e.serveFile)
+	return logRequests(mux, os.Stdout)
+}
+
+// request uri comes from the client, it is never used as format
+func logRequests(h http.Handler, log io.Writer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(log, "%s %s %s\n", r.RemoteAddr, r.Method, r.URL.RequestURI())
+		if (r.Method != http.MethodGet) && (r.Method != http.MethodHead) {
+			sendError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (e *Exporter) serveIndex(w http.ResponseWriter, r *http.Request) {
+	idx := index.NewExportIndex()
+	meta := index.NewMeta()
+	if err := e.Store.Load(idx, meta); err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var projects []*projectInfo
+	for _, i := range *idx {
+		projects = append(projects, newProjectInfo(i))
+	}
+	sendJSON(w, map[string]interface{}{"meta": meta, "indexes": projects})
+}
+
+func (e *Exporter) serveProjects(w http.ResponseWriter, r *http.Request) {
+	found, err := e.Store.Lookup(index.Query{})
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	projects := []*projectInfo{}
+	for _, i := range found {
+		if !i.Removed {
+			projects = append(projects, newProjectInfo(i))
+		}
+	}
+	sendJSON(w, projects)
+}
+
+func (e *Exporter) serveProject(w http.ResponseWriter, r *http.Request) {
+	id, fasta := pathID(r.URL.Path, "/projects/")
+	i, status, err := e.findIndex(index.Query{Project: id}, fasta)
+	if err != nil {
+		sendError(w, status, err)
+		return
+	}
+	if !fasta {
+		sendJSON(w, newProjectInfo(i))
+		return
+	}
+	e.sendFasta(w, r, i, "", id)
+}
+
+func (e *Exporter) serveMetagenome(w http.ResponseWriter, r *http.Request) {
+	id, fasta := pathID(r.URL.Path, "/metagenomes/")
+	i, status, err := e.findIndex(index.Query{Metagenome: id}, fasta)
+	if err != nil {
+		sendError(w, status, err)
+		return
+	}
+	if !fasta {
+		mi := &metagenomeInfo{Metagenome: id, Project: i.Project, Records: -1}
+		if i.Records != nil {
+			mi.Records = i.Records[id]
+		}
+		mi.Pairs = i.Pairs[id]
+		// files of its project, the index has no per metagenome positions
+		mi.Files = newProjectInfo(i).Files
+		sendJSON(w, mi)
+		return
+	}
+	e.sendFasta(w, r, i, id, id)
+}
+
+func (e *Exporter) serveFiles(w http.ResponseWriter, r *http.Request) {
+	found, err := e.Store.Lookup(index.Query{})
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	files := []*fileInfo{}
+	byNum := make(map[int]*fileInfo)
+	for _, i := range found {
+		for _, f := range newProjectInfo(i).Files {
+			fi, ok := byNum[f]
+			if !ok {
+				fi = &fileInfo{File: f, Name: e.Files.FileName(f), Size: -1}
+				if size, serr := e.FS.Size(fi.Name); serr == nil {
+					fi.Size = size
+				}
+				// R2 file of split pairs
+				if e.Files.Mates {
+					fi.MateName = e.Files.MateFileName(f, 2)
+					fi.MateSize = -1
+					if size, serr := e.FS.Size(fi.MateName); serr == nil {
+						fi.MateSize = size
+					}
+				}
+				byNum[f] = fi
+				files = append(files, fi)
+			}
+			fi.Projects = append(fi.Projects, i.Project)
+		}
+	}
+	sendJSON(w, files)
+}
+
+// only numbered files of the index, their mates and metadata sidecars are served
+func (e *Exporter) serveFile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	ok, err := e.indexedFile(name)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		sendError(w, http.StatusNotFound, fmt.Errorf("no export file %s", name))
+		return
+	}
+	fh, err := e.FS.Open(name)
+	if err != nil {
+		sendError(w, http.StatusNotFound, err)
+		return
+	}
+	defer fh.Close()
+	w.Header().Set("Content-Type", e.contentType(name))
+	// local files and s3 objects both seek, ranges are handled by ServeContent
+	if rs, ok := fh.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, time.Time{}, rs)
+		return
+	}
+	if size, serr := e.FS.Size(name); serr == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, fh)
+}
+
+// file is numbered file of an index or metadata sidecar linked from one
+func (e *Exporter) indexedFile(name string) (ok bool, err error) {
+	if num, isNum := e.Files.fileNumberAny(name); isNum {
+		found, lerr := e.Store.Lookup(index.Query{File: num})
+		ok, err = len(found) > 0, lerr
+		return
+	}
+	found, err := e.Store.Lookup(index.Query{})
+	for _, i := range found {
+		if (i.Metadata != "") && ((name == i.Metadata) || (name == MetadataTSVName(i.Metadata))) {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// sidecars by name, numbered files by compression profile of export set
+func (e *Exporter) contentType(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".jsonl"):
+		return "application/x-ndjson"
+	case strings.HasSuffix(name, ".json"):
+		return "application/json"
+	case strings.HasSuffix(name, ".tsv"):
+		return "text/tab-separated-values"
+	case e.Profile.Compressed():
+		return "application/gzip"
+	}
+	return "text/x-fasta"
+}
+
+// index of project or metagenome, records can only be read once completed
+func (e *Exporter) findIndex(q index.Query, fasta bool) (found *index.Index, status int, err error) {
+	status = http.StatusNotFound
+	name := q.Project + q.Metagenome
+	if name == "" {
+		err = fmt.Errorf("id missing")
+		return
+	}
+	matches, err := e.Store.Lookup(q)
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+	for _, i := range matches {
+		if !i.Removed {
+			found = i
+		}
+	}
+	if found == nil {
+		err = fmt.Errorf("%s not found", name)
+		return
+	}
+	if fasta && !found.Completed {
+		status = http.StatusConflict
+		err = fmt.Errorf("project %s is incomplete", found.Project)
+	}
+	return
+}
+
+// records are streamed as read, an error after the first write can
+// only end the response early
+func (e *Exporter) sendFasta(w http.ResponseWriter, r *http.Request, i *index.Index, mg string, name string) {
+	w.Header().Set("Content-Type", "text/x-fasta")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.fasta\"", name))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := e.extractIndex(i, mg, w); err != nil {
+		fmt.Fprintf(os.Stderr, "error streaming %s: %s\n", name, err.Error())
+	}
+}
+
+// id of path under prefix, and if it asks for fasta
+func pathID(path string, prefix string) (id string, fasta bool) {
+	id = strings.TrimPrefix(path, prefix)
+	if strings.HasSuffix(id, "/fasta") {
+		id = strings.TrimSuffix(id, "/fasta")
+		fasta = true
+	}
+	return
+}
+
+func sendJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func sendError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
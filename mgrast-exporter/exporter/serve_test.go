@@ -0,0 +1,137 @@
+package exporter
+
+import (
+	"bytes"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// server of export set in compression profile, nil for default,
+// with metadata sidecars of mgp1
+func testServer(t *testing.T, prof *file.Profile) (*httptest.Server, string) {
+	dir := t.TempDir()
+	opts := NewOptions()
+	opts.Path = dir
+	opts.Profile = prof
+	writeTestSetOpts(t, opts, bundleSegments)
+	e := New(opts)
+	if err := e.openIndex(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Store.Close() })
+	if err := e.loadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	sidecar := MetadataName("mgp1")
+	for name, data := range map[string]string{sidecar: "{\"project\": \"mgp1\"}\n", MetadataTSVName(sidecar): "project\nmgp1\n"} {
+		if err := writeFile(e.FS, name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	(*e.Indexes)[0].Link(sidecar)
+	if err := e.Store.Save(e.Indexes, e.Meta); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(e.serveHandler())
+	t.Cleanup(srv.Close)
+	return srv, dir
+}
+
+func TestServeFileRange(t *testing.T) {
+	srv, dir := testServer(t, nil)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "1.fasta.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/files/1.fasta.gz", nil)
+	req.Header.Set("Range", "bytes=10-19")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("range request status %d, expected %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	if !bytes.Equal(body, data[10:20]) {
+		t.Errorf("range request returned %x, expected %x", body, data[10:20])
+	}
+
+	// whole file
+	resp, err = http.Get(srv.URL + "/files/1.fasta.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ = ioutil.ReadAll(resp.Body)
+	if (resp.StatusCode != http.StatusOK) || !bytes.Equal(body, data) {
+		t.Errorf("file request status %d with %d bytes, expected %d bytes", resp.StatusCode, len(body), len(data))
+	}
+}
+
+// only numbered files and sidecars of the index are served
+func TestServeFileNotFound(t *testing.T) {
+	srv, _ := testServer(t, nil)
+	for _, name := range []string{"export.index", "1.fasta.gz.temp", "3.fasta.gz", "x.fasta.gz", "..%2Fexport.index", "1.ids.gz", "mgp2.metadata.jsonl"} {
+		resp, err := http.Get(srv.URL + "/files/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status %d, expected %d", name, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+// type of numbered files follows compression profile, sidecars their name
+func TestServeContentType(t *testing.T) {
+	tests := []struct {
+		profile *file.Profile
+		types   map[string]string
+	}{
+		{nil, map[string]string{"1.fasta.gz": "application/gzip", "mgp1.metadata.jsonl": "application/x-ndjson", "mgp1.metadata.tsv": "text/tab-separated-values"}},
+		{file.Profiles["none"], map[string]string{"1.fasta": "text/x-fasta", "2.fasta": "text/x-fasta", "mgp1.metadata.jsonl": "application/x-ndjson"}},
+	}
+	for _, tt := range tests {
+		srv, dir := testServer(t, tt.profile)
+		for name, ctype := range tt.types {
+			data, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.Get(srv.URL + "/files/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if (resp.StatusCode != http.StatusOK) || !bytes.Equal(body, data) {
+				t.Errorf("%s: status %d with %d bytes, expected %d bytes", name, resp.StatusCode, len(body), len(data))
+			}
+			if got := resp.Header.Get("Content-Type"); got != ctype {
+				t.Errorf("%s: content type %s, expected %s", name, got, ctype)
+			}
+		}
+	}
+}
+
+// verbs in request uri are logged as sent
+func TestLogRequests(t *testing.T) {
+	var log bytes.Buffer
+	srv := httptest.NewServer(logRequests(http.NotFoundHandler(), &log))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/files/%25s%25d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !bytes.HasSuffix(log.Bytes(), []byte(" GET /files/%25s%25d\n")) {
+		t.Errorf("logged %q", log.String())
+	}
+}
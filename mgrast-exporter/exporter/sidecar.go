@@ -0,0 +1,123 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"sort"
+	"strings"
+)
+
+var METADATA_SUFFIX = ".metadata"
+
+// shock node attributes of one metagenome
+type NodeMetadata struct {
+	Project    string                 `json:"project"`
+	Metagenome string                 `json:"metagenome"`
+	Node       string                 `json:"node"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// json lines sidecar of project, linked from its index
+func MetadataName(project string) string {
+	return project + METADATA_SUFFIX + ".jsonl"
+}
+
+// tsv sidecar next to json lines one
+func MetadataTSVName(jsonlName string) string {
+	return strings.TrimSuffix(jsonlName, ".jsonl") + ".tsv"
+}
+
+// attributes of shock node, nil if it has none
+func nodeAttributes(data interface{}) map[string]interface{} {
+	node, _ := data.(map[string]interface{})
+	attr, _ := node["attributes"].(map[string]interface{})
+	return attr
+}
+
+// write project metagenomes as json lines, one node per line, and as tsv with
+// one column per attribute. nested attributes are json in tsv.
+func writeMetadata(fs storage.Storage, project string, nodes []*NodeMetadata) (err error) {
+	var jsonl bytes.Buffer
+	keys := make(map[string]bool)
+	for _, n := range nodes {
+		line, merr := json.Marshal(n)
+		if merr != nil {
+			err = merr
+			return
+		}
+		jsonl.Write(line)
+		jsonl.WriteByte('\n')
+		for k := range n.Attributes {
+			keys[k] = true
+		}
+	}
+	// ids are already columns
+	delete(keys, "id")
+	delete(keys, "project_id")
+	var columns []string
+	for k := range keys {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+
+	var tsv bytes.Buffer
+	fmt.Fprintf(&tsv, "project\tmetagenome\tnode")
+	for _, c := range columns {
+		fmt.Fprintf(&tsv, "\t%s", tsvValue(c))
+	}
+	tsv.WriteByte('\n')
+	for _, n := range nodes {
+		fmt.Fprintf(&tsv, "%s\t%s\t%s", n.Project, n.Metagenome, n.Node)
+		for _, c := range columns {
+			fmt.Fprintf(&tsv, "\t%s", tsvValue(n.Attributes[c]))
+		}
+		tsv.WriteByte('\n')
+	}
+
+	name := MetadataName(project)
+	err = writeFile(fs, name, jsonl.Bytes())
+	if err != nil {
+		return
+	}
+	err = writeFile(fs, MetadataTSVName(name), tsv.Bytes())
+	return
+}
+
+// strings as is without tabs or newlines, other values as json
+func tsvValue(v interface{}) string {
+	var s string
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		s = t
+	default:
+		js, _ := json.Marshal(t)
+		s = string(js)
+	}
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(s)
+}
+
+// remove sidecars of project
+func deleteMetadata(fs storage.Storage, jsonlName string) {
+	if jsonlName == "" {
+		return
+	}
+	fs.Delete(jsonlName)
+	fs.Delete(MetadataTSVName(jsonlName))
+}
+
+func writeFile(fs storage.Storage, name string, data []byte) (err error) {
+	fh, err := fs.Create(name)
+	if err != nil {
+		return
+	}
+	if _, err = fh.Write(data); err != nil {
+		fh.Close()
+		return
+	}
+	err = fh.Close()
+	return
+}
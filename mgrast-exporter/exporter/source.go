@@ -0,0 +1,174 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"github.com/MG-RAST/go-shock-client"
+	"github.com/MG-RAST/golib/httpclient"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shock nodes to export, one at a time
+type nodeSource interface {
+	Next(ctx context.Context) (*httpclient.Item, error)
+}
+
+// shock calls do not take a context, they are left running once ctx is
+// done or nothing came back within timeout
+func withTimeout(ctx context.Context, timeout time.Duration, what string, call func() error) (err error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-expired:
+		err = fmt.Errorf("%s: no response within %s", what, timeout)
+	}
+	return
+}
+
+// paged node listing of shock, each page within idle timeout
+type shockNodes struct {
+	rc   *httpclient.RestClient
+	idle time.Duration
+}
+
+func (e *Exporter) queryNodes(ctx context.Context, query url.Values) (nodes *shockNodes, err error) {
+	var rc *httpclient.RestClient
+	err = withTimeout(ctx, e.IdleTimeout, "shock node query", func() (qerr error) {
+		rc, qerr = e.SC.QueryPaginated(RESOURCE, query, PAGE_SIZE, 0)
+		return
+	})
+	if err != nil {
+		return
+	}
+	e.RC = rc
+	nodes = &shockNodes{rc: rc, idle: e.IdleTimeout}
+	return
+}
+
+func (s *shockNodes) Next(ctx context.Context) (item *httpclient.Item, err error) {
+	var next *httpclient.Item
+	err = withTimeout(ctx, s.idle, "shock node listing", func() (nerr error) {
+		next, nerr = s.rc.Next()
+		return
+	})
+	if err == nil {
+		item = next
+	}
+	return
+}
+
+// download stream of node, given up once ctx is done
+func (e *Exporter) fetchNode(ctx context.Context, nodeID string) (stream io.ReadCloser, err error) {
+	downloadUrl := fmt.Sprintf("%s/%s/%s?download", e.SC.Host, RESOURCE, nodeID)
+	if e.Debug {
+		fmt.Fprintf(os.Stdout, downloadUrl+"\n")
+	}
+	var body io.ReadCloser
+	var mu sync.Mutex
+	abandoned := false
+	err = withTimeout(ctx, e.IdleTimeout, fmt.Sprintf("shock node %s", nodeID), func() (ferr error) {
+		b, ferr := shock.FetchShockStream(downloadUrl, "")
+		mu.Lock()
+		defer mu.Unlock()
+		// response after giving up is not read
+		if (ferr == nil) && abandoned {
+			b.Close()
+			return
+		}
+		body = b
+		return
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		abandoned = true
+		return
+	}
+	stream = newTimedReader(ctx, body, e.IdleTimeout)
+	return
+}
+
+// stream closed once ctx is done, or a read waited for data longer than idle
+// timeout. time between reads is not counted, a consumer blocked on the writer
+// does not make the stream idle. a read after closing returns the reason.
+type timedReader struct {
+	r       io.ReadCloser
+	idle    time.Duration
+	waiting int64
+	stop    chan bool
+	once    sync.Once
+	mu      sync.Mutex
+	reason  error
+}
+
+func newTimedReader(ctx context.Context, r io.ReadCloser, idle time.Duration) *timedReader {
+	t := &timedReader{r: r, idle: idle, stop: make(chan bool)}
+	go t.watch(ctx)
+	return t
+}
+
+func (t *timedReader) watch(ctx context.Context) {
+	var tick <-chan time.Time
+	if t.idle > 0 {
+		ticker := time.NewTicker(t.idle / 4)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ctx.Done():
+			t.abort(ctx.Err())
+			return
+		case <-tick:
+			since := atomic.LoadInt64(&t.waiting)
+			if (since != 0) && (time.Since(time.Unix(0, since)) > t.idle) {
+				t.abort(fmt.Errorf("no data read within %s", t.idle))
+				return
+			}
+		}
+	}
+}
+
+func (t *timedReader) abort(reason error) {
+	t.mu.Lock()
+	t.reason = reason
+	t.mu.Unlock()
+	t.r.Close()
+}
+
+func (t *timedReader) Read(p []byte) (n int, err error) {
+	atomic.StoreInt64(&t.waiting, time.Now().UnixNano())
+	n, err = t.r.Read(p)
+	atomic.StoreInt64(&t.waiting, 0)
+	if err != nil {
+		t.mu.Lock()
+		if t.reason != nil {
+			err = t.reason
+		}
+		t.mu.Unlock()
+	}
+	return
+}
+
+func (t *timedReader) Close() (err error) {
+	t.once.Do(func() { close(t.stop) })
+	return t.r.Close()
+}
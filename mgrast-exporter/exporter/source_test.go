@@ -0,0 +1,73 @@
+package exporter
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// consumer busy longer than idle timeout between reads is not idle
+func TestTimedReaderSlowConsumer(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 4; i++ {
+			pw.Write([]byte("ACGT"))
+		}
+		pw.Close()
+	}()
+	r := newTimedReader(context.Background(), pr, 50*time.Millisecond)
+	defer r.Close()
+	buf := make([]byte, 4)
+	total := 0
+	for {
+		n, err := r.Read(buf)
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read after %d bytes: %s", total, err.Error())
+		}
+		// as if blocked sending to writer
+		time.Sleep(150 * time.Millisecond)
+	}
+	if total != 16 {
+		t.Errorf("read %d bytes, expected 16", total)
+	}
+}
+
+// read waiting on a stalled source fails after idle timeout
+func TestTimedReaderStalled(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("ACGT"))
+	r := newTimedReader(context.Background(), pr, 50*time.Millisecond)
+	defer r.Close()
+	start := time.Now()
+	data, err := ioutil.ReadAll(r)
+	if (err == nil) || !strings.Contains(err.Error(), "no data read within") {
+		t.Fatalf("stalled read returned %v", err)
+	}
+	if string(data) != "ACGT" {
+		t.Errorf("read %q before stall", data)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("stall noticed after %s", time.Since(start))
+	}
+}
+
+// read is given up once ctx is done
+func TestTimedReaderCancel(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newTimedReader(ctx, pr, 0)
+	defer r.Close()
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := r.Read(make([]byte, 4)); err != context.Canceled {
+		t.Errorf("read returned %v, expected %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,311 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"github.com/MG-RAST/golib/httpclient"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var STAGES_MANIFEST = "stages.json"
+var STAGES_MANIFEST_TSV = "stages.tsv"
+
+// nodes of one stage passed on from the shared listing as it is read.
+// err is set before items is closed, a failed listing is not an end.
+type stageNodes struct {
+	items chan *httpclient.Item
+	err   error
+}
+
+func newStageNodes() *stageNodes {
+	return &stageNodes{items: make(chan *httpclient.Item)}
+}
+
+func (l *stageNodes) Next(ctx context.Context) (item *httpclient.Item, err error) {
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case it, ok := <-l.items:
+		if !ok {
+			err = io.EOF
+			if l.err != nil {
+				err = l.err
+			}
+			return
+		}
+		item = it
+	}
+	return
+}
+
+// metagenome across stages of a multi-stage export
+type stagesManifest struct {
+	Created     time.Time                       `json:"created"`
+	Stages      []*stageSummary                 `json:"stages"`
+	Metagenomes map[string]*stagesManifestEntry `json:"metagenomes"`
+}
+
+type stageSummary struct {
+	Stage       string `json:"stage"`
+	Directory   string `json:"directory"`
+	SeqType     string `json:"seq_type"`
+	Projects    int    `json:"projects"`
+	Metagenomes int    `json:"metagenomes"`
+}
+
+type stagesManifestEntry struct {
+	Project string                 `json:"project"`
+	Stages  map[string]*stageFiles `json:"stages"`
+}
+
+// records of metagenome in a stage, files are relative to top directory
+type stageFiles struct {
+	Records int      `json:"records"`
+	Files   []string `json:"files"`
+}
+
+func stageNodeName(data interface{}) string {
+	node, _ := data.(map[string]interface{})
+	attr, _ := node["attributes"].(map[string]interface{})
+	stage, _ := attr["stage_name"].(string)
+	return stage
+}
+
+// subdirectory of stage, also under an s3 prefix
+func stagePath(path string, stage string) string {
+	if storage.IsRemote(path) {
+		return strings.TrimSuffix(path, "/") + "/" + stage
+	}
+	return filepath.Join(path, stage)
+}
+
+// export each stage into its own subdirectory with its own index. nodes of
+// all stages are listed once, stages are exported side by side and each
+// gets its nodes as they are listed. a manifest of all stages is written
+// to the top directory once all are done.
+func (e *Exporter) ExportStages(ctx context.Context, stages []string) (err error) {
+	seen := make(map[string]bool)
+	for _, s := range stages {
+		if (s == "") || seen[s] || strings.ContainsAny(s, "/\\") {
+			err = fmt.Errorf("invalid or repeated stage name '%s'", s)
+			return
+		}
+		seen[s] = true
+	}
+	err = e.openStorage()
+	if err != nil {
+		return
+	}
+
+	// one listing of requested stages, split by stage name of node
+	e.Query.Del("stage_name")
+	for _, s := range stages {
+		e.Query.Add("stage_name", s)
+	}
+	listing, err := e.queryNodes(ctx, e.Query)
+	if err != nil {
+		return
+	}
+
+	// a failed stage stops the listing and the other stages
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lists := make(map[string]*stageNodes)
+	done := make(chan error, len(stages))
+	for _, s := range stages {
+		se := e.stageExporter(s)
+		lists[s] = newStageNodes()
+		se.nodes = lists[s]
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("exporting stage %s into %s\n", s, se.Path))
+		go func(s string, se *Exporter) {
+			serr := se.Export(ctx)
+			if serr != nil {
+				serr = fmt.Errorf("stage %s: %s", s, serr.Error())
+				cancel()
+			}
+			done <- serr
+		}(s, se)
+	}
+
+	var lerr error
+	for lerr == nil {
+		item, er := listing.Next(ctx)
+		if er != nil {
+			if er != io.EOF {
+				lerr = er
+			}
+			break
+		}
+		l, ok := lists[stageNodeName(item.Data)]
+		if !ok {
+			continue
+		}
+		select {
+		case l.items <- item:
+		case <-ctx.Done():
+			lerr = ctx.Err()
+		}
+	}
+	for _, l := range lists {
+		l.err = lerr
+		close(l.items)
+	}
+
+	// error of a stage comes before the listing stopped by it
+	for range stages {
+		if serr := <-done; (serr != nil) && (err == nil) {
+			err = serr
+		}
+	}
+	if err == nil {
+		err = lerr
+	}
+	if err != nil {
+		return
+	}
+	err = e.writeStagesManifest(stages)
+	return
+}
+
+// exporter of stage subdirectory with settings of e
+func (e *Exporter) stageExporter(stage string) *Exporter {
+	se := *e
+	se.Path = stagePath(e.Path, stage)
+	se.Stage = stage
+	se.FS = nil
+	se.Store = nil
+	se.Indexes = index.NewExportIndex()
+	se.Meta = index.NewMeta()
+	se.Files = NewFileNaming()
+	se.writer = NewRecordWriter()
+	se.nodes = nil
+	se.Query = url.Values{}
+	for k, v := range e.Query {
+		se.Query[k] = append([]string{}, v...)
+	}
+	// alphabet follows sequence type of each stage
+	if e.Valid != nil {
+		v := *e.Valid
+		se.Valid = &v
+	}
+	// stages run side by side, each with its own filter
+	if e.Dedup != nil {
+		se.Dedup = e.Dedup.New()
+	}
+	return &se
+}
+
+// json and tsv manifest from indexes of all stages
+func (e *Exporter) writeStagesManifest(stages []string) (err error) {
+	manifest := &stagesManifest{
+		Created:     time.Now().UTC(),
+		Metagenomes: make(map[string]*stagesManifestEntry),
+	}
+	for _, s := range stages {
+		se := e.stageExporter(s)
+		if err = se.openIndex(); err != nil {
+			return
+		}
+		idx := index.NewExportIndex()
+		meta := index.NewMeta()
+		err = se.Store.Load(idx, meta)
+		se.Store.Close()
+		if err != nil {
+			return
+		}
+		// stage without nodes has no index
+		seqType := file.StageSeqType(s)
+		if meta.SeqType != "" {
+			if seqType, err = file.GetSeqType(meta.SeqType); err != nil {
+				return
+			}
+		}
+		suffix := file.FileSuffix(seqType, meta.Profile)
+		summary := &stageSummary{Stage: s, Directory: s, SeqType: seqType.Name}
+		manifest.Stages = append(manifest.Stages, summary)
+		for _, i := range *idx {
+			if i.Removed || !i.Completed {
+				continue
+			}
+			summary.Projects += 1
+			var files []string
+			for f := i.StartFile; f <= i.EndFile; f++ {
+				if meta.Paired == PAIRED_SPLIT {
+					files = append(files, fmt.Sprintf("%s/%d_R1%s", s, f, suffix), fmt.Sprintf("%s/%d_R2%s", s, f, suffix))
+				} else {
+					files = append(files, fmt.Sprintf("%s/%d%s", s, f, suffix))
+				}
+			}
+			for _, m := range i.Metagenomes {
+				summary.Metagenomes += 1
+				entry, ok := manifest.Metagenomes[m]
+				if !ok {
+					entry = &stagesManifestEntry{Project: i.Project, Stages: make(map[string]*stageFiles)}
+					manifest.Metagenomes[m] = entry
+				}
+				records := -1
+				if i.Records != nil {
+					records = i.Records[m]
+				}
+				entry.Stages[s] = &stageFiles{Records: records, Files: files}
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFile(e.FS, STAGES_MANIFEST, data)
+	if err != nil {
+		return
+	}
+
+	// one row per metagenome, records and files of each stage
+	var tsv bytes.Buffer
+	fmt.Fprintf(&tsv, "project\tmetagenome")
+	for _, s := range stages {
+		fmt.Fprintf(&tsv, "\t%s_records\t%s_files", s, s)
+	}
+	tsv.WriteByte('\n')
+	var mgs []string
+	for m := range manifest.Metagenomes {
+		mgs = append(mgs, m)
+	}
+	sort.Slice(mgs, func(i, j int) bool {
+		a, b := manifest.Metagenomes[mgs[i]], manifest.Metagenomes[mgs[j]]
+		if a.Project == b.Project {
+			return mgs[i] < mgs[j]
+		}
+		return a.Project < b.Project
+	})
+	for _, m := range mgs {
+		entry := manifest.Metagenomes[m]
+		fmt.Fprintf(&tsv, "%s\t%s", entry.Project, m)
+		for _, s := range stages {
+			if sf, ok := entry.Stages[s]; ok {
+				fmt.Fprintf(&tsv, "\t%d\t%s", sf.Records, strings.Join(sf.Files, ","))
+			} else {
+				fmt.Fprintf(&tsv, "\t\t")
+			}
+		}
+		tsv.WriteByte('\n')
+	}
+	err = writeFile(e.FS, STAGES_MANIFEST_TSV, tsv.Bytes())
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("stages manifest: %s\n", e.FS.Location(STAGES_MANIFEST)))
+	return
+}
@@ -1,39 +1,119 @@
 package exporter
 
 import (
+	"context"
 	"fmt"
 	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
 	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
 	"os"
 )
 
-var (
-	RecordWriter = NewRecordWriter()
-)
-
 func NewRecordWriter() *RWBuffer {
 	return &RWBuffer{
 		RecBuffer: make(chan *Record, 1024),
 		Done:      make(chan bool, 1),
+		Errors:    make(chan error, 64),
+		Stop:      make(chan bool, 1),
 	}
 }
 
+// errors of writer go back to exporter, after an open, write, close or index
+// error nothing more is written. stop ends writer without finishing project.
 type RWBuffer struct {
 	RecBuffer chan *Record
 	Done      chan bool
-	Path      string
+	Errors    chan error
+	Stop      chan bool
+	FS        storage.Storage
 	Size      int64
+	Threads   int
+	Profile   *file.Profile
+	Store     index.Backend
+	Metadata  bool
+	ReadIndex bool
+	Files     *FileNaming
+	Indexes   *index.Indexes
+	Meta      *index.Meta
 	Debug     bool
 }
 
-func (b *RWBuffer) Init(path string, size int64, debug bool) {
+// store is not used for simple writes
+func (b *RWBuffer) Init(fs storage.Storage, size int64, threads int, profile *file.Profile, store index.Backend, debug bool) {
 	if debug {
 		b.Size = size * 1024 * 1024
 	} else {
 		b.Size = size * 1024 * 1024 * 1024
 	}
-	b.Path = path
+	b.FS = fs
+	b.Threads = threads
+	b.Profile = profile
+	b.Store = store
+	b.Metadata = false
+	b.ReadIndex = false
+	b.Files = NewFileNaming()
+	b.Indexes = nil
+	b.Meta = nil
 	b.Debug = debug
+	// left from an earlier run
+	for len(b.RecBuffer) > 0 {
+		<-b.RecBuffer
+	}
+	for len(b.Errors) > 0 {
+		<-b.Errors
+	}
+	for len(b.Done) > 0 {
+		<-b.Done
+	}
+	for len(b.Stop) > 0 {
+		<-b.Stop
+	}
+}
+
+// file names and index of export set, index is not used for simple writes
+func (b *RWBuffer) SetIndex(files *FileNaming, idx *index.Indexes, meta *index.Meta) {
+	b.Files = files
+	b.Indexes = idx
+	b.Meta = meta
+}
+
+// send record, or return a writer error received first.
+// the record is not sent if an error is returned.
+func (b *RWBuffer) Send(ctx context.Context, rec *Record) (err error) {
+	select {
+	case b.RecBuffer <- rec:
+	case err = <-b.Errors:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// wait for writer to finish project, or the run. errors sent before are
+// returned, err is set if ctx is done first.
+func (b *RWBuffer) Wait(ctx context.Context) (errs []error, err error) {
+	for {
+		select {
+		case <-b.Done:
+			for len(b.Errors) > 0 {
+				errs = append(errs, <-b.Errors)
+			}
+			return
+		case werr := <-b.Errors:
+			errs = append(errs, werr)
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+// end writer after a failed export. files are closed to be readable,
+// records written after the last finished project are left for clean.
+func (b *RWBuffer) Abort() []error {
+	b.Stop <- true
+	errs, _ := b.Wait(context.Background())
+	return errs
 }
 
 func (b *RWBuffer) WriterHandle(simpleWrite bool, startFile int, startRec int) {
@@ -43,45 +123,89 @@ func (b *RWBuffer) WriterHandle(simpleWrite bool, startFile int, startRec int) {
 
 	// get starting file
 	if startFile == 0 || startRec == 0 {
-		if index.ExportIndex.Len() == 0 {
+		if b.Indexes.Len() == 0 {
 			startFile = 1
 			startRec = 1
 		} else {
-			startFile = (*index.ExportIndex)[index.ExportIndex.Len()-1].EndFile
-			startRec = (*index.ExportIndex)[index.ExportIndex.Len()-1].EndRecord + 1
+			startFile = (*b.Indexes)[b.Indexes.Len()-1].EndFile
+			startRec = (*b.Indexes)[b.Indexes.Len()-1].EndRecord + 1
+		}
+	}
+	fname := b.Files.FileName(startFile)
+
+	// read index of current file, continued when appending
+	var currReads *index.ReadIndex
+	var err error
+	if b.ReadIndex && !simpleWrite {
+		if currReads, err = b.startReadIndex(startFile, startRec); err != nil {
+			b.fail(err, simpleWrite)
+			return
 		}
 	}
-	fname := FileFromInt(startFile, b.Path)
 
 	// append or create
-	currFile, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	currFile, currWrite, err := b.openFile(fname, true)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, fmt.Sprintf("error opening file %s: %s\n", fname, err.Error()))
-		os.Exit(1)
+		b.fail(err, simpleWrite)
+		return
+	}
+
+	// mates of split pairs go to parallel file of same number and record
+	var mateFile storage.Writer
+	var mateWrite *file.Writer
+	mname := b.Files.MateFileName(startFile, 2)
+	if b.Files.Mates {
+		if mateFile, mateWrite, err = b.openFile(mname, true); err != nil {
+			b.fail(err, simpleWrite)
+			return
+		}
 	}
-	currWrite := file.NewWriter(currFile)
 
 	prev := new(index.PrevInfo)
 	fileCount := startFile
 	recCount := startRec
 	projectDone := false
 
-	ifile := IndexFile(b.Path)
-
 	currIndex := new(index.Index)
 	if !simpleWrite {
-		index.ExportIndex.Add(currIndex)
+		b.Indexes.Add(currIndex)
 	}
 
 	for {
-		rec := <-b.RecBuffer
+		var rec *Record
+		select {
+		case rec = <-b.RecBuffer:
+		case <-b.Stop:
+			err = b.closeFile(currFile, currWrite, fname)
+			if (err == nil) && b.Files.Mates {
+				err = b.closeFile(mateFile, mateWrite, mname)
+			}
+			if err != nil {
+				b.Errors <- err
+			}
+			if b.Debug {
+				fmt.Fprintf(os.Stdout, "writer stopped\n")
+			}
+			b.Done <- true
+			return
+		}
 
 		// end of current project, finsh current index and make new
 		if rec == nil {
 			if projectDone {
 				// we already finished a project, 2nd nil means we are all done
-				currWrite.Close()
-				currFile.Close()
+				err = b.closeFile(currFile, currWrite, fname)
+				if (err == nil) && b.Files.Mates {
+					err = b.closeFile(mateFile, mateWrite, mname)
+				}
+				if err != nil {
+					b.Errors <- err
+				}
+				b.saveReadIndex(currReads, fileCount)
+				// drop unused index started after last project
+				if !simpleWrite && (currIndex.Project == "") {
+					b.Indexes.RemoveFromEnd(1)
+				}
 				if b.Debug {
 					fmt.Fprintf(os.Stdout, "writer is all done\n")
 				}
@@ -95,23 +219,56 @@ func (b *RWBuffer) WriterHandle(simpleWrite bool, startFile int, startRec int) {
 			if simpleWrite {
 				continue
 			}
+			// no records since last project, keep index for next one
+			if currIndex.Project == "" {
+				b.Done <- true
+				continue
+			}
 			currIndex.Finalize(prev.M, prev.F, prev.R)
-			index.ExportIndex.Save(ifile)
+			// sidecar is written before project end is signalled
+			if b.Metadata {
+				currIndex.Link(MetadataName(currIndex.Project))
+			}
+			if err = b.Store.Save(b.Indexes, b.Meta); err != nil {
+				b.Errors <- &WriteError{Op: OP_INDEX, Path: b.Store.Path(), Project: currIndex.Project, Err: err}
+				b.Done <- true
+				b.drain(simpleWrite, true)
+				return
+			}
 
 			nextIndex := new(index.Index)
-			index.ExportIndex.Add(nextIndex)
+			b.Indexes.Add(nextIndex)
 			currIndex = nextIndex
 			b.Done <- true
 			continue
 		}
 		projectDone = false
 
-		err := currWrite.Write(rec.R)
-		if err != nil {
-			// skip bad write
-			fmt.Fprintf(os.Stderr, fmt.Sprintf("error in write: project=%s file=%d record=%d\n", fileCount, recCount))
+		// record of another project is not written, its index would be wrong
+		if !simpleWrite && (currIndex.Project != "") && (currIndex.Project != rec.P) {
+			b.Errors <- &WriteError{Op: OP_RECORD, Project: rec.P, Metagenome: rec.M, File: fileCount, Record: recCount, Err: fmt.Errorf("record of project %s when expecting %s", rec.P, currIndex.Project)}
 			continue
 		}
+
+		// interleaved mate follows read in same file
+		recs := [][]byte{rec.R}
+		err = currWrite.Write(rec.R)
+		if (err == nil) && (rec.R2 != nil) && b.Files.Mates {
+			err = mateWrite.Write(rec.R2)
+		} else if (err == nil) && (rec.R2 != nil) {
+			recs = append(recs, rec.R2)
+			err = currWrite.Write(rec.R2)
+		}
+		if err != nil {
+			// compressed file and its mate are out of step after a failed
+			// write, the run stops and clean truncates to last finished project
+			b.closeFile(currFile, currWrite, fname)
+			if b.Files.Mates {
+				b.closeFile(mateFile, mateWrite, mname)
+			}
+			b.fail(&WriteError{Op: OP_WRITE, Path: b.FS.Location(fname), Project: rec.P, Metagenome: rec.M, File: fileCount, Record: recCount, Err: err}, simpleWrite)
+			return
+		}
 		if simpleWrite {
 			continue
 		}
@@ -126,35 +283,147 @@ func (b *RWBuffer) WriterHandle(simpleWrite bool, startFile int, startRec int) {
 			if rec.M != prev.M {
 				currIndex.Update(rec.M)
 			}
-		} else if currIndex.Project == "" {
+		} else {
 			// empty index, start it
 			currIndex.Init(rec.P, rec.M, fileCount, recCount)
-		} else if currIndex.Project != rec.P {
-			// we should not be in this state
-			fmt.Fprintf(os.Stderr, fmt.Sprintf("error in record: project %s when expecting %s\n", rec.P, currIndex.Project))
-			continue
+		}
+		for n, r := range recs {
+			if n > 0 {
+				recCount += 1
+			}
+			currIndex.AddRecord(rec.M)
+			if currReads != nil {
+				currReads.Add(index.ReadKey(r), recCount)
+			}
+		}
+		if rec.R2 != nil {
+			currIndex.AddPair(rec.M)
+		}
+		// mates of split pairs are found under record of read
+		if (currReads != nil) && (rec.R2 != nil) && b.Files.Mates {
+			currReads.Add(index.ReadKey(rec.R2), recCount)
 		}
 		prev.M = rec.M
 		prev.F = fileCount
 		prev.R = recCount
 
-		info, _ := currFile.Stat()
-		if info.Size() > b.Size {
+		// pairs are not split across files
+		if currFile.Size() > b.Size {
 			// need to switch to new file, reset counters
-			currWrite.Close()
-			currFile.Close()
+			err = b.closeFile(currFile, currWrite, fname)
+			if (err == nil) && b.Files.Mates {
+				err = b.closeFile(mateFile, mateWrite, mname)
+			}
+			if err != nil {
+				b.fail(err, simpleWrite)
+				return
+			}
+			b.saveReadIndex(currReads, fileCount)
+			if currReads != nil {
+				currReads = index.NewReadIndex()
+			}
 			fileCount += 1
 			recCount = 1
-			fname = FileFromInt(fileCount, b.Path)
-			currFile, err = os.OpenFile(fname, os.O_CREATE|os.O_WRONLY, 0666)
+			fname = b.Files.FileName(fileCount)
+			currFile, currWrite, err = b.openFile(fname, false)
+			if (err == nil) && b.Files.Mates {
+				mname = b.Files.MateFileName(fileCount, 2)
+				mateFile, mateWrite, err = b.openFile(mname, false)
+			}
 			if err != nil {
-				fmt.Fprintf(os.Stderr, fmt.Sprintf("error opening file %s: %s\n", fname, err.Error()))
-				os.Exit(1)
+				b.fail(err, simpleWrite)
+				return
 			}
-			currWrite = file.NewWriter(currFile)
 		} else {
 			recCount += 1
 		}
 	}
 	return
 }
+
+// send error that stops the writer
+func (b *RWBuffer) fail(err error, simpleWrite bool) {
+	b.Errors <- err
+	b.drain(simpleWrite, false)
+}
+
+// take records without writing them until the exporter ends the run,
+// project ends are answered as before
+func (b *RWBuffer) drain(simpleWrite bool, projectDone bool) {
+	if b.Debug {
+		fmt.Fprintf(os.Stdout, "writer stopped, nothing more is written\n")
+	}
+	for {
+		var rec *Record
+		select {
+		case rec = <-b.RecBuffer:
+		case <-b.Stop:
+			b.Done <- true
+			return
+		}
+		if rec != nil {
+			projectDone = false
+			continue
+		}
+		if projectDone {
+			b.Done <- true
+			return
+		}
+		projectDone = true
+		if !simpleWrite {
+			b.Done <- true
+		}
+	}
+}
+
+// append to or create numbered file, on s3 appending copies the whole file again
+func (b *RWBuffer) openFile(fname string, appendFile bool) (f storage.Writer, w *file.Writer, err error) {
+	if appendFile {
+		f, err = b.FS.Append(fname)
+	} else {
+		f, err = b.FS.Create(fname)
+	}
+	if err != nil {
+		err = &WriteError{Op: OP_OPEN, Path: b.FS.Location(fname), Err: err}
+		return
+	}
+	w = file.NewWriter(f, b.Threads, b.Profile)
+	return
+}
+
+// remote files are only stored once closed, a failed close loses the file
+func (b *RWBuffer) closeFile(f storage.Writer, w *file.Writer, fname string) (err error) {
+	err = w.Close()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		err = &WriteError{Op: OP_CLOSE, Path: b.FS.Location(fname), Err: err}
+	}
+	return
+}
+
+// read index of records before start, from sidecar or by reading the file
+func (b *RWBuffer) startReadIndex(fnum int, startRec int) (ri *index.ReadIndex, err error) {
+	if (startRec <= 1) || !b.FS.Exists(b.Files.FileName(fnum)) {
+		ri = index.NewReadIndex()
+		return
+	}
+	ri, err = b.Files.loadReadIndex(b.FS, fnum)
+	if err != nil {
+		err = &WriteError{Op: OP_INDEX, Path: b.FS.Location(ReadIndexName(fnum)), Err: err}
+		return
+	}
+	ri.Truncate(startRec - 1)
+	return
+}
+
+func (b *RWBuffer) saveReadIndex(ri *index.ReadIndex, fnum int) {
+	if ri == nil {
+		return
+	}
+	name := ReadIndexName(fnum)
+	if err := ri.Save(b.FS, name); err != nil {
+		fmt.Fprintf(os.Stderr, fmt.Sprintf("error saving read index %s: %s\n", b.FS.Location(name), err.Error()))
+	}
+}
@@ -0,0 +1,106 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// storage whose files fail once limit bytes are written to them
+type failingWrites struct {
+	storage.Storage
+	limit int64
+}
+
+type failWriter struct {
+	storage.Writer
+	limit   int64
+	written int64
+}
+
+func (s *failingWrites) Create(name string) (storage.Writer, error) {
+	w, err := s.Storage.Create(name)
+	return &failWriter{Writer: w, limit: s.limit}, err
+}
+
+func (s *failingWrites) Append(name string) (storage.Writer, error) {
+	w, err := s.Storage.Append(name)
+	return &failWriter{Writer: w, limit: s.limit}, err
+}
+
+func (w *failWriter) Write(p []byte) (n int, err error) {
+	if w.written+int64(len(p)) > w.limit {
+		n, _ = w.Writer.Write(p[:w.limit-w.written])
+		w.written += int64(n)
+		err = errors.New("no space left on device")
+		return
+	}
+	n, err = w.Writer.Write(p)
+	w.written += int64(n)
+	return
+}
+
+// failed write stops the export even with skip policy, set is cleaned
+// back to last finished project and failure is in ledger
+func TestWriteErrorStopsExport(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSet(t, dir, []testSegment{{"mgp1", "mgm1.3", 1, 3}})
+	opts := NewOptions()
+	opts.Path = dir
+	opts.OnError = POLICY_SKIP
+	e := New(opts)
+	if err := e.openIndex(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Store.Close()
+	if err := e.loadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	local := e.FS
+	e.writer.Init(&failingWrites{Storage: local, limit: 20000}, 1, 1, e.Profile, e.Store, false)
+	e.writer.SetIndex(e.Files, e.Indexes, e.Meta)
+	go e.writer.WriterHandle(false, 0, 0)
+
+	run := newExportRun(e)
+	ledger, err := LoadFailureLedger(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.ledger = ledger
+	run.project = "mgp2"
+	rnd := rand.New(rand.NewSource(1))
+	seq := make([]byte, 300)
+	for n := 1; (err == nil) && (n <= 5000); n++ {
+		for i := range seq {
+			seq[i] = "ACGT"[rnd.Intn(4)]
+		}
+		rec := &file.Seq{ID: []byte(fmt.Sprintf("mgp2|mgm2.3|read_%d", n)), Seq: seq}
+		err = run.send(context.Background(), &Record{R: rec.Record(), P: "mgp2", M: "mgm2.3"})
+	}
+	werr, ok := err.(*WriteError)
+	if !ok || (werr.Op != OP_WRITE) {
+		t.Fatalf("export went on after failed write, got %v", err)
+	}
+
+	run.abort(&err)
+	run.rejects.Close()
+	run.report.Close()
+	if files := readTestSet(t, local); !reflect.DeepEqual(files, map[string][]string{"1.fasta.gz": {"mgp1|mgm1.3|read_1", "mgp1|mgm1.3|read_2", "mgp1|mgm1.3|read_3"}}) {
+		t.Errorf("files after failed write: %v", files)
+	}
+	if layout := testIndexLayout(e.Indexes); !reflect.DeepEqual(layout, []string{"mgp1 1:1-1:3"}) {
+		t.Errorf("index after failed write: %v", layout)
+	}
+	ledger, err = LoadFailureLedger(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(ledger.Failures) != 1) || (ledger.Failures[0].Kind != OP_WRITE) || (ledger.Failures[0].Project != "mgp2") {
+		t.Errorf("ledger after failed write: %+v", ledger.Failures)
+	}
+}
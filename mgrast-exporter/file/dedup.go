@@ -0,0 +1,144 @@
+package file
+
+import (
+	"fmt"
+	"math"
+)
+
+var DEDUP_MODES = []string{"exact", "revcomp"}
+var DEDUP_HASHES = 6
+
+var complement [256]byte
+
+func init() {
+	for i := range complement {
+		complement[i] = byte(i)
+	}
+	pairs := []string{"AT", "TA", "UA", "CG", "GC", "RY", "YR", "KM", "MK", "BV", "VB", "DH", "HD"}
+	for _, p := range pairs {
+		complement[p[0]] = p[1]
+	}
+}
+
+// bloom filter of sequences seen, memory is fixed whatever the number of records.
+// a new sequence is taken for a duplicate at the false positive rate.
+// with RevComp a sequence and its reverse complement are the same.
+type Dedup struct {
+	RevComp bool
+	bits    []uint64
+	size    uint64
+	set     uint64
+}
+
+// memory in MB
+func NewDedup(mode string, memory int) (d *Dedup, err error) {
+	if (mode != "exact") && (mode != "revcomp") {
+		err = fmt.Errorf("unknown dedup mode %s, must be one of: %v", mode, DEDUP_MODES)
+		return
+	}
+	if memory < 1 {
+		err = fmt.Errorf("dedup memory must be at least 1 MB")
+		return
+	}
+	words := memory * 1024 * 1024 / 8
+	d = &Dedup{
+		RevComp: mode == "revcomp",
+		bits:    make([]uint64, words),
+		size:    uint64(words) * 64,
+	}
+	return
+}
+
+// add sequence, true if it was probably seen before
+func (d *Dedup) Seen(seq []byte) bool {
+	h := seqHash(seq, false)
+	if d.RevComp {
+		if hr := seqHash(seq, true); hr < h {
+			h = hr
+		}
+	}
+	return d.add(h)
+}
+
+// add read pair, true if it was probably seen before. with RevComp the
+// pair read from the other strand, its mates swapped, is the same.
+func (d *Dedup) SeenPair(r1 []byte, r2 []byte) bool {
+	h := pairHash(r1, r2)
+	if d.RevComp {
+		if hs := pairHash(r2, r1); hs < h {
+			h = hs
+		}
+	}
+	return d.add(h)
+}
+
+func (d *Dedup) add(h1 uint64) bool {
+	h2 := mix64(h1) | 1
+	seen := true
+	for i := 0; i < DEDUP_HASHES; i++ {
+		bit := (h1 + uint64(i)*h2) % d.size
+		w, m := bit/64, uint64(1)<<(bit%64)
+		if d.bits[w]&m == 0 {
+			seen = false
+			d.bits[w] |= m
+			d.set += 1
+		}
+	}
+	return seen
+}
+
+// chance a new sequence is taken for a duplicate at current fill
+func (d *Dedup) FalsePositiveRate() float64 {
+	return math.Pow(float64(d.set)/float64(d.size), float64(DEDUP_HASHES))
+}
+
+// empty filter of same mode and size
+func (d *Dedup) New() *Dedup {
+	return &Dedup{RevComp: d.RevComp, bits: make([]uint64, len(d.bits)), size: d.size}
+}
+
+// forget all sequences
+func (d *Dedup) Reset() {
+	if d.set == 0 {
+		return
+	}
+	for i := range d.bits {
+		d.bits[i] = 0
+	}
+	d.set = 0
+}
+
+// fnv-1a of uppercase sequence without whitespace, or of its reverse complement
+func seqHash(seq []byte, revcomp bool) uint64 {
+	return appendHash(14695981039346656037, seq, revcomp)
+}
+
+// fnv-1a of mates in order, with a separator no sequence byte hashes to
+func pairHash(r1 []byte, r2 []byte) uint64 {
+	h := appendHash(14695981039346656037, r1, false)
+	h ^= uint64('\n')
+	h *= 1099511628211
+	return appendHash(h, r2, false)
+}
+
+func appendHash(h uint64, seq []byte, revcomp bool) uint64 {
+	n := len(seq)
+	for i := 0; i < n; i++ {
+		c := seq[i]
+		if revcomp {
+			c = seq[n-1-i]
+		}
+		if c <= ' ' {
+			continue
+		}
+		if (c >= 'a') && (c <= 'z') {
+			c -= 'a' - 'A'
+		}
+		if revcomp {
+			c = complement[c]
+		}
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,94 @@
+package file
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func randomSeq(rnd *rand.Rand, n int) []byte {
+	seq := make([]byte, n)
+	for i := range seq {
+		seq[i] = "ACGT"[rnd.Intn(4)]
+	}
+	return seq
+}
+
+// new sequences are taken for duplicates at about the reported rate,
+// sequences added are always found again
+func TestDedupFalsePositiveRate(t *testing.T) {
+	d, err := NewDedup("exact", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	var added [][]byte
+	for i := 0; i < 1000000; i++ {
+		seq := randomSeq(rnd, 50)
+		d.Seen(seq)
+		if i%1000 == 0 {
+			added = append(added, seq)
+		}
+	}
+	for _, seq := range added {
+		if !d.Seen(seq) {
+			t.Fatalf("added sequence %s not found", seq)
+		}
+	}
+	before := d.FalsePositiveRate()
+	queries := 20000
+	falseDups := 0
+	for i := 0; i < queries; i++ {
+		if d.Seen(randomSeq(rnd, 60)) {
+			falseDups += 1
+		}
+	}
+	after := d.FalsePositiveRate()
+	rate := float64(falseDups) / float64(queries)
+	if (rate < 0.7*before) || (rate > 1.3*after) {
+		t.Errorf("false duplicate rate %f, reported %f to %f", rate, before, after)
+	}
+}
+
+func TestDedupRevComp(t *testing.T) {
+	tests := []struct {
+		name  string
+		first [2]string
+		next  [2]string
+		exact bool
+		rc    bool
+	}{
+		{name: "same", first: [2]string{"ACGGT"}, next: [2]string{"ACGGT"}, exact: true, rc: true},
+		{name: "case and whitespace", first: [2]string{"ACGGT"}, next: [2]string{"ac gg\nt"}, exact: true, rc: true},
+		{name: "reverse complement", first: [2]string{"AACGGT"}, next: [2]string{"ACCGTT"}, exact: false, rc: true},
+		{name: "other", first: [2]string{"AACGGT"}, next: [2]string{"AACGGA"}, exact: false, rc: false},
+		{name: "pair", first: [2]string{"AACGG", "TTGCA"}, next: [2]string{"aacgg", "TTGCA"}, exact: true, rc: true},
+		{name: "pair mates swapped", first: [2]string{"AACGG", "TTGCA"}, next: [2]string{"TTGCA", "AACGG"}, exact: false, rc: true},
+		{name: "pair joined reverse complement", first: [2]string{"AACGG", "TTGCA"}, next: [2]string{"TGCAA", "CCGTT"}, exact: false, rc: false},
+		{name: "pair split elsewhere", first: [2]string{"AACGG", "TTGCA"}, next: [2]string{"AACG", "GTTGCA"}, exact: false, rc: false},
+		{name: "pair and joined read", first: [2]string{"AACGG", "TTGCA"}, next: [2]string{"AACGGTTGCA"}, exact: false, rc: false},
+	}
+	for _, tt := range tests {
+		for _, mode := range DEDUP_MODES {
+			d, err := NewDedup(mode, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := func(s [2]string) bool {
+				if s[1] == "" {
+					return d.Seen([]byte(s[0]))
+				}
+				return d.SeenPair([]byte(s[0]), []byte(s[1]))
+			}
+			if seen(tt.first) {
+				t.Errorf("%s, %s: first sequence seen before", tt.name, mode)
+			}
+			expected := tt.exact
+			if d.RevComp {
+				expected = tt.rc
+			}
+			if got := seen(tt.next); got != expected {
+				t.Errorf("%s, %s: duplicate %v, expected %v", tt.name, mode, got, expected)
+			}
+		}
+	}
+}
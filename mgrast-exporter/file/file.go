@@ -6,9 +6,9 @@ import (
 	"compress/gzip"
 	"errors"
 	"io"
-	"strings"
 )
 
+// suffix of nucleotide export files with default profile, see FileSuffix
 var FILE_SUFFIX = ".fasta.gz"
 
 type Seq struct {
@@ -17,13 +17,55 @@ type Seq struct {
 }
 
 func (s *Seq) Record() []byte {
-	return append(append(append(append([]byte{'>'}, s.ID...), []byte{'\n'}...), bytes.ToUpper(s.Seq)...), []byte{'\n'}...)
+	return s.WrappedRecord(0)
 }
 
+// sequence uppercased and split into lines of width, 0 for single line
+// always returns a new slice, safe to keep after the next Read
+func (s *Seq) WrappedRecord(width int) []byte {
+	if (width <= 0) || (width > len(s.Seq)) {
+		width = len(s.Seq)
+	}
+	lines := 1
+	if width > 0 {
+		lines = (len(s.Seq) + width - 1) / width
+	}
+	rec := make([]byte, 0, len(s.ID)+len(s.Seq)+lines+2)
+	rec = append(append(append(rec, '>'), s.ID...), '\n')
+	for start := 0; start < len(s.Seq); start += width {
+		end := start + width
+		if end > len(s.Seq) {
+			end = len(s.Seq)
+		}
+		for _, c := range s.Seq[start:end] {
+			if 'a' <= c && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			rec = append(rec, c)
+		}
+		rec = append(rec, '\n')
+	}
+	if len(s.Seq) == 0 {
+		rec = append(rec, '\n')
+	}
+	return rec
+}
+
+var READ_BUFFER_SIZE = 1024 * 1024
+
+// streaming fasta parser, buffers are reused between calls
+// a record starts only at a line beginning with '>', so '>' inside headers is kept
 type Reader struct {
-	f io.Reader
-	r *bufio.Reader
-	c bool
+	f    io.Reader
+	r    *bufio.Reader
+	c    bool
+	seq  Seq
+	id   []byte
+	next []byte
+	body []byte
+	line []byte
+	have bool
+	done bool
 }
 
 func NewReader(f io.Reader, c bool) *Reader {
@@ -34,108 +76,158 @@ func NewReader(f io.Reader, c bool) *Reader {
 	}
 }
 
+// threads > 1 compresses in parallel as independent gzip members
+// nil profile uses the default, profile without codec writes plain text
 type Writer struct {
-	f io.Writer
-	w *gzip.Writer
+	f    io.Writer
+	w    *gzip.Writer
+	p    *parallelWriter
+	t    int
+	prof *Profile
 }
 
-func NewWriter(f io.Writer) *Writer {
+func NewWriter(f io.Writer, threads int, prof *Profile) *Writer {
+	if prof == nil {
+		prof = Profiles[DEFAULT_PROFILE]
+	}
 	return &Writer{
-		f: f,
-		w: nil,
+		f:    f,
+		w:    nil,
+		p:    nil,
+		t:    threads,
+		prof: prof,
 	}
 }
 
 func (self *Writer) Write(body []byte) (err error) {
+	if !self.prof.Compressed() {
+		_, err = self.f.Write(body)
+		return
+	}
+	if self.t > 1 {
+		if self.p == nil {
+			self.p = newParallelWriter(self.f, self.t, self.prof.BlockSize, self.prof.Level)
+		}
+		err = self.p.Write(body)
+		return
+	}
 	if self.w == nil {
-		self.w = gzip.NewWriter(self.f)
+		self.w, err = gzip.NewWriterLevel(self.f, self.prof.Level)
+		if err != nil {
+			return
+		}
 	}
 	_, err = self.w.Write(body)
 	return
 }
 
-func (self *Writer) Close() {
+func (self *Writer) Close() (err error) {
+	if self.p != nil {
+		err = self.p.Close()
+	}
 	if self.w != nil {
-		self.w.Close()
+		err = self.w.Close()
 	}
+	return
 }
 
+// returns next record, or nil and io.EOF when input is done
+// returned Seq and its slices are only valid until the next call to Read
 func (self *Reader) Read() (seq *Seq, err error) {
 	if self.r == nil {
-		if self.c {
-			gread, gerr := gzip.NewReader(self.f)
+		self.r = bufio.NewReaderSize(self.f, READ_BUFFER_SIZE)
+		// compressed input may also be plain text, known by missing gzip magic
+		if magic, _ := self.r.Peek(2); self.c && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			gread, gerr := gzip.NewReader(self.r)
 			if gerr != nil {
 				err = gerr
 				return
 			}
-			self.r = bufio.NewReader(gread)
-		} else {
-			self.r = bufio.NewReader(self.f)
+			self.r = bufio.NewReaderSize(gread, READ_BUFFER_SIZE)
 		}
 	}
-	var prev, read, label, body []byte
-	var eof bool
-	for {
-		read, err = self.r.ReadBytes('>')
-		// non eof error
+	if self.done {
+		err = io.EOF
+		return
+	}
+	// find first header, only blank lines may come before it
+	for !self.have {
+		var line []byte
+		line, err = self.readLine()
 		if err != nil {
 			if err == io.EOF {
-				eof = true
-			} else {
-				return
+				self.done = true
 			}
+			return
 		}
-		if len(prev) > 0 {
-			read = append(prev, read...)
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '>' {
+			err = errors.New("Invalid fasta entry")
+			return
 		}
-		// only have '>'
-		if len(read) == 1 {
-			if eof {
-				break
-			} else {
-				continue
+		self.next = append(self.next[:0], line[1:]...)
+		self.have = true
+	}
+	// header read on last call becomes current
+	self.id, self.next = self.next, self.id
+	self.have = false
+	self.body = self.body[:0]
+	for {
+		line, rerr := self.readLine()
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+				return
 			}
+			self.done = true
+			break
 		}
-		// found an embedded '>'
-		if !bytes.Contains(read, []byte{'\n'}) {
-			prev = read
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
 			continue
 		}
-		// process lines
-		read = bytes.TrimSpace(bytes.TrimRight(read, ">"))
-		lines := bytes.Split(read, []byte{'\n'})
-		label = lines[0]
-		if len(lines) > 1 {
-			body = bytes.Join(lines[1:], []byte{})
+		if line[0] == '>' {
+			self.next = append(self.next[:0], line[1:]...)
+			self.have = true
+			break
 		}
-		break
+		self.body = append(self.body, line...)
 	}
-	if len(label) > 0 {
-		seq = &Seq{ID: label, Seq: body}
-	} else {
+	if len(bytes.TrimSpace(self.id)) == 0 {
 		err = errors.New("Invalid fasta entry")
+		return
 	}
-	if eof {
-		err = io.EOF
-	}
+	self.seq.ID = bytes.TrimSpace(self.id)
+	self.seq.Seq = self.body
+	seq = &self.seq
 	return
 }
 
-func ParseHeader(h string) (p string, m string, e error) {
-	parts := strings.Split(h, "|")
-	if len(parts) < 3 {
-		e = errors.New("Invalid sequence header for index")
+// full line including newline, valid until next call
+func (self *Reader) readLine() (line []byte, err error) {
+	line, err = self.r.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		if (err == io.EOF) && (len(line) > 0) {
+			err = nil
+		}
 		return
 	}
-	p = parts[0]
-	m = parts[1]
-	if !strings.HasPrefix(p, "mgp") {
-		e = errors.New("Invalid project ID in header")
-		return
+	// line longer than buffer, collect pieces
+	self.line = append(self.line[:0], line...)
+	for err == bufio.ErrBufferFull {
+		line, err = self.r.ReadSlice('\n')
+		self.line = append(self.line, line...)
 	}
-	if !strings.HasPrefix(m, "mgm") {
-		e = errors.New("Invalid metagenome ID in header")
-		return
+	if err == io.EOF {
+		err = nil
 	}
+	line = self.line
 	return
 }
+
+func ParseHeader(h string) (p string, m string, e error) {
+	return DefaultHeader.ParseHeader(h)
+}
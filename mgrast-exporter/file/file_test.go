@@ -0,0 +1,264 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func readAll(t *testing.T, input string, compressed bool) (records []Seq) {
+	var data []byte
+	if compressed {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write([]byte(input))
+		gw.Close()
+		data = buf.Bytes()
+	} else {
+		data = []byte(input)
+	}
+	r := NewReader(bytes.NewReader(data), compressed)
+	for {
+		seq, err := r.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("read: %s", err.Error())
+		}
+		// returned record is only valid until next Read
+		records = append(records, Seq{ID: append([]byte{}, seq.ID...), Seq: append([]byte{}, seq.Seq...)})
+	}
+}
+
+func checkRecords(t *testing.T, name string, got []Seq, want [][2]string) {
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d records, expected %d", name, len(got), len(want))
+	}
+	for i, w := range want {
+		if (string(got[i].ID) != w[0]) || (string(got[i].Seq) != w[1]) {
+			t.Errorf("%s: record %d is %q %q, expected %q %q", name, i, got[i].ID, got[i].Seq, w[0], w[1])
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  [][2]string
+	}{
+		{
+			name:  "wrapped",
+			input: ">r1 len=8\nACGT\nACGT\n>r2\nTTTT\n",
+			want:  [][2]string{{"r1 len=8", "ACGTACGT"}, {"r2", "TTTT"}},
+		},
+		{
+			name:  "header with '>'",
+			input: ">r1 a>b>c\nACGT\n>r2 >x\nGG\n",
+			want:  [][2]string{{"r1 a>b>c", "ACGT"}, {"r2 >x", "GG"}},
+		},
+		{
+			name:  "crlf",
+			input: ">r1\r\nAC\r\nGT\r\n>r2\r\nTT\r\n",
+			want:  [][2]string{{"r1", "ACGT"}, {"r2", "TT"}},
+		},
+		{
+			name:  "empty last record",
+			input: ">r1\nACGT\n>r2\n",
+			want:  [][2]string{{"r1", "ACGT"}, {"r2", ""}},
+		},
+		{
+			name:  "no final newline",
+			input: ">r1\nACGT\n>r2\nGG",
+			want:  [][2]string{{"r1", "ACGT"}, {"r2", "GG"}},
+		},
+		{
+			name:  "blank lines",
+			input: "\n\n>r1\nAC\n\nGT\n\n>r2\nTT\n\n",
+			want:  [][2]string{{"r1", "ACGT"}, {"r2", "TT"}},
+		},
+		{
+			name:  "empty input",
+			input: "",
+			want:  [][2]string{},
+		},
+	}
+	for _, tt := range tests {
+		checkRecords(t, tt.name, readAll(t, tt.input, false), tt.want)
+		checkRecords(t, tt.name+" gzip", readAll(t, tt.input, true), tt.want)
+	}
+}
+
+func TestReaderInvalid(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte("ACGT\n>r1\nACGT\n")), false)
+	if _, err := r.Read(); (err == nil) || (err == io.EOF) {
+		t.Errorf("expected error for sequence before first header, got %v", err)
+	}
+}
+
+func TestReaderBufferReuse(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte(">r1\nAAAA\n>r2\nCC\n")), false)
+	first, err := r.Read()
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+	firstSeq := first.Seq
+	second, err := r.Read()
+	if err != nil {
+		t.Fatalf("read: %s", err.Error())
+	}
+	if first != second {
+		t.Errorf("expected same Seq reused between calls")
+	}
+	if string(second.ID) != "r2" || string(second.Seq) != "CC" {
+		t.Errorf("second record is %q %q", second.ID, second.Seq)
+	}
+	// body buffer of first record was overwritten in place
+	if string(firstSeq[:2]) != "CC" {
+		t.Errorf("expected body buffer reused, first record still holds %q", firstSeq)
+	}
+}
+
+func TestReaderLongLine(t *testing.T) {
+	long := bytes.Repeat([]byte("ACGT"), READ_BUFFER_SIZE/2)
+	input := ">r1\n" + string(long) + "\n>r2\nGG\n"
+	checkRecords(t, "long line", readAll(t, input, false), [][2]string{{"r1", string(long)}, {"r2", "GG"}})
+}
+
+// parser before the line-based rewrite, kept for comparison
+type oldReader struct {
+	r *bufio.Reader
+}
+
+func (self *oldReader) Read() (seq *Seq, err error) {
+	var prev, read, label, body []byte
+	var eof bool
+	for {
+		read, err = self.r.ReadBytes('>')
+		if err != nil {
+			if err == io.EOF {
+				eof = true
+			} else {
+				return
+			}
+		}
+		if len(prev) > 0 {
+			read = append(prev, read...)
+		}
+		if len(read) == 1 {
+			if eof {
+				break
+			} else {
+				continue
+			}
+		}
+		if !bytes.Contains(read, []byte{'\n'}) {
+			prev = read
+			continue
+		}
+		read = bytes.TrimSpace(bytes.TrimRight(read, ">"))
+		lines := bytes.Split(read, []byte{'\n'})
+		label = lines[0]
+		if len(lines) > 1 {
+			body = bytes.Join(lines[1:], []byte{})
+		}
+		break
+	}
+	if len(label) > 0 {
+		seq = &Seq{ID: label, Seq: body}
+	} else {
+		err = errors.New("Invalid fasta entry")
+	}
+	if eof {
+		err = io.EOF
+	}
+	return
+}
+
+func benchInput(records int, width int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	seq := make([]byte, 0, 400)
+	for i := 0; i < records; i++ {
+		seq = seq[:0]
+		for n := 100 + rnd.Intn(300); n > 0; n-- {
+			seq = append(seq, "ACGT"[rnd.Intn(4)])
+		}
+		rec := &Seq{ID: []byte(fmt.Sprintf("mgp1|mgm1.3|read_%d len=%d", i, len(seq))), Seq: seq}
+		buf.Write(rec.WrappedRecord(width))
+	}
+	return buf.Bytes()
+}
+
+func gzipInput(data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(data)
+	gw.Close()
+	return buf.Bytes()
+}
+
+// old and new parser on single line and 60 column sequences, plain and
+// gzipped as downloaded from shock, with each record copied as the
+// exporter does. bytes are those of the uncompressed fasta.
+func BenchmarkReader(b *testing.B) {
+	unwrapped := benchInput(20000, 0)
+	wrapped := benchInput(20000, 60)
+	inputs := []struct {
+		name       string
+		data       []byte
+		size       int
+		compressed bool
+	}{
+		{"unwrapped", unwrapped, len(unwrapped), false},
+		{"wrapped", wrapped, len(wrapped), false},
+		{"gzip/unwrapped", gzipInput(unwrapped), len(unwrapped), true},
+		{"gzip/wrapped", gzipInput(wrapped), len(wrapped), true},
+	}
+	for _, in := range inputs {
+		b.Run("old/"+in.name, func(b *testing.B) {
+			b.SetBytes(int64(in.size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var src io.Reader = bytes.NewReader(in.data)
+				if in.compressed {
+					gr, err := gzip.NewReader(src)
+					if err != nil {
+						b.Fatal(err)
+					}
+					src = gr
+				}
+				r := &oldReader{r: bufio.NewReader(src)}
+				for {
+					seq, err := r.Read()
+					if seq != nil {
+						seq.Record()
+					}
+					if err != nil {
+						break
+					}
+				}
+			}
+		})
+		b.Run("new/"+in.name, func(b *testing.B) {
+			b.SetBytes(int64(in.size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r := NewReader(bytes.NewReader(in.data), in.compressed)
+				for {
+					seq, err := r.Read()
+					if err != nil {
+						break
+					}
+					seq.Record()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var DEFAULT_HEADER_TEMPLATE = "{project}|{metagenome}|{id}"
+
+var (
+	DefaultHeader, _ = NewHeaderFormat(DEFAULT_HEADER_TEMPLATE)
+	headerField      = regexp.MustCompile(`\{([a-z]+)\}`)
+)
+
+// available template fields, with pattern used when parsing back.
+// project and metagenome IDs have a fixed shape, so they parse back
+// without separators between fields or with the separator inside an ID.
+// metagenome IDs written as accessions have _ for the dot.
+var headerFields = map[string]string{
+	"project":    `(mgp[0-9]+)`,
+	"metagenome": `(mgm[0-9]+[._][0-9]+)`,
+	"id":         `(.*?)`,
+	"len":        `([0-9]+)`,
+}
+
+type HeaderFormat struct {
+	Template string
+	parse    *regexp.Regexp
+	groups   map[string]int
+	parts    []headerPart
+}
+
+// literal text followed by optional field name
+type headerPart struct {
+	text  string
+	field string
+}
+
+func NewHeaderFormat(template string) (hf *HeaderFormat, err error) {
+	hf = &HeaderFormat{
+		Template: template,
+		groups:   make(map[string]int),
+	}
+	pattern := "^"
+	last := 0
+	for n, loc := range headerField.FindAllStringSubmatchIndex(template, -1) {
+		name := template[loc[2]:loc[3]]
+		group, ok := headerFields[name]
+		if !ok {
+			err = fmt.Errorf("unknown header template field: {%s}", name)
+			return
+		}
+		if _, ok := hf.groups[name]; ok {
+			err = fmt.Errorf("duplicate header template field: {%s}", name)
+			return
+		}
+		hf.groups[name] = n + 1
+		hf.parts = append(hf.parts, headerPart{text: template[last:loc[0]], field: name})
+		pattern += regexp.QuoteMeta(template[last:loc[0]]) + group
+		last = loc[1]
+	}
+	hf.parts = append(hf.parts, headerPart{text: template[last:]})
+	pattern += regexp.QuoteMeta(template[last:]) + "$"
+	if _, ok := hf.groups["project"]; !ok {
+		err = errors.New("header template requires {project}")
+		return
+	}
+	if _, ok := hf.groups["metagenome"]; !ok {
+		err = errors.New("header template requires {metagenome}")
+		return
+	}
+	if strings.ContainsAny(template, ">\n") {
+		err = errors.New("header template contains invalid character")
+		return
+	}
+	hf.parse, err = regexp.Compile(pattern)
+	return
+}
+
+func (hf *HeaderFormat) Format(p string, m string, s *Seq) []byte {
+	return hf.AppendFormat(make([]byte, 0, len(hf.Template)+len(p)+len(m)+len(s.ID)), p, m, s)
+}
+
+func (hf *HeaderFormat) AppendFormat(h []byte, p string, m string, s *Seq) []byte {
+	for _, part := range hf.parts {
+		h = append(h, part.text...)
+		switch part.field {
+		case "project":
+			h = append(h, p...)
+		case "metagenome":
+			h = append(h, m...)
+		case "id":
+			h = append(h, s.ID...)
+		case "len":
+			h = strconv.AppendInt(h, int64(len(s.Seq)), 10)
+		}
+	}
+	return h
+}
+
+func (hf *HeaderFormat) ParseHeader(h string) (p string, m string, e error) {
+	parts := hf.parse.FindStringSubmatch(h)
+	if parts == nil {
+		e = errors.New("Invalid sequence header for index")
+		return
+	}
+	p = parts[hf.groups["project"]]
+	m = strings.Replace(parts[hf.groups["metagenome"]], "_", ".", 1)
+	return
+}
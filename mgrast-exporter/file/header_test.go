@@ -0,0 +1,71 @@
+package file
+
+import (
+	"testing"
+)
+
+// headers of each template parse back to the IDs they were formatted with
+func TestHeaderFormatParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		project  string
+		mg       string
+		id       string
+		want     string
+		parsed   string
+	}{
+		{name: "default", template: DEFAULT_HEADER_TEMPLATE, project: "mgp1", mg: "mgm1.3", id: "read_1", want: "mgp1|mgm1.3|read_1"},
+		{name: "id with separator", template: DEFAULT_HEADER_TEMPLATE, project: "mgp1", mg: "mgm1.3", id: "read|1", want: "mgp1|mgm1.3|read|1"},
+		{name: "blastdb", template: "{project}_{metagenome}_{id}", project: "mgp12", mg: "mgm4447943.3", id: "7", want: "mgp12_mgm4447943.3_7"},
+		{name: "accession", template: "{project}_{metagenome}_{id}", project: "mgp12", mg: "mgm4447943_3", id: "7", want: "mgp12_mgm4447943_3_7", parsed: "mgm4447943.3"},
+		{name: "separator in metagenome ID", template: "{project}.{metagenome}.{id}", project: "mgp1", mg: "mgm1.3", id: "read.1", want: "mgp1.mgm1.3.read.1"},
+		{name: "no separator", template: "{project}{metagenome}{id}", project: "mgp12", mg: "mgm1.3", id: "read_1", want: "mgp12mgm1.3read_1"},
+		{name: "no separator, metagenome first", template: "{metagenome}{project}", project: "mgp3", mg: "mgm20.3", want: "mgm20.3mgp3"},
+		{name: "id first with length", template: "{id} {project}:{metagenome} len={len}", project: "mgp1", mg: "mgm1.3", id: "read 1", want: "read 1 mgp1:mgm1.3 len=4"},
+	}
+	for _, tt := range tests {
+		hf, err := NewHeaderFormat(tt.template)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+			continue
+		}
+		h := hf.Format(tt.project, tt.mg, &Seq{ID: []byte(tt.id), Seq: []byte("ACGT")})
+		if string(h) != tt.want {
+			t.Errorf("%s: formatted %q, expected %q", tt.name, h, tt.want)
+			continue
+		}
+		p, m, err := hf.ParseHeader(string(h))
+		if err != nil {
+			t.Errorf("%s: parse %q: %s", tt.name, h, err.Error())
+			continue
+		}
+		mg := tt.mg
+		if tt.parsed != "" {
+			mg = tt.parsed
+		}
+		if (p != tt.project) || (m != mg) {
+			t.Errorf("%s: parsed %q as %s %s, expected %s %s", tt.name, h, p, m, tt.project, mg)
+		}
+	}
+}
+
+func TestHeaderFormatInvalid(t *testing.T) {
+	templates := []string{
+		"{metagenome}|{id}",
+		"{project}|{id}",
+		"{project}|{metagenome}|{name}",
+		"{project}|{metagenome}|{id}|{id}",
+		"{project}>{metagenome}",
+	}
+	for _, template := range templates {
+		if _, err := NewHeaderFormat(template); err == nil {
+			t.Errorf("template %q accepted", template)
+		}
+	}
+	for _, h := range []string{"mgp1|mgm1.3", "mgm1.3|mgp1|read_1", "xyz1|mgm1.3|read_1", "mgp1|mgm1|read_1"} {
+		if _, _, err := DefaultHeader.ParseHeader(h); err == nil {
+			t.Errorf("header %q parsed", h)
+		}
+	}
+}
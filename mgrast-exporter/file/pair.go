@@ -0,0 +1,41 @@
+package file
+
+import (
+	"bytes"
+)
+
+// key shared by both mates of a read and its mate number, 0 if the ID has no
+// mate. mates are marked by a /1 or /2 suffix of the first word, or by a
+// second word starting with 1: or 2: (casava 1.8).
+func MateID(id []byte) (key []byte, mate int) {
+	key = id
+	desc := []byte(nil)
+	if n := bytes.IndexAny(id, " \t"); n != -1 {
+		key = id[:n]
+		desc = bytes.TrimLeft(id[n:], " \t")
+	}
+	if l := len(key); (l > 2) && (key[l-2] == '/') && ((key[l-1] == '1') || (key[l-1] == '2')) {
+		mate = int(key[l-1] - '0')
+		key = key[:l-2]
+		return
+	}
+	if (len(desc) > 1) && (desc[1] == ':') && ((desc[0] == '1') || (desc[0] == '2')) {
+		mate = int(desc[0] - '0')
+	}
+	return
+}
+
+// ID of mate as exported, key/mate followed by any description of id
+func AppendMateID(dst []byte, id []byte, mate int) []byte {
+	key, _ := MateID(id)
+	dst = append(append(dst, key...), '/', byte('0'+mate))
+	if n := bytes.IndexAny(id, " \t"); n != -1 {
+		dst = append(dst, id[n:]...)
+	}
+	return dst
+}
+
+// copy of record, safe to keep after the next Read
+func (s *Seq) Copy() *Seq {
+	return &Seq{ID: append([]byte(nil), s.ID...), Seq: append([]byte(nil), s.Seq...)}
+}
@@ -0,0 +1,135 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// one independently compressed gzip member
+type gzBlock struct {
+	in   []byte
+	out  bytes.Buffer
+	err  error
+	done chan bool
+}
+
+// pigz style writer, input is cut into blocks that are compressed on
+// separate goroutines and written out in order as a multi-member gzip
+type parallelWriter struct {
+	f       io.Writer
+	size    int
+	level   int
+	block   []byte
+	sem     chan bool
+	queue   chan *gzBlock
+	written chan bool
+	gzPool  sync.Pool
+	lock    sync.Mutex
+	err     error
+}
+
+func newParallelWriter(f io.Writer, threads int, size int, level int) *parallelWriter {
+	p := &parallelWriter{
+		f:       f,
+		size:    size,
+		level:   level,
+		block:   make([]byte, 0, size),
+		sem:     make(chan bool, threads),
+		queue:   make(chan *gzBlock, threads),
+		written: make(chan bool, 1),
+	}
+	go p.writeHandle()
+	return p
+}
+
+func (p *parallelWriter) Write(body []byte) (err error) {
+	if err = p.getErr(); err != nil {
+		return
+	}
+	for len(body) > 0 {
+		n := p.size - len(p.block)
+		if n > len(body) {
+			n = len(body)
+		}
+		p.block = append(p.block, body[:n]...)
+		body = body[n:]
+		if len(p.block) >= p.size {
+			p.flush()
+		}
+	}
+	return
+}
+
+func (p *parallelWriter) Close() (err error) {
+	if len(p.block) > 0 {
+		p.flush()
+	}
+	close(p.queue)
+	<-p.written
+	err = p.getErr()
+	return
+}
+
+// hand current block to a compress goroutine, queue keeps output order
+func (p *parallelWriter) flush() {
+	blk := &gzBlock{
+		in:   p.block,
+		done: make(chan bool, 1),
+	}
+	p.block = make([]byte, 0, p.size)
+	p.sem <- true
+	go p.compress(blk)
+	p.queue <- blk
+}
+
+func (p *parallelWriter) compress(blk *gzBlock) {
+	gw, ok := p.gzPool.Get().(*gzip.Writer)
+	if ok {
+		gw.Reset(&blk.out)
+	} else {
+		gw, blk.err = gzip.NewWriterLevel(&blk.out, p.level)
+		if blk.err != nil {
+			<-p.sem
+			blk.done <- true
+			return
+		}
+	}
+	_, blk.err = gw.Write(blk.in)
+	if cerr := gw.Close(); blk.err == nil {
+		blk.err = cerr
+	}
+	p.gzPool.Put(gw)
+	blk.in = nil
+	<-p.sem
+	blk.done <- true
+}
+
+func (p *parallelWriter) writeHandle() {
+	for blk := range p.queue {
+		<-blk.done
+		if p.getErr() != nil {
+			continue
+		}
+		if blk.err == nil {
+			_, blk.err = p.f.Write(blk.out.Bytes())
+		}
+		if blk.err != nil {
+			p.setErr(blk.err)
+		}
+	}
+	p.written <- true
+}
+
+func (p *parallelWriter) getErr() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+func (p *parallelWriter) setErr(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.err = err
+}
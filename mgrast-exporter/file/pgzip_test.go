@@ -0,0 +1,147 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// gzip members of data in order, each read on its own
+func gzipMembers(t *testing.T, data []byte) (members [][]byte) {
+	src := bytes.NewReader(data)
+	gr, err := gzip.NewReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		gr.Multistream(false)
+		member, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, member)
+		if err = gr.Reset(src); err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// blocks compressed on several threads come out as members in write order
+func TestParallelWriter(t *testing.T) {
+	input := benchInput(2000, 60)
+	size := 4096
+	for _, threads := range []int{2, 4, 8} {
+		var out bytes.Buffer
+		w := newParallelWriter(&out, threads, size, gzip.DefaultCompression)
+		// writes smaller and larger than a block
+		for pos, n := 0, 0; pos < len(input); pos += n {
+			n = 1000 + (pos % 7000)
+			if pos+n > len(input) {
+				n = len(input) - pos
+			}
+			if err := w.Write(input[pos : pos+n]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data := out.Bytes()
+
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, input) {
+			t.Errorf("%d threads: compress/gzip read %d bytes, expected %d", threads, len(plain), len(input))
+		}
+
+		members := gzipMembers(t, data)
+		if expected := (len(input) + size - 1) / size; len(members) != expected {
+			t.Errorf("%d threads: %d members, expected %d", threads, len(members), expected)
+		}
+		for n, member := range members {
+			end := (n + 1) * size
+			if end > len(input) {
+				end = len(input)
+			}
+			if !bytes.Equal(member, input[n*size:end]) {
+				t.Errorf("%d threads: member %d out of order", threads, n)
+				break
+			}
+		}
+
+		r := NewReader(bytes.NewReader(data), true)
+		var records []byte
+		for {
+			seq, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, seq.WrappedRecord(60)...)
+		}
+		if !bytes.Equal(records, input) {
+			t.Errorf("%d threads: reader records differ from input", threads)
+		}
+	}
+}
+
+// output failing after limit bytes
+type limitWriter struct {
+	limit   int
+	written int
+}
+
+func (w *limitWriter) Write(p []byte) (n int, err error) {
+	if w.written+len(p) > w.limit {
+		err = errors.New("no space left on device")
+		return
+	}
+	w.written += len(p)
+	n = len(p)
+	return
+}
+
+// errors of output and of compress goroutines come back from Write or Close
+func TestParallelWriterError(t *testing.T) {
+	input := benchInput(2000, 60)
+	tests := []struct {
+		name  string
+		out   io.Writer
+		level int
+		want  string
+	}{
+		{name: "output", out: &limitWriter{limit: 10000}, level: gzip.DefaultCompression, want: "no space left on device"},
+		{name: "compress", out: ioutil.Discard, level: 42, want: "gzip: invalid compression level: 42"},
+	}
+	for _, tt := range tests {
+		w := newParallelWriter(tt.out, 4, 4096, tt.level)
+		var err error
+		for pos := 0; (err == nil) && (pos < len(input)); pos += 1000 {
+			end := pos + 1000
+			if end > len(input) {
+				end = len(input)
+			}
+			err = w.Write(input[pos:end])
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if (err == nil) || (err.Error() != tt.want) {
+			t.Errorf("%s: got error %v, expected %s", tt.name, err, tt.want)
+		}
+	}
+}
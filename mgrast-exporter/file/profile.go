@@ -0,0 +1,52 @@
+package file
+
+import (
+	"compress/gzip"
+	"fmt"
+	"sort"
+)
+
+var DEFAULT_PROFILE = "balanced"
+
+// how export files are compressed, stored in index metadata
+type Profile struct {
+	Name      string `json:"name"`
+	Codec     string `json:"codec"`
+	Level     int    `json:"level"`
+	BlockSize int    `json:"block_size"`
+}
+
+var Profiles = map[string]*Profile{
+	"archival": &Profile{Name: "archival", Codec: "gzip", Level: gzip.BestCompression, BlockSize: 4 * 1024 * 1024},
+	"balanced": &Profile{Name: "balanced", Codec: "gzip", Level: gzip.DefaultCompression, BlockSize: 1024 * 1024},
+	"fast":     &Profile{Name: "fast", Codec: "gzip", Level: gzip.BestSpeed, BlockSize: 512 * 1024},
+	"none":     &Profile{Name: "none", Codec: "none", Level: 0, BlockSize: 0},
+}
+
+func GetProfile(name string) (p *Profile, err error) {
+	p, ok := Profiles[name]
+	if !ok {
+		err = fmt.Errorf("unknown compression profile %s, must be one of: %v", name, ProfileNames())
+	}
+	return
+}
+
+func ProfileNames() (names []string) {
+	for n := range Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return
+}
+
+func (p *Profile) Compressed() bool {
+	return p.Codec != "none"
+}
+
+func (p *Profile) Equal(o *Profile) bool {
+	return (p.Codec == o.Codec) && (p.Level == o.Level) && (p.BlockSize == o.BlockSize)
+}
+
+func (p *Profile) String() string {
+	return fmt.Sprintf("%s (codec=%s, level=%d, block_size=%d)", p.Name, p.Codec, p.Level, p.BlockSize)
+}
@@ -0,0 +1,122 @@
+package file
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// subsampling settings, stored in index metadata of sampled export sets
+type Sampling struct {
+	Fraction float64 `json:"fraction,omitempty"`
+	MaxReads int     `json:"max_reads_per_metagenome,omitempty"`
+	Seed     int64   `json:"seed"`
+}
+
+func (s *Sampling) Equal(o *Sampling) bool {
+	return (s.Fraction == o.Fraction) && (s.MaxReads == o.MaxReads) && (s.Seed == o.Seed)
+}
+
+func (s *Sampling) String() string {
+	return fmt.Sprintf("fraction=%g, max_reads_per_metagenome=%d, seed=%d", s.Fraction, s.MaxReads, s.Seed)
+}
+
+// hash based sampling of a metagenome's records. a record is kept by its score,
+// hash of seed, metagenome and record ID, so the same seed keeps the same records
+// in any order. with MaxReads only the lowest scoring records are held, and
+// released in input order once the metagenome is done.
+type Sampler struct {
+	Sampling
+	threshold uint64
+	kept      sampleHeap
+	pos       int
+}
+
+func NewSampler(s *Sampling) *Sampler {
+	sm := &Sampler{Sampling: *s, threshold: math.MaxUint64}
+	if (s.Fraction > 0) && (s.Fraction < 1) {
+		sm.threshold = uint64(s.Fraction * math.MaxUint64)
+	}
+	return sm
+}
+
+// start next metagenome, held records are dropped
+func (sm *Sampler) Reset() {
+	sm.kept = sm.kept[:0]
+	sm.pos = 0
+}
+
+// record passes fraction, its score is used by Hold
+func (sm *Sampler) Keep(mg string, id []byte) (keep bool, score uint64) {
+	h := fnv.New64a()
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], uint64(sm.Seed))
+	h.Write(seed[:])
+	h.Write([]byte(mg))
+	h.Write([]byte{0})
+	h.Write(id)
+	score = mix64(h.Sum64())
+	keep = score <= sm.threshold
+	return
+}
+
+// true if records must be held till metagenome is done
+func (sm *Sampler) Holds() bool {
+	return sm.MaxReads > 0
+}
+
+// hold record if among MaxReads lowest scores so far, rec is not copied
+func (sm *Sampler) Hold(score uint64, rec []byte) {
+	sm.pos += 1
+	if len(sm.kept) < sm.MaxReads {
+		heap.Push(&sm.kept, &sampleItem{score: score, pos: sm.pos, rec: rec})
+		return
+	}
+	if score < sm.kept[0].score {
+		sm.kept[0] = &sampleItem{score: score, pos: sm.pos, rec: rec}
+		heap.Fix(&sm.kept, 0)
+	}
+}
+
+// held records in input order, sampler is reset
+func (sm *Sampler) Release() (recs [][]byte) {
+	sort.Slice(sm.kept, func(i, j int) bool { return sm.kept[i].pos < sm.kept[j].pos })
+	for _, item := range sm.kept {
+		recs = append(recs, item.rec)
+	}
+	sm.Reset()
+	return
+}
+
+// splitmix64 finalizer, spreads fnv output over full range
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+type sampleItem struct {
+	score uint64
+	pos   int
+	rec   []byte
+}
+
+// max heap on score, root is first to be replaced
+type sampleHeap []*sampleItem
+
+func (h sampleHeap) Len() int            { return len(h) }
+func (h sampleHeap) Less(i, j int) bool  { return h[i].score > h[j].score }
+func (h sampleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sampleHeap) Push(x interface{}) { *h = append(*h, x.(*sampleItem)) }
+func (h *sampleHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
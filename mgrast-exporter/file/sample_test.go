@@ -0,0 +1,119 @@
+package file
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func sampleIDs(n int) (ids [][]byte) {
+	for i := 1; i <= n; i++ {
+		ids = append(ids, []byte(fmt.Sprintf("mgp1|mgm1.3|read_%d", i)))
+	}
+	return
+}
+
+// records kept by fraction, sorted
+func sampleFraction(s *Sampling, ids [][]byte) (kept []string) {
+	sm := NewSampler(s)
+	for _, id := range ids {
+		if keep, _ := sm.Keep("mgm1.3", id); keep {
+			kept = append(kept, string(id))
+		}
+	}
+	sort.Strings(kept)
+	return
+}
+
+// records held with MaxReads, in released order
+func sampleMax(s *Sampling, ids [][]byte) (kept []string) {
+	sm := NewSampler(s)
+	for _, id := range ids {
+		if keep, score := sm.Keep("mgm1.3", id); keep {
+			sm.Hold(score, id)
+		}
+	}
+	for _, rec := range sm.Release() {
+		kept = append(kept, string(rec))
+	}
+	return
+}
+
+func shuffled(ids [][]byte, seed int64) [][]byte {
+	out := append([][]byte{}, ids...)
+	rand.New(rand.NewSource(seed)).Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out
+}
+
+func TestSamplerFraction(t *testing.T) {
+	ids := sampleIDs(2000)
+	s := &Sampling{Fraction: 0.25, Seed: 7}
+	kept := sampleFraction(s, ids)
+	if (len(kept) < 400) || (len(kept) > 600) {
+		t.Errorf("fraction 0.25 kept %d of %d records", len(kept), len(ids))
+	}
+	for n := int64(1); n <= 3; n++ {
+		if again := sampleFraction(s, shuffled(ids, n)); !reflect.DeepEqual(again, kept) {
+			t.Errorf("same seed kept other records in shuffled order %d", n)
+		}
+	}
+	if other := sampleFraction(&Sampling{Fraction: 0.25, Seed: 8}, ids); reflect.DeepEqual(other, kept) {
+		t.Errorf("other seed kept same records")
+	}
+	// full fraction keeps everything
+	if all := sampleFraction(&Sampling{Fraction: 1, Seed: 7}, ids); len(all) != len(ids) {
+		t.Errorf("fraction 1 kept %d of %d records", len(all), len(ids))
+	}
+}
+
+func TestSamplerMaxReads(t *testing.T) {
+	ids := sampleIDs(500)
+	for _, s := range []*Sampling{{MaxReads: 10, Seed: 3}, {Fraction: 0.5, MaxReads: 10, Seed: 3}, {MaxReads: 1000, Seed: 3}} {
+		name := s.String()
+		kept := sampleMax(s, ids)
+		want := s.MaxReads
+		if want > len(ids) {
+			want = len(ids)
+		}
+		if len(kept) != want {
+			t.Errorf("%s: kept %d records, expected %d", name, len(kept), want)
+		}
+		// released in input order
+		pos := make(map[string]int)
+		for n, id := range ids {
+			pos[string(id)] = n
+		}
+		for n := 1; n < len(kept); n++ {
+			if pos[kept[n]] <= pos[kept[n-1]] {
+				t.Errorf("%s: %s released after %s", name, kept[n], kept[n-1])
+			}
+		}
+		// same records in any input order
+		sorted := append([]string{}, kept...)
+		sort.Strings(sorted)
+		for n := int64(1); n <= 3; n++ {
+			again := sampleMax(s, shuffled(ids, n))
+			sort.Strings(again)
+			if !reflect.DeepEqual(again, sorted) {
+				t.Errorf("%s: other records kept in shuffled order %d", name, n)
+			}
+		}
+	}
+}
+
+// release empties sampler for next metagenome
+func TestSamplerRelease(t *testing.T) {
+	sm := NewSampler(&Sampling{MaxReads: 2, Seed: 1})
+	for _, id := range sampleIDs(5) {
+		_, score := sm.Keep("mgm1.3", id)
+		sm.Hold(score, id)
+	}
+	if n := len(sm.Release()); n != 2 {
+		t.Errorf("released %d records, expected 2", n)
+	}
+	if n := len(sm.Release()); n != 0 {
+		t.Errorf("second release has %d records", n)
+	}
+}
@@ -0,0 +1,75 @@
+package file
+
+import (
+	"fmt"
+	"sort"
+)
+
+var IUPAC_AMINO_ACIDS = "ACDEFGHIKLMNPQRSTVWYBZJUOX*"
+var DEFAULT_SEQ_TYPE = "nucleotide"
+
+// kind of sequences in an export set, stored in index metadata
+type SeqType struct {
+	Name     string
+	Alphabet string
+	// replaces invalid characters
+	Unknown byte
+	// file name extension before any compression suffix
+	Ext string
+}
+
+var SeqTypes = map[string]*SeqType{
+	"nucleotide": &SeqType{Name: "nucleotide", Alphabet: IUPAC_NUCLEOTIDES, Unknown: 'N', Ext: ".fasta"},
+	"protein":    &SeqType{Name: "protein", Alphabet: IUPAC_AMINO_ACIDS, Unknown: 'X', Ext: ".faa"},
+}
+
+// MG-RAST pipeline stages with protein output, other stages are nucleotide
+var PROTEIN_STAGES = map[string]bool{
+	"genecalling":    true,
+	"genecalling.aa": true,
+	"protein":        true,
+	"protein.filter": true,
+	"cluster.aa90":   true,
+	"aa90":           true,
+}
+
+func GetSeqType(name string) (t *SeqType, err error) {
+	t, ok := SeqTypes[name]
+	if !ok {
+		err = fmt.Errorf("unknown sequence type %s, must be one of: %v", name, SeqTypeNames())
+	}
+	return
+}
+
+func SeqTypeNames() (names []string) {
+	for n := range SeqTypes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return
+}
+
+// sequence type of stage output
+func StageSeqType(stage string) *SeqType {
+	if PROTEIN_STAGES[stage] {
+		return SeqTypes["protein"]
+	}
+	return SeqTypes[DEFAULT_SEQ_TYPE]
+}
+
+// suffix of export files of sequence type written with profile,
+// nil for either is the default
+func FileSuffix(t *SeqType, p *Profile) string {
+	suffix := SeqTypes[DEFAULT_SEQ_TYPE].Ext
+	if t != nil {
+		suffix = t.Ext
+	}
+	if (p == nil) || p.Compressed() {
+		suffix += ".gz"
+	}
+	return suffix
+}
+
+func (t *SeqType) IsNucleotide() bool {
+	return t.Name == "nucleotide"
+}
@@ -0,0 +1,99 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+)
+
+var IUPAC_NUCLEOTIDES = "ACGTUNRYSWKMBDHV"
+
+type Validator struct {
+	Alphabet string
+	alphabet [256]bool
+	// replaces invalid characters
+	Unknown byte
+	MinLen  int
+	MaxLen  int
+	Replace bool
+	buf     []byte
+}
+
+// alphabet is case-insensitive, maxLen of 0 means no upper bound.
+// empty alphabet is set later from sequence type of export set.
+func NewValidator(alphabet string, minLen int, maxLen int, replace bool) *Validator {
+	v := &Validator{
+		Unknown: 'N',
+		MinLen:  minLen,
+		MaxLen:  maxLen,
+		Replace: replace,
+	}
+	v.SetAlphabet(alphabet)
+	return v
+}
+
+func (v *Validator) SetAlphabet(alphabet string) {
+	v.Alphabet = alphabet
+	v.alphabet = [256]bool{}
+	for _, c := range bytes.ToUpper([]byte(alphabet)) {
+		v.alphabet[c] = true
+	}
+}
+
+// alphabet if none was given and replacement of sequence type
+func (v *Validator) SetType(t *SeqType) {
+	if v.Alphabet == "" {
+		v.SetAlphabet(t.Alphabet)
+	}
+	v.Unknown = t.Unknown
+}
+
+// sanitize sequence, return error with reason if record is rejected
+// rejected records keep their original sequence, accepted ones point
+// to a buffer reused on the next call
+func (v *Validator) Check(s *Seq) (err error) {
+	if len(s.ID) == 0 {
+		err = fmt.Errorf("empty header")
+		return
+	}
+	if bytes.ContainsAny(s.ID, ">\n") {
+		err = fmt.Errorf("invalid character in header")
+		return
+	}
+	// drop whitespace, uppercase, check alphabet
+	clean := v.buf[:0]
+	for _, c := range s.Seq {
+		switch c {
+		case ' ', '\t', '\r', '\n', '\v', '\f':
+			continue
+		case '>':
+			err = fmt.Errorf("embedded '>' in sequence")
+			return
+		}
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		if !v.alphabet[c] {
+			if !v.Replace {
+				err = fmt.Errorf("invalid character '%c'", c)
+				return
+			}
+			c = v.Unknown
+		}
+		clean = append(clean, c)
+	}
+	v.buf = clean
+	if len(clean) == 0 {
+		err = fmt.Errorf("zero length sequence")
+		return
+	}
+	if len(clean) < v.MinLen {
+		err = fmt.Errorf("sequence length %d below minimum %d", len(clean), v.MinLen)
+		return
+	}
+	if (v.MaxLen > 0) && (len(clean) > v.MaxLen) {
+		err = fmt.Errorf("sequence length %d above maximum %d", len(clean), v.MaxLen)
+		return
+	}
+	s.Seq = clean
+	return
+}
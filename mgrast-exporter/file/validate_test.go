@@ -0,0 +1,61 @@
+package file
+
+import (
+	"testing"
+)
+
+func TestValidatorCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace bool
+		id      string
+		seq     string
+		want    string
+		reject  bool
+	}{
+		{name: "clean", id: "r1", seq: "ACGT", want: "ACGT"},
+		{name: "lowercase and whitespace", id: "r1", seq: "ac gt\r\nNN\t", want: "ACGTNN"},
+		{name: "invalid character", id: "r1", seq: "ACXGT", reject: true},
+		{name: "invalid character replaced", replace: true, id: "r1", seq: "ACXGT", want: "ACNGT"},
+		{name: "embedded header", id: "r1", seq: "AC>GT", reject: true},
+		{name: "empty header", id: "", seq: "ACGT", reject: true},
+		{name: "header with newline", id: "r1\nr2", seq: "ACGT", reject: true},
+		{name: "zero length", id: "r1", seq: " \n", reject: true},
+		{name: "below minimum", id: "r1", seq: "ac", reject: true},
+		{name: "above maximum", id: "r1", seq: "acgtacgtacg", reject: true},
+	}
+	for _, tt := range tests {
+		v := NewValidator(IUPAC_NUCLEOTIDES, 3, 10, tt.replace)
+		s := &Seq{ID: []byte(tt.id), Seq: []byte(tt.seq)}
+		err := v.Check(s)
+		if tt.reject {
+			if err == nil {
+				t.Errorf("%s: expected reject, got %q", tt.name, s.Seq)
+			}
+			// rejects keep their original sequence for the rejects log
+			if string(s.Seq) != tt.seq {
+				t.Errorf("%s: rejected sequence changed to %q, expected %q", tt.name, s.Seq, tt.seq)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected reject: %s", tt.name, err.Error())
+			continue
+		}
+		if string(s.Seq) != tt.want {
+			t.Errorf("%s: got %q, expected %q", tt.name, s.Seq, tt.want)
+		}
+	}
+}
+
+func TestValidatorSetType(t *testing.T) {
+	v := NewValidator("", 1, 0, true)
+	v.SetType(SeqTypes["protein"])
+	s := &Seq{ID: []byte("p1"), Seq: []byte("mkl1v*")}
+	if err := v.Check(s); err != nil {
+		t.Fatalf("unexpected reject: %s", err.Error())
+	}
+	if string(s.Seq) != "MKLXV*" {
+		t.Errorf("got %q, expected %q", s.Seq, "MKLXV*")
+	}
+}
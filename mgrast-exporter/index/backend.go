@@ -0,0 +1,87 @@
+package index
+
+import (
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"path/filepath"
+)
+
+// storage of indexes and metadata for an export set
+type Backend interface {
+	Name() string
+	Path() string
+	Exists() bool
+	Load(idx *Indexes, meta *Meta) error
+	Save(idx *Indexes, meta *Meta) error
+	Lookup(q Query) ([]*Index, error)
+	Delete() error
+	Close() error
+}
+
+// empty fields are not used, all given fields must match
+type Query struct {
+	Project    string
+	Metagenome string
+	File       int
+}
+
+func (q Query) Match(i *Index) bool {
+	if (q.Project != "") && (i.Project != q.Project) {
+		return false
+	}
+	if q.Metagenome != "" {
+		found := false
+		for _, m := range i.Metagenomes {
+			if m == q.Metagenome {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if (q.File > 0) && ((q.File < i.StartFile) || (q.File > i.EndFile)) {
+		return false
+	}
+	return true
+}
+
+var BACKENDS = []string{"json", "sqlite"}
+
+// sqlite needs a local export set, json is kept with the files
+func NewBackend(store storage.Storage, name string) (b Backend, err error) {
+	switch name {
+	case "json":
+		b = NewJSONBackend(store, INDEX_FILE)
+	case "sqlite":
+		dir, ok := store.LocalDir()
+		if !ok {
+			err = fmt.Errorf("sqlite index backend needs a local export directory, not %s", store.Location(""))
+			return
+		}
+		b = NewSQLiteBackend(filepath.Join(dir, INDEX_DB_FILE))
+	default:
+		err = fmt.Errorf("unknown index backend %s, must be one of: %v", name, BACKENDS)
+	}
+	return
+}
+
+// use backend of existing index in export set, name is used if there is none
+func OpenBackend(store storage.Storage, name string) (b Backend, err error) {
+	hasJSON := store.Exists(INDEX_FILE)
+	hasDB := store.Exists(INDEX_DB_FILE)
+	switch {
+	case hasJSON && hasDB:
+		err = fmt.Errorf("export set %s has both %s and %s, remove one", store.Location(""), INDEX_FILE, INDEX_DB_FILE)
+		return
+	case hasJSON:
+		name = "json"
+	case hasDB:
+		name = "sqlite"
+	case name == "":
+		name = "json"
+	}
+	b, err = NewBackend(store, name)
+	return
+}
@@ -0,0 +1,115 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"io/ioutil"
+)
+
+// on-disk layout of index file, version 1 is a bare index array
+type indexEnvelope struct {
+	Version int      `json:"version"`
+	Meta    *Meta    `json:"meta"`
+	Indexes *Indexes `json:"indexes"`
+}
+
+// whole export set in one json file, rewritten on every save
+type JSONBackend struct {
+	store storage.Storage
+	name  string
+}
+
+func NewJSONBackend(store storage.Storage, name string) *JSONBackend {
+	return &JSONBackend{store: store, name: name}
+}
+
+func (b *JSONBackend) Name() string {
+	return "json"
+}
+
+func (b *JSONBackend) Path() string {
+	return b.store.Location(b.name)
+}
+
+func (b *JSONBackend) Exists() bool {
+	return b.store.Exists(b.name)
+}
+
+// reads indexes and metadata, a legacy bare index array has empty metadata
+// and is written in current version on next save
+func (b *JSONBackend) Load(idx *Indexes, meta *Meta) (err error) {
+	if !b.Exists() {
+		return
+	}
+	fh, err := b.store.Open(b.name)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	jsonstream, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return
+	}
+	jsonstream = bytes.TrimSpace(jsonstream)
+	if bytes.HasPrefix(jsonstream, []byte{'['}) {
+		err = json.Unmarshal(jsonstream, idx)
+		return
+	}
+	env := &indexEnvelope{Meta: meta, Indexes: idx}
+	err = json.Unmarshal(jsonstream, env)
+	if err != nil {
+		return
+	}
+	if env.Version > INDEX_VERSION {
+		err = fmt.Errorf("index file %s has version %d, newer than supported version %d", b.Path(), env.Version, INDEX_VERSION)
+	}
+	return
+}
+
+func (b *JSONBackend) Save(idx *Indexes, meta *Meta) (err error) {
+	var jsonstream []byte
+	jsonstream, err = MarshalIndex(idx, meta)
+	if err != nil {
+		return
+	}
+	fh, err := b.store.Create(b.name)
+	if err != nil {
+		return
+	}
+	if _, err = fh.Write(jsonstream); err != nil {
+		fh.Close()
+		return
+	}
+	err = fh.Close()
+	return
+}
+
+// index file content in current version
+func MarshalIndex(idx *Indexes, meta *Meta) ([]byte, error) {
+	return json.Marshal(&indexEnvelope{Version: INDEX_VERSION, Meta: meta, Indexes: idx})
+}
+
+// linear scan of whole file
+func (b *JSONBackend) Lookup(q Query) (found []*Index, err error) {
+	idx := NewExportIndex()
+	err = b.Load(idx, NewMeta())
+	if err != nil {
+		return
+	}
+	for _, i := range *idx {
+		if q.Match(i) {
+			found = append(found, i)
+		}
+	}
+	return
+}
+
+func (b *JSONBackend) Delete() error {
+	return b.store.Delete(b.name)
+}
+
+func (b *JSONBackend) Close() error {
+	return nil
+}
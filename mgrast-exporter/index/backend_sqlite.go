@@ -0,0 +1,285 @@
+package index
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"os"
+	"strings"
+)
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS meta (id INTEGER PRIMARY KEY CHECK (id = 1), version INTEGER NOT NULL, data TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS indexes (pos INTEGER PRIMARY KEY, project TEXT NOT NULL, start_file INTEGER NOT NULL, start_record INTEGER NOT NULL, end_file INTEGER NOT NULL, end_record INTEGER NOT NULL, completed INTEGER NOT NULL, removed INTEGER NOT NULL DEFAULT 0, metadata TEXT NOT NULL DEFAULT '')`,
+	`CREATE TABLE IF NOT EXISTS metagenomes (pos INTEGER NOT NULL, seq INTEGER NOT NULL, metagenome TEXT NOT NULL, records INTEGER, pairs INTEGER, PRIMARY KEY (pos, seq))`,
+	`CREATE INDEX IF NOT EXISTS indexes_project ON indexes (project)`,
+	`CREATE INDEX IF NOT EXISTS indexes_files ON indexes (start_file, end_file)`,
+	`CREATE INDEX IF NOT EXISTS metagenomes_metagenome ON metagenomes (metagenome)`,
+}
+
+// columns added after first schema, with statement adding them to older databases
+var sqliteColumns = [][3]string{
+	{"indexes", "removed", `ALTER TABLE indexes ADD COLUMN removed INTEGER NOT NULL DEFAULT 0`},
+	{"indexes", "metadata", `ALTER TABLE indexes ADD COLUMN metadata TEXT NOT NULL DEFAULT ''`},
+	{"metagenomes", "records", `ALTER TABLE metagenomes ADD COLUMN records INTEGER`},
+	{"metagenomes", "pairs", `ALTER TABLE metagenomes ADD COLUMN pairs INTEGER`},
+}
+
+// embedded database, save only writes indexes changed since last load or save
+type SQLiteBackend struct {
+	path string
+	db   *sql.DB
+}
+
+func NewSQLiteBackend(path string) *SQLiteBackend {
+	return &SQLiteBackend{path: path}
+}
+
+func (b *SQLiteBackend) Name() string {
+	return "sqlite"
+}
+
+func (b *SQLiteBackend) Path() string {
+	return b.path
+}
+
+func (b *SQLiteBackend) Exists() bool {
+	_, err := os.Stat(b.path)
+	return err == nil
+}
+
+func (b *SQLiteBackend) open() (err error) {
+	if b.db != nil {
+		return
+	}
+	b.db, err = sql.Open("sqlite", b.path)
+	if err != nil {
+		return
+	}
+	for _, stmt := range sqliteSchema {
+		if _, err = b.db.Exec(stmt); err != nil {
+			b.db.Close()
+			b.db = nil
+			return
+		}
+	}
+	for _, col := range sqliteColumns {
+		var n int
+		err = b.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, col[0], col[1]).Scan(&n)
+		if err == nil && n == 0 {
+			_, err = b.db.Exec(col[2])
+		}
+		if err != nil {
+			b.db.Close()
+			b.db = nil
+			return
+		}
+	}
+	return
+}
+
+func (b *SQLiteBackend) Load(idx *Indexes, meta *Meta) (err error) {
+	if !b.Exists() {
+		return
+	}
+	if err = b.open(); err != nil {
+		return
+	}
+	var version int
+	var data string
+	err = b.db.QueryRow(`SELECT version, data FROM meta WHERE id = 1`).Scan(&version, &data)
+	if err == sql.ErrNoRows {
+		err = nil
+	} else if err != nil {
+		return
+	} else {
+		if version > INDEX_VERSION {
+			err = fmt.Errorf("index file %s has version %d, newer than supported version %d", b.path, version, INDEX_VERSION)
+			return
+		}
+		if err = json.Unmarshal([]byte(data), meta); err != nil {
+			return
+		}
+	}
+	found, err := b.query("", nil)
+	if err != nil {
+		return
+	}
+	idx.Reset()
+	for _, i := range found {
+		*idx = append(*idx, i)
+	}
+	return
+}
+
+func (b *SQLiteBackend) Save(idx *Indexes, meta *Meta) (err error) {
+	if err = b.open(); err != nil {
+		return
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	tx, err := b.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	_, err = tx.Exec(`INSERT OR REPLACE INTO meta (id, version, data) VALUES (1, ?, ?)`, INDEX_VERSION, string(data))
+	if err != nil {
+		return
+	}
+	// drop indexes removed from end
+	if _, err = tx.Exec(`DELETE FROM indexes WHERE pos >= ?`, idx.Len()); err != nil {
+		return
+	}
+	if _, err = tx.Exec(`DELETE FROM metagenomes WHERE pos >= ?`, idx.Len()); err != nil {
+		return
+	}
+	for pos, i := range *idx {
+		if !i.dirty {
+			continue
+		}
+		_, err = tx.Exec(
+			`INSERT OR REPLACE INTO indexes (pos, project, start_file, start_record, end_file, end_record, completed, removed, metadata) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			pos, i.Project, i.StartFile, i.StartRecord, i.EndFile, i.EndRecord, i.Completed, i.Removed, i.Metadata,
+		)
+		if err != nil {
+			return
+		}
+		if _, err = tx.Exec(`DELETE FROM metagenomes WHERE pos = ?`, pos); err != nil {
+			return
+		}
+		for seq, m := range i.Metagenomes {
+			// no count for legacy indexes
+			var records, pairs interface{}
+			if i.Records != nil {
+				records = i.Records[m]
+			}
+			if n, ok := i.Pairs[m]; ok {
+				pairs = n
+			}
+			if _, err = tx.Exec(`INSERT INTO metagenomes (pos, seq, metagenome, records, pairs) VALUES (?, ?, ?, ?, ?)`, pos, seq, m, records, pairs); err != nil {
+				return
+			}
+		}
+	}
+	for _, i := range *idx {
+		i.dirty = false
+	}
+	return
+}
+
+func (b *SQLiteBackend) Lookup(q Query) (found []*Index, err error) {
+	if !b.Exists() {
+		return
+	}
+	if err = b.open(); err != nil {
+		return
+	}
+	var where []string
+	var args []interface{}
+	if q.Project != "" {
+		where = append(where, `project = ?`)
+		args = append(args, q.Project)
+	}
+	if q.Metagenome != "" {
+		where = append(where, `pos IN (SELECT pos FROM metagenomes WHERE metagenome = ?)`)
+		args = append(args, q.Metagenome)
+	}
+	if q.File > 0 {
+		where = append(where, `start_file <= ? AND end_file >= ?`)
+		args = append(args, q.File, q.File)
+	}
+	found, err = b.query(strings.Join(where, " AND "), args)
+	return
+}
+
+// indexes in position order with their metagenomes
+func (b *SQLiteBackend) query(where string, args []interface{}) (found []*Index, err error) {
+	stmt := `SELECT pos, project, start_file, start_record, end_file, end_record, completed, removed, metadata FROM indexes`
+	if where != "" {
+		stmt += ` WHERE ` + where
+	}
+	stmt += ` ORDER BY pos`
+	rows, err := b.db.Query(stmt, args...)
+	if err != nil {
+		return
+	}
+	byPos := make(map[int]*Index)
+	var positions []interface{}
+	for rows.Next() {
+		var pos int
+		i := new(Index)
+		if err = rows.Scan(&pos, &i.Project, &i.StartFile, &i.StartRecord, &i.EndFile, &i.EndRecord, &i.Completed, &i.Removed, &i.Metadata); err != nil {
+			rows.Close()
+			return
+		}
+		found = append(found, i)
+		byPos[pos] = i
+		positions = append(positions, pos)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if len(found) == 0 {
+		return
+	}
+	mstmt := `SELECT pos, metagenome, records, pairs FROM metagenomes ORDER BY pos, seq`
+	var margs []interface{}
+	if where != "" {
+		mstmt = `SELECT pos, metagenome, records, pairs FROM metagenomes WHERE pos IN (?` + strings.Repeat(`, ?`, len(positions)-1) + `) ORDER BY pos, seq`
+		margs = positions
+	}
+	mrows, err := b.db.Query(mstmt, margs...)
+	if err != nil {
+		return
+	}
+	defer mrows.Close()
+	for mrows.Next() {
+		var pos int
+		var m string
+		var records, pairs sql.NullInt64
+		if err = mrows.Scan(&pos, &m, &records, &pairs); err != nil {
+			return
+		}
+		if i, ok := byPos[pos]; ok {
+			i.Metagenomes = append(i.Metagenomes, m)
+			if records.Valid {
+				if i.Records == nil {
+					i.Records = make(map[string]int)
+				}
+				i.Records[m] = int(records.Int64)
+			}
+			if pairs.Valid {
+				if i.Pairs == nil {
+					i.Pairs = make(map[string]int)
+				}
+				i.Pairs[m] = int(pairs.Int64)
+			}
+		}
+	}
+	err = mrows.Err()
+	return
+}
+
+func (b *SQLiteBackend) Delete() error {
+	b.Close()
+	return os.Remove(b.path)
+}
+
+func (b *SQLiteBackend) Close() (err error) {
+	if b.db != nil {
+		err = b.db.Close()
+		b.db = nil
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package index
+
+import (
+	"database/sql"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"reflect"
+	"testing"
+)
+
+func testIndexes() *Indexes {
+	idx := NewExportIndex()
+	for _, p := range []struct {
+		project string
+		mgs     []string
+	}{{"mgp1", []string{"mgm1.3", "mgm2.3"}}, {"mgp2", []string{"mgm3.3"}}} {
+		i := new(Index)
+		i.Init(p.project, p.mgs[0], 1, 1)
+		for _, m := range p.mgs[1:] {
+			i.Update(m)
+		}
+		for n, m := range p.mgs {
+			for r := 0; r <= n; r++ {
+				i.AddRecord(m)
+			}
+		}
+		i.Finalize(p.mgs[len(p.mgs)-1], 1, 10)
+		idx.Add(i)
+	}
+	return idx
+}
+
+// indexes loaded from json are not dirty, a new backend must still get them all
+func TestSQLiteSaveLoaded(t *testing.T) {
+	store, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := NewJSONBackend(store, INDEX_FILE)
+	if err = source.Save(testIndexes(), NewMeta()); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewExportIndex()
+	if err = source.Load(loaded, NewMeta()); err != nil {
+		t.Fatal(err)
+	}
+
+	target := NewSQLiteBackend(store.Location(INDEX_DB_FILE))
+	defer target.Close()
+	loaded.MarkDirty()
+	if err = target.Save(loaded, NewMeta()); err != nil {
+		t.Fatal(err)
+	}
+	converted := NewExportIndex()
+	if err = target.Load(converted, NewMeta()); err != nil {
+		t.Fatal(err)
+	}
+	if converted.Len() != loaded.Len() {
+		t.Fatalf("converted index has %d projects, expected %d", converted.Len(), loaded.Len())
+	}
+	for pos, i := range *loaded {
+		n := (*converted)[pos]
+		if (n.Project != i.Project) || !reflect.DeepEqual(n.Metagenomes, i.Metagenomes) || !reflect.DeepEqual(n.Records, i.Records) {
+			t.Errorf("position %d is %+v, expected %+v", pos, n, i)
+		}
+	}
+}
+
+// database created before removed and records columns keeps working
+func TestSQLiteMigrate(t *testing.T) {
+	path := t.TempDir() + "/" + INDEX_DB_FILE
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE meta (id INTEGER PRIMARY KEY CHECK (id = 1), version INTEGER NOT NULL, data TEXT NOT NULL)`,
+		`CREATE TABLE indexes (pos INTEGER PRIMARY KEY, project TEXT NOT NULL, start_file INTEGER NOT NULL, start_record INTEGER NOT NULL, end_file INTEGER NOT NULL, end_record INTEGER NOT NULL, completed INTEGER NOT NULL)`,
+		`CREATE TABLE metagenomes (pos INTEGER NOT NULL, seq INTEGER NOT NULL, metagenome TEXT NOT NULL, PRIMARY KEY (pos, seq))`,
+		`INSERT INTO meta (id, version, data) VALUES (1, 1, '{}')`,
+		`INSERT INTO indexes VALUES (0, 'mgp1', 1, 1, 1, 3, 1)`,
+		`INSERT INTO metagenomes VALUES (0, 0, 'mgm1.3')`,
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	b := NewSQLiteBackend(path)
+	defer b.Close()
+	idx := NewExportIndex()
+	if err = b.Load(idx, NewMeta()); err != nil {
+		t.Fatalf("load old database: %s", err.Error())
+	}
+	if (idx.Len() != 1) || ((*idx)[0].Project != "mgp1") || (len((*idx)[0].Records) != 0) {
+		t.Fatalf("old database loaded as %+v", *idx)
+	}
+	(*idx)[0].Removed = true
+	(*idx)[0].Records = map[string]int{"mgm1.3": 3}
+	idx.MarkDirty()
+	if err = b.Save(idx, NewMeta()); err != nil {
+		t.Fatalf("save to old database: %s", err.Error())
+	}
+	loaded := NewExportIndex()
+	if err = b.Load(loaded, NewMeta()); err != nil {
+		t.Fatal(err)
+	}
+	if !(*loaded)[0].Removed {
+		t.Errorf("removed flag not stored in old database")
+	}
+	if (*loaded)[0].Records["mgm1.3"] != 3 {
+		t.Errorf("record count not stored in old database: %v", (*loaded)[0].Records)
+	}
+}
@@ -0,0 +1,132 @@
+package index
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// differences between two export sets, old to new
+type Diff struct {
+	Added   []*Index
+	Removed []*Index
+	Changed []*ProjectDiff
+}
+
+type ProjectDiff struct {
+	Project     string
+	Added       []string
+	Removed     []string
+	OldRecords  int
+	NewRecords  int
+	Metagenomes []*MetagenomeDiff
+}
+
+type MetagenomeDiff struct {
+	Metagenome string
+	OldRecords int
+	NewRecords int
+}
+
+// record counts are only compared when both sides have them,
+// removed (tombstoned) projects count as missing
+func Compare(old *Indexes, current *Indexes) (d *Diff) {
+	d = &Diff{}
+	oldProj := projectMap(old)
+	newProj := projectMap(current)
+	for _, p := range sortedKeys(newProj) {
+		if _, ok := oldProj[p]; !ok {
+			d.Added = append(d.Added, newProj[p])
+		}
+	}
+	for _, p := range sortedKeys(oldProj) {
+		o := oldProj[p]
+		n, ok := newProj[p]
+		if !ok {
+			d.Removed = append(d.Removed, o)
+			continue
+		}
+		pd := &ProjectDiff{Project: p, OldRecords: o.RecordCount(), NewRecords: n.RecordCount()}
+		oldMg := make(map[string]bool)
+		for _, m := range o.Metagenomes {
+			oldMg[m] = true
+		}
+		newMg := make(map[string]bool)
+		for _, m := range n.Metagenomes {
+			newMg[m] = true
+			if !oldMg[m] {
+				pd.Added = append(pd.Added, m)
+			}
+		}
+		for _, m := range o.Metagenomes {
+			if !newMg[m] {
+				pd.Removed = append(pd.Removed, m)
+			} else if (o.Records != nil) && (n.Records != nil) && (o.Records[m] != n.Records[m]) {
+				pd.Metagenomes = append(pd.Metagenomes, &MetagenomeDiff{Metagenome: m, OldRecords: o.Records[m], NewRecords: n.Records[m]})
+			}
+		}
+		countChanged := (pd.OldRecords >= 0) && (pd.NewRecords >= 0) && (pd.OldRecords != pd.NewRecords)
+		if (len(pd.Added) > 0) || (len(pd.Removed) > 0) || (len(pd.Metagenomes) > 0) || countChanged {
+			sort.Strings(pd.Added)
+			sort.Strings(pd.Removed)
+			d.Changed = append(d.Changed, pd)
+		}
+	}
+	return
+}
+
+func (d *Diff) Empty() bool {
+	return (len(d.Added) == 0) && (len(d.Removed) == 0) && (len(d.Changed) == 0)
+}
+
+func (d *Diff) Write(w io.Writer) {
+	for _, i := range d.Added {
+		fmt.Fprintf(w, "+ project %s: %d metagenome(s)%s\n", i.Project, len(i.Metagenomes), recordText(i.RecordCount()))
+	}
+	for _, i := range d.Removed {
+		fmt.Fprintf(w, "- project %s: %d metagenome(s)%s\n", i.Project, len(i.Metagenomes), recordText(i.RecordCount()))
+	}
+	for _, pd := range d.Changed {
+		fmt.Fprintf(w, "~ project %s", pd.Project)
+		if (pd.OldRecords >= 0) && (pd.NewRecords >= 0) && (pd.OldRecords != pd.NewRecords) {
+			fmt.Fprintf(w, ": records %d -> %d", pd.OldRecords, pd.NewRecords)
+		}
+		fmt.Fprintf(w, "\n")
+		for _, m := range pd.Added {
+			fmt.Fprintf(w, "    + metagenome %s\n", m)
+		}
+		for _, m := range pd.Removed {
+			fmt.Fprintf(w, "    - metagenome %s\n", m)
+		}
+		for _, md := range pd.Metagenomes {
+			fmt.Fprintf(w, "    ~ metagenome %s: records %d -> %d\n", md.Metagenome, md.OldRecords, md.NewRecords)
+		}
+	}
+	fmt.Fprintf(w, "%d project(s) added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+func recordText(n int) string {
+	if n < 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %d record(s)", n)
+}
+
+func projectMap(idx *Indexes) map[string]*Index {
+	projects := make(map[string]*Index)
+	for _, i := range *idx {
+		if i.Removed || (i.Project == "") {
+			continue
+		}
+		projects[i.Project] = i
+	}
+	return projects
+}
+
+func sortedKeys(m map[string]*Index) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
@@ -0,0 +1,108 @@
+package index
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// metagenome of a test project, records below zero leaves no counts
+type testMg struct {
+	id      string
+	records int
+}
+
+func diffIndexes(projects map[string][]testMg, removed ...string) *Indexes {
+	idx := NewExportIndex()
+	for _, p := range []string{"mgp1", "mgp2", "mgp3", "mgp4", "mgp5", "mgp6", "mgp7"} {
+		mgs, ok := projects[p]
+		if !ok {
+			continue
+		}
+		i := new(Index)
+		i.Init(p, mgs[0].id, 0, 0)
+		for _, m := range mgs {
+			i.Update(m.id)
+			for r := 0; r < m.records; r++ {
+				i.AddRecord(m.id)
+			}
+		}
+		for _, r := range removed {
+			i.Removed = i.Removed || (r == p)
+		}
+		idx.Add(i)
+	}
+	return idx
+}
+
+func TestCompare(t *testing.T) {
+	old := diffIndexes(map[string][]testMg{
+		"mgp1": {{"mgm1.3", 3}, {"mgm2.3", 2}},
+		"mgp2": {{"mgm3.3", 1}},
+		"mgp3": {{"mgm4.3", 4}},
+		"mgp5": {{"mgm9.3", 1}},
+		"mgp6": {{"mgm10.3", 2}},
+		"mgp7": {{"mgm7.3", 1}, {"mgm8.3", 1}},
+	}, "mgp5")
+	current := diffIndexes(map[string][]testMg{
+		"mgp1": {{"mgm1.3", 3}, {"mgm2.3", 5}},
+		"mgp3": {{"mgm4.3", 4}, {"mgm6.3", 1}},
+		"mgp4": {{"mgm5.3", 2}},
+		"mgp5": {{"mgm9.3", 1}},
+		"mgp6": {{"mgm10.3", 2}},
+		"mgp7": {{"mgm7.3", 1}},
+	})
+	d := Compare(old, current)
+	var added, removed []string
+	for _, i := range d.Added {
+		added = append(added, i.Project)
+	}
+	for _, i := range d.Removed {
+		removed = append(removed, i.Project)
+	}
+	// tombstoned project counts as missing, unchanged project is left out
+	if !reflect.DeepEqual(added, []string{"mgp4", "mgp5"}) {
+		t.Errorf("added %v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"mgp2"}) {
+		t.Errorf("removed %v", removed)
+	}
+	var buf bytes.Buffer
+	d.Write(&buf)
+	expected := "+ project mgp4: 1 metagenome(s), 2 record(s)\n" +
+		"+ project mgp5: 1 metagenome(s), 1 record(s)\n" +
+		"- project mgp2: 1 metagenome(s), 1 record(s)\n" +
+		"~ project mgp1: records 5 -> 8\n" +
+		"    ~ metagenome mgm2.3: records 2 -> 5\n" +
+		"~ project mgp3: records 4 -> 5\n" +
+		"    + metagenome mgm6.3\n" +
+		"~ project mgp7: records 2 -> 1\n" +
+		"    - metagenome mgm8.3\n" +
+		"2 project(s) added, 1 removed, 3 changed\n"
+	if buf.String() != expected {
+		t.Errorf("diff is\n%s\nexpected\n%s", buf.String(), expected)
+	}
+	if d.Empty() || !Compare(current, current).Empty() {
+		t.Error("wrong empty diff")
+	}
+}
+
+// listing has no record counts, only metagenomes are compared
+func TestCompareListing(t *testing.T) {
+	old := diffIndexes(map[string][]testMg{
+		"mgp1": {{"mgm1.3", 3}, {"mgm2.3", 2}},
+		"mgp2": {{"mgm3.3", 1}},
+	})
+	listing := diffIndexes(map[string][]testMg{
+		"mgp1": {{"mgm1.3", -1}, {"mgm2.3", -1}},
+		"mgp2": {{"mgm3.3", -1}, {"mgm4.3", -1}},
+	})
+	var buf bytes.Buffer
+	Compare(old, listing).Write(&buf)
+	expected := "~ project mgp2\n" +
+		"    + metagenome mgm4.3\n" +
+		"0 project(s) added, 0 removed, 1 changed\n"
+	if buf.String() != expected {
+		t.Errorf("diff is\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
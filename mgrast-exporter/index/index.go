@@ -1,36 +1,75 @@
 package index
 
 import (
-	"encoding/json"
+	"bytes"
 	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
 	"io"
-	"io/ioutil"
-	"os"
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var INDEX_FILE = "export.index"
-
-var (
-	ExportIndex = NewExportIndex()
-)
+var INDEX_DB_FILE = "export.index.db"
+var INDEX_VERSION = 2
 
 func NewExportIndex() *Indexes {
 	return &Indexes{}
 }
 
+func NewMeta() *Meta {
+	return &Meta{}
+}
+
 type Indexes []*Index
 
+// describes how the export set was produced
+type Meta struct {
+	Version   string         `json:"exporter_version,omitempty"`
+	Created   time.Time      `json:"created"`
+	Stage     string         `json:"stage,omitempty"`
+	SeqType   string         `json:"seq_type,omitempty"`
+	Size      int64          `json:"size,omitempty"`
+	ShockHost string         `json:"shock_host,omitempty"`
+	Query     url.Values     `json:"query,omitempty"`
+	Header    string         `json:"header_template,omitempty"`
+	Wrap      int            `json:"wrap"`
+	Profile   *file.Profile  `json:"profile,omitempty"`
+	Sample    *file.Sampling `json:"sample,omitempty"`
+	ReadIndex bool           `json:"read_index,omitempty"`
+	Target    string         `json:"target,omitempty"`
+	Paired    string         `json:"paired,omitempty"`
+	Removing  *Removal       `json:"removing,omitempty"`
+}
+
+// project removal saved with the index of the new layout before its files
+// are renamed, so an interrupted one can be finished. file numbers are the
+// ones before removal.
+type Removal struct {
+	Project   string `json:"project"`
+	Phase     string `json:"phase"`
+	Files     []int  `json:"files"`
+	Rewritten []int  `json:"rewritten,omitempty"`
+	Emptied   []int  `json:"emptied,omitempty"`
+	Metadata  string `json:"metadata,omitempty"`
+}
+
 type Index struct {
-	Project     string   `json:"p"`
-	Metagenomes []string `json:"m"`
-	StartFile   int      `json:"sf"`
-	StartRecord int      `json:"sr"`
-	EndFile     int      `json:"ef"`
-	EndRecord   int      `json:"er"`
-	Completed   bool     `json:"c"`
+	Project     string         `json:"p"`
+	Metagenomes []string       `json:"m"`
+	StartFile   int            `json:"sf"`
+	StartRecord int            `json:"sr"`
+	EndFile     int            `json:"ef"`
+	EndRecord   int            `json:"er"`
+	Completed   bool           `json:"c"`
+	Removed     bool           `json:"x,omitempty"`
+	Records     map[string]int `json:"n,omitempty"`
+	Pairs       map[string]int `json:"pe,omitempty"`
+	Metadata    string         `json:"md,omitempty"`
+	dirty       bool
 }
 
 type PrevInfo struct {
@@ -44,6 +83,7 @@ func (i *Index) Init(p string, m string, f int, r int) {
 	i.Metagenomes = append(i.Metagenomes, m)
 	i.StartFile = f
 	i.StartRecord = r
+	i.dirty = true
 }
 
 func (i *Index) Update(mg string) {
@@ -58,7 +98,69 @@ func (i *Index) Update(mg string) {
 	}
 	if add {
 		i.Metagenomes = append(i.Metagenomes, mg)
+		i.dirty = true
+	}
+}
+
+// count record of metagenome
+func (i *Index) AddRecord(mg string) {
+	if i.Records == nil {
+		i.Records = make(map[string]int)
 	}
+	i.Records[mg] += 1
+	i.dirty = true
+}
+
+// count read pair of metagenome, both mates are also counted as records
+// unless they are written to parallel files
+func (i *Index) AddPair(mg string) {
+	i.AddPairs(mg, 1)
+}
+
+func (i *Index) AddPairs(mg string, n int) {
+	if i.Pairs == nil {
+		i.Pairs = make(map[string]int)
+	}
+	i.Pairs[mg] += n
+	i.dirty = true
+}
+
+// total records, -1 if index has no counts
+func (i *Index) RecordCount() (count int) {
+	if i.Records == nil {
+		return -1
+	}
+	for _, n := range i.Records {
+		count += n
+	}
+	return
+}
+
+// new file positions after files were rewritten
+func (i *Index) Move(sf int, sr int, ef int, er int) {
+	if (i.StartFile == sf) && (i.StartRecord == sr) && (i.EndFile == ef) && (i.EndRecord == er) {
+		return
+	}
+	i.StartFile = sf
+	i.StartRecord = sr
+	i.EndFile = ef
+	i.EndRecord = er
+	i.dirty = true
+}
+
+// project removed from export set, records stay in files until repack
+func (i *Index) Tombstone() {
+	i.Removed = true
+	i.dirty = true
+}
+
+// sidecar file with metadata of project metagenomes
+func (i *Index) Link(metadata string) {
+	if i.Metadata == metadata {
+		return
+	}
+	i.Metadata = metadata
+	i.dirty = true
 }
 
 func (i *Index) CurrentMG() string {
@@ -70,18 +172,16 @@ func (i *Index) Finalize(mg string, f int, r int) {
 	i.EndFile = f
 	i.EndRecord = r
 	i.Completed = true
+	i.dirty = true
 }
 
-func (idx *Indexes) Init(filepath string) (err error) {
-	if _, oerr := os.Stat(filepath); oerr == nil {
-		var jsonstream []byte
-		jsonstream, err = ioutil.ReadFile(filepath)
-		if err != nil {
-			return
-		}
-		err = json.Unmarshal(jsonstream, idx)
+// set of all projects, for repeated lookups
+func (idx *Indexes) Projects() map[string]bool {
+	projects := make(map[string]bool)
+	for _, i := range *idx {
+		projects[i.Project] = true
 	}
-	return
+	return projects
 }
 
 func (idx *Indexes) Contains(p string) bool {
@@ -97,28 +197,34 @@ func (idx *Indexes) Get() *Index {
 	return (*idx)[len(*idx)-1]
 }
 
-func (idx *Indexes) Save(filepath string) (err error) {
-	if _, oerr := os.Stat(filepath); oerr == nil {
-		// delete if exists
-		os.Remove(filepath)
-	}
-	var jsonstream []byte
-	jsonstream, err = json.Marshal(idx)
-	if err != nil {
-		return
-	}
-	err = ioutil.WriteFile(filepath, jsonstream, 0666)
-	return
-}
-
 func (idx *Indexes) RemoveFromEnd(n int) {
 	*idx = (*idx)[:len(*idx)-n]
 }
 
 func (idx *Indexes) Add(i *Index) {
+	i.dirty = true
 	*idx = append(*idx, i)
 }
 
+// later indexes change position
+func (idx *Indexes) RemoveAt(pos int) {
+	*idx = append((*idx)[:pos], (*idx)[pos+1:]...)
+	for _, i := range (*idx)[pos:] {
+		i.dirty = true
+	}
+}
+
+// next save writes every index, as needed by a new backend
+func (idx *Indexes) MarkDirty() {
+	for _, i := range *idx {
+		i.dirty = true
+	}
+}
+
+func (idx *Indexes) Reset() {
+	*idx = (*idx)[:0]
+}
+
 func (idx *Indexes) Len() int {
 	return len(*idx)
 }
@@ -158,7 +264,7 @@ func (idx *Indexes) HasFiles(files []string) (ok bool, missing []string) {
 	ifiles := idx.FileList(0)
 	for _, f := range files {
 		has := false
-		fnum, _ := strconv.Atoi(strings.Split(filepath.Base(f), ".")[0])
+		fnum, _ := FileNum(f)
 		for _, ifile := range ifiles {
 			if fnum == ifile {
 				has = true
@@ -172,12 +278,23 @@ func (idx *Indexes) HasFiles(files []string) (ok bool, missing []string) {
 	return
 }
 
-func (idx *Indexes) IndexAllFiles(files []string) (err error) {
+// number of numbered file, leading digits of its name
+func FileNum(f string) (int, error) {
+	name := filepath.Base(f)
+	return strconv.Atoi(name[:len(name)-len(strings.TrimLeft(name, "0123456789"))])
+}
+
+// with pairs adjacent mates of a metagenome are counted as read pairs
+func (idx *Indexes) IndexAllFiles(store storage.Storage, files []string, hf *file.HeaderFormat, pairs bool) (err error) {
 	prev := new(PrevInfo)
 	currIndex := new(Index)
 	idx.Add(currIndex)
+	var mates *mateCount
+	if pairs {
+		mates = &mateCount{}
+	}
 	for _, f := range files {
-		prev, currIndex, err = idx.indexFile(f, prev, currIndex)
+		prev, currIndex, err = idx.indexFile(store, f, hf, prev, currIndex, mates)
 		if err != nil {
 			return
 		}
@@ -187,38 +304,53 @@ func (idx *Indexes) IndexAllFiles(files []string) (err error) {
 	return
 }
 
-func (idx *Indexes) indexFile(f string, prev *PrevInfo, currIndex *Index) (next *PrevInfo, nextIndex *Index, err error) {
+// mate 1 of last record, paired by the next one
+type mateCount struct {
+	mg  string
+	key []byte
+}
+
+func (mc *mateCount) count(i *Index, mg string, id []byte) {
+	key, mate := file.MateID(id)
+	if (mate == 2) && (mc.key != nil) && (mc.mg == mg) && bytes.Equal(key, mc.key) {
+		i.AddPair(mg)
+	}
+	mc.key = nil
+	if mate == 1 {
+		mc.mg = mg
+		mc.key = append([]byte(nil), key...)
+	}
+}
+
+func (idx *Indexes) indexFile(store storage.Storage, f string, hf *file.HeaderFormat, prev *PrevInfo, currIndex *Index, mates *mateCount) (next *PrevInfo, nextIndex *Index, err error) {
 	var fnum int
-	fnum, err = strconv.Atoi(strings.Split(filepath.Base(f), ".")[0])
+	fnum, err = FileNum(f)
 	if err != nil {
 		return
 	}
 	rnum := 0
 
-	fh, err := os.Open(f)
+	fh, err := store.Open(f)
 	if err != nil {
 		return
 	}
 	defer fh.Close()
 	fr := file.NewReader(fh, true)
 
-	eof := false
+	next = prev
 	for {
-		rnum += 1
 		seq, er := fr.Read()
 		if er != nil {
 			if er != io.EOF {
 				err = er
 				return
 			}
-			eof = true
-		}
-		if eof && (seq == nil) {
 			break
 		}
+		rnum += 1
 		var proj string
 		var mg string
-		proj, mg, err = file.ParseHeader(string(seq.ID[:]))
+		proj, mg, err = hf.ParseHeader(string(seq.ID[:]))
 		if err != nil {
 			return
 		}
@@ -237,15 +369,17 @@ func (idx *Indexes) indexFile(f string, prev *PrevInfo, currIndex *Index) (next
 			idx.Add(nextIndex)
 			nextIndex.Init(proj, mg, fnum, rnum)
 		}
+		if nextIndex != nil {
+			currIndex = nextIndex
+		}
+		currIndex.AddRecord(mg)
+		if mates != nil {
+			mates.count(currIndex, mg, seq.ID)
+		}
 		next.M = mg
 		next.F = fnum
 		next.R = rnum
-		if nextIndex == nil {
-			nextIndex = currIndex
-		}
-		if eof {
-			break
-		}
 	}
+	nextIndex = currIndex
 	return
 }
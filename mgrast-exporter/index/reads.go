@@ -0,0 +1,198 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"hash/fnv"
+	"io"
+	"sort"
+)
+
+var READ_INDEX_MAGIC = []byte("MGRIDS2\n")
+
+// version 1 keyed records on their header up to first whitespace
+var READ_INDEX_MAGIC_V1 = []byte("MGRIDS1\n")
+var ErrReadIndexVersion = errors.New("read index of older version")
+
+// entries allocated up front, count in file is not trusted beyond it
+var READ_INDEX_PREALLOC = 1 << 20
+
+// read position in numbered file, by hash of its key
+type ReadEntry struct {
+	Hash   uint64
+	Record uint32
+}
+
+// sorted read keys of one numbered file. only hashes are kept, a match
+// is confirmed by reading the record.
+type ReadIndex struct {
+	Entries []ReadEntry
+	sorted  bool
+}
+
+func NewReadIndex() *ReadIndex {
+	return &ReadIndex{sorted: true}
+}
+
+// key of record is its whole header line, header or record may be given
+func ReadKey(header []byte) []byte {
+	header = bytes.TrimPrefix(header, []byte{'>'})
+	if i := bytes.IndexByte(header, '\n'); i >= 0 {
+		header = header[:i]
+	}
+	return bytes.TrimRight(header, " \t\r")
+}
+
+func ReadHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+func (ri *ReadIndex) Add(key []byte, rec int) {
+	ri.Entries = append(ri.Entries, ReadEntry{Hash: ReadHash(key), Record: uint32(rec)})
+	ri.sorted = false
+}
+
+func (ri *ReadIndex) Len() int {
+	return len(ri.Entries)
+}
+
+func (ri *ReadIndex) sort() {
+	if ri.sorted {
+		return
+	}
+	sort.Slice(ri.Entries, func(i, j int) bool {
+		if ri.Entries[i].Hash == ri.Entries[j].Hash {
+			return ri.Entries[i].Record < ri.Entries[j].Record
+		}
+		return ri.Entries[i].Hash < ri.Entries[j].Hash
+	})
+	ri.sorted = true
+}
+
+// drop records after last
+func (ri *ReadIndex) Truncate(last int) {
+	kept := ri.Entries[:0]
+	for _, e := range ri.Entries {
+		if int(e.Record) <= last {
+			kept = append(kept, e)
+		}
+	}
+	ri.Entries = kept
+}
+
+// record numbers with hash of key
+func (ri *ReadIndex) Find(key []byte) (recs []int) {
+	ri.sort()
+	h := ReadHash(key)
+	n := sort.Search(len(ri.Entries), func(i int) bool { return ri.Entries[i].Hash >= h })
+	for ; (n < len(ri.Entries)) && (ri.Entries[n].Hash == h); n++ {
+		recs = append(recs, int(ri.Entries[n].Record))
+	}
+	return
+}
+
+// gzip of magic, entry count and fixed size entries in hash order
+func (ri *ReadIndex) Save(fs storage.Storage, name string) (err error) {
+	ri.sort()
+	fh, err := fs.Create(name)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			fh.Close()
+		}
+	}()
+	gw := gzip.NewWriter(fh)
+	bw := bufio.NewWriter(gw)
+	bw.Write(READ_INDEX_MAGIC)
+	var buf [12]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(len(ri.Entries)))
+	bw.Write(buf[:8])
+	for _, e := range ri.Entries {
+		binary.BigEndian.PutUint64(buf[:8], e.Hash)
+		binary.BigEndian.PutUint32(buf[8:], e.Record)
+		if _, err = bw.Write(buf[:]); err != nil {
+			return
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		return
+	}
+	if err = gw.Close(); err != nil {
+		return
+	}
+	err = fh.Close()
+	return
+}
+
+func LoadReadIndex(fs storage.Storage, name string) (ri *ReadIndex, err error) {
+	fh, err := fs.Open(name)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	gr, err := gzip.NewReader(fh)
+	if err != nil {
+		return
+	}
+	br := bufio.NewReader(gr)
+	head := make([]byte, len(READ_INDEX_MAGIC)+8)
+	if _, err = io.ReadFull(br, head); err != nil {
+		return
+	}
+	if err = checkReadIndexMagic(fs, name, head); err != nil {
+		return
+	}
+	count := binary.BigEndian.Uint64(head[len(READ_INDEX_MAGIC):])
+	prealloc := count
+	if prealloc > uint64(READ_INDEX_PREALLOC) {
+		prealloc = uint64(READ_INDEX_PREALLOC)
+	}
+	ri = &ReadIndex{Entries: make([]ReadEntry, 0, prealloc), sorted: true}
+	var buf [12]byte
+	for i := uint64(0); i < count; i++ {
+		if _, err = io.ReadFull(br, buf[:]); err != nil {
+			err = fmt.Errorf("read index %s is truncated: %s", fs.Location(name), err.Error())
+			return
+		}
+		ri.Entries = append(ri.Entries, ReadEntry{Hash: binary.BigEndian.Uint64(buf[:8]), Record: binary.BigEndian.Uint32(buf[8:])})
+	}
+	return
+}
+
+// read index file is of current version, without loading its entries
+func CheckReadIndex(fs storage.Storage, name string) (err error) {
+	fh, err := fs.Open(name)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	gr, err := gzip.NewReader(fh)
+	if err != nil {
+		return
+	}
+	head := make([]byte, len(READ_INDEX_MAGIC))
+	if _, err = io.ReadFull(gr, head); err != nil {
+		return
+	}
+	err = checkReadIndexMagic(fs, name, head)
+	return
+}
+
+func checkReadIndexMagic(fs storage.Storage, name string, head []byte) error {
+	if bytes.Equal(head[:len(READ_INDEX_MAGIC_V1)], READ_INDEX_MAGIC_V1) {
+		return ErrReadIndexVersion
+	}
+	if !bytes.Equal(head[:len(READ_INDEX_MAGIC)], READ_INDEX_MAGIC) {
+		return fmt.Errorf("%s is not a read index", fs.Location(name))
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package index
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/storage"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadKey(t *testing.T) {
+	tests := map[string]string{
+		"mgp1|mgm1.3|read_1":                    "mgp1|mgm1.3|read_1",
+		">mgp1|mgm1.3|read_1 len=8\nACGTACGT\n": "mgp1|mgm1.3|read_1 len=8",
+		"mgp1|mgm1.3|read 1\tpaired\r\n":        "mgp1|mgm1.3|read 1\tpaired",
+	}
+	for header, key := range tests {
+		if got := string(ReadKey([]byte(header))); got != key {
+			t.Errorf("key of %q is %q, expected %q", header, got, key)
+		}
+	}
+}
+
+func TestReadIndexSaveLoad(t *testing.T) {
+	fs, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ri := NewReadIndex()
+	headers := []string{"mgp1|mgm1.3|read_1 len=8", "mgp1|mgm1.3|read_1 len=9", "mgp1|mgm1.3|read_2", "mgp1|mgm1.3|read_3"}
+	for n, h := range headers {
+		ri.Add(ReadKey([]byte(h)), n+1)
+	}
+	// mate under record of its read
+	ri.Add([]byte("mgp1|mgm1.3|read_3/2"), 4)
+	if err = ri.Save(fs, "1.ids.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckReadIndex(fs, "1.ids.gz"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadReadIndex(fs, "1.ids.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Entries, ri.Entries) {
+		t.Errorf("loaded %v, saved %v", loaded.Entries, ri.Entries)
+	}
+	lookups := map[string][]int{
+		"mgp1|mgm1.3|read_1 len=8": {1},
+		"mgp1|mgm1.3|read_1 len=9": {2},
+		"mgp1|mgm1.3|read_3/2":     {4},
+		"mgp1|mgm1.3|read_1":       nil,
+		"mgp1|mgm1.3|read_4":       nil,
+	}
+	for key, recs := range lookups {
+		if got := loaded.Find([]byte(key)); !reflect.DeepEqual(got, recs) {
+			t.Errorf("lookup %s found %v, expected %v", key, got, recs)
+		}
+	}
+}
+
+func writeGzip(t *testing.T, fs storage.Storage, name string, data []byte) {
+	fh, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(fh)
+	gw.Write(data)
+	gw.Close()
+	if err = fh.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadReadIndexInvalid(t *testing.T) {
+	fs, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := make([]byte, 8)
+	binary.BigEndian.PutUint64(count, 1)
+	writeGzip(t, fs, "magic.ids.gz", append([]byte("NOTANIDX"), count...))
+	writeGzip(t, fs, "v1.ids.gz", append(append([]byte{}, READ_INDEX_MAGIC_V1...), count...))
+	// count far beyond entries in file is not allocated up front
+	binary.BigEndian.PutUint64(count, 1<<60)
+	writeGzip(t, fs, "count.ids.gz", append(append([]byte{}, READ_INDEX_MAGIC...), append(count, bytes.Repeat([]byte{1}, 24)...)...))
+
+	if _, err = LoadReadIndex(fs, "magic.ids.gz"); (err == nil) || !strings.Contains(err.Error(), "is not a read index") {
+		t.Errorf("bad magic loaded: %v", err)
+	}
+	if _, err = LoadReadIndex(fs, "v1.ids.gz"); err != ErrReadIndexVersion {
+		t.Errorf("older version loaded: %v", err)
+	}
+	if err = CheckReadIndex(fs, "v1.ids.gz"); err != ErrReadIndexVersion {
+		t.Errorf("older version checked: %v", err)
+	}
+	if _, err = LoadReadIndex(fs, "count.ids.gz"); (err == nil) || !strings.Contains(err.Error(), "is truncated") {
+		t.Errorf("truncated index loaded: %v", err)
+	}
+}
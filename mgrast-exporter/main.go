@@ -1,21 +1,44 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/config"
 	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/exporter"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/file"
+	"github.com/MG-RAST/MG-RAST-exporter/mgrast-exporter/index"
 	"net/url"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var exportDirDefault = os.Getenv("EXPORT_DIR")
 var shockUrlDefault = os.Getenv("SHOCK_URL")
-var fileSizeDefault = int64(2)
-var stageNameDefault = "screen"
+var s3EndpointDefault = os.Getenv("S3_ENDPOINT")
+var configDefault = os.Getenv("EXPORT_CONFIG")
+var fileSizeDefault = exporter.SIZE_DEFAULT
+var stageNameDefault = exporter.STAGE_DEFAULT
+var headerTemplateDefault = file.DEFAULT_HEADER_TEMPLATE
 
 var flags *flag.FlagSet
 
+// options with a default from environment, it comes before config file
+var envOptions = map[string]string{
+	"directory":   "EXPORT_DIR",
+	"shock":       "SHOCK_URL",
+	"s3-endpoint": "S3_ENDPOINT",
+	"config":      "EXPORT_CONFIG",
+}
+
+// options that can not be set in config file
+var noConfig = map[string]bool{"config": true, "config-profile": true, "help": true}
+
 func usage() {
 	fmt.Fprintf(os.Stdout, fmt.Sprintf("\nUsage: %s command [options]\n", os.Args[0]))
 	fmt.Fprintf(
@@ -23,53 +46,264 @@ func usage() {
 		"\n"+
 			"Commands:\n"+
 			"\n"+
-			"  export --directory [--project --size --stage]\n"+
+			"  export --directory [--project --target --paired --size --stage --seq-type --wrap --header-template --compress-threads --profile]\n"+
+			"         [--alphabet --min-length --max-length --replace-invalid --no-validate --no-metadata]\n"+
+			"         [--sample-fraction --max-reads-per-metagenome --seed]\n"+
+			"         [--dedup --dedup-scope --dedup-memory --read-index --on-error --retry-failed]\n"+
+			"         [--timeout --node-timeout --idle-timeout]\n"+
 			"           Export compressed files from MG-RAST object store.\n"+
 			"           All or single project, from a given pipeline stage.\n"+
+			"           With a list of stages (--stage screen,upload) nodes are listed once and\n"+
+			"           each stage is exported to its own subdirectory, with a manifest of\n"+
+			"           metagenomes across stages (stages.json, stages.tsv).\n"+
+			"           Protein stages (genecalling, protein.filter, cluster.aa90) are exported\n"+
+			"           as .faa.gz with an amino acid alphabet, other stages as nucleotide .fasta.gz.\n"+
+			"           Records failing validation are written to a rejects file.\n"+
+			"           Shock attributes of metagenomes are written to <project>.metadata.jsonl\n"+
+			"           and .tsv, linked from the project index.\n"+
+			"           With sampling only a reproducible subset of each metagenome is exported.\n"+
+			"           With dedup exact or reverse complement duplicate sequences are dropped,\n"+
+			"           pairs by both mates, with reverse complement also with mates swapped.\n"+
+			"           Per metagenome counts of each run are written to a report file.\n"+
+			"           Target blastdb-fasta writes uncompressed files ready for makeblastdb or\n"+
+			"           diamond makedb, with accession headers <project>_<metagenome>_<n>\n"+
+			"           (dot of metagenome ID as _, e.g. mgp1_mgm4447943_3_1) numbered per\n"+
+			"           metagenome, a taxid map (blastdb.taxid_map.txt) and a metagenome table.\n"+
+			"           With read index a sorted index of record IDs is kept next to each file.\n"+
+			"           With paired layout mates of R1 / R2 nodes (mate attribute or file name)\n"+
+			"           or of /1 /2 read IDs are kept together: interleaved in the numbered files,\n"+
+			"           or split into parallel N_R1 / N_R2 files of pairs only that rotate together.\n"+
+			"           The index counts pairs per metagenome.\n"+
+			"           Failed nodes and records are kept in a failure ledger (failures.json).\n"+
+			"           With --on-error skip the export leaves them out and goes on, with fail\n"+
+			"           it stops. A failed file write always stops the export.\n"+
+			"           With --retry-failed only projects in the ledger are exported\n"+
+			"           again, after cleaning up and removing their earlier export.\n"+
+			"           Export stops on interrupt or once --timeout is over, a node fails once\n"+
+			"           --node-timeout is over or no data came within --idle-timeout. A stopped\n"+
+			"           export is cleaned back to its last finished project and resumes there.\n"+
 			"  clean  --directory\n"+
 			"           Remove any files not in index list and prune last index end file.\n"+
 			"           Used to cleanup after interrupted export.\n"+
-			"  remove --directory [--count]\n"+
+			"  remove --directory [--count --compress-threads]\n"+
 			"           Remove <count> number indexes from end of index list.\n"+
 			"           Remove their files and prune last index file.\n"+
-			"  index  --directory [--force]\n"+
-			"           Rebuilds export index if missing.\n",
+			"  remove --directory --project [--tombstone]\n"+
+			"           Remove single project, rewrite its files and renumber the rest.\n"+
+			"           With tombstone only mark it removed, records are dropped on repack.\n"+
+			"  repack --directory [--size]\n"+
+			"           Rewrite export set into files of uniform size with new index.\n"+
+			"           Drops removed projects. Resumes if interrupted, verifies before replacing.\n"+
+			"           A repack stopped while replacing the directory is finished by clean.\n"+
+			"  diff   --directory --against | --listing | --shock [--project --idle-timeout]\n"+
+			"           Report added, removed and changed projects and metagenomes against\n"+
+			"           an older index (file or directory) or a shock node listing.\n"+
+			"           A shock query stops on interrupt or with no response within --idle-timeout.\n"+
+			"  bundle --directory --output [--volume-size]\n"+
+			"           Write complete export set as deterministic tar (.tar, .tar.gz or .tgz) with\n"+
+			"           index, checksum manifest and summary. Split in volumes if size given.\n"+
+			"  index  --directory [--force --header-template --seq-type --profile --backend]\n"+
+			"           Rebuilds export index if missing.\n"+
+			"           Compression profile of an existing index is kept.\n"+
+			"           Header template must match the one used for export.\n"+
+			"  index convert --directory --backend\n"+
+			"           Move export index to given backend.\n"+
+			"  index ids --directory\n"+
+			"           Build missing read indexes of export files, rebuild those of older versions.\n"+
+			"  list   --directory [--project --metagenome --file --output]\n"+
+			"           List indexes, all or matching given project, metagenome or file number.\n"+
+			"  extract --directory --project | --metagenome [--output]\n"+
+			"          [--sample-fraction --max-reads-per-metagenome --seed]\n"+
+			"           Write records of project or metagenome as fasta, to stdout if no output.\n"+
+			"  lookup --directory [--output] ID... | -\n"+
+			"           Print file, record number and sequence of reads, IDs after options or\n"+
+			"           one per line from stdin. An ID is the whole record header, or\n"+
+			"           metagenome|id if the header template has project first.\n"+
+			"           Files without read index are read in full.\n"+
+			"  serve  --directory [--listen]\n"+
+			"           Serve export set over http: index as json (/index, /projects,\n"+
+			"           /metagenomes/<id>, /files), numbered files and metadata sidecars with\n"+
+			"           range requests (/files/<name>) and records of a project or metagenome\n"+
+			"           as fasta (/projects/<id>/fasta, /metagenomes/<id>/fasta).\n"+
+			"  config show [--config --config-profile]\n"+
+			"           Print effective value of each option and where it is set: flag,\n"+
+			"           environment, config file or default.\n",
+	)
+	fmt.Fprintf(
+		os.Stdout,
+		"\n"+
+			"Export settings (target, paired layout, stage, sequence type, size, wrap, header-template, profile, shock, sampling) are stored\n"+
+			"in the index. If not given they are read from it, if given they must match it.\n"+
+			"New export sets use the given index backend, json if not set.\n"+
+			"\n"+
+			"The directory may be an s3 bucket prefix (s3://bucket/prefix) on AWS or any\n"+
+			"s3 compatible endpoint. Credentials are read from AWS_ACCESS_KEY_ID and\n"+
+			"AWS_SECRET_ACCESS_KEY, or MINIO_ROOT_USER and MINIO_ROOT_PASSWORD.\n"+
+			"Repack and the sqlite index backend need a local directory.\n"+
+			"\n"+
+			"Options of any command can be kept in a config file (--config, .yaml, .toml\n"+
+			"or .json) with option names as keys. Top level settings apply to all named\n"+
+			"profiles under \"profiles\", --config-profile selects one of them, e.g.:\n"+
+			"\n"+
+			"  shock: https://shock.mg-rast.org\n"+
+			"  profiles:\n"+
+			"    public-screen:\n"+
+			"      directory: /data/export/screen\n"+
+			"      stage: screen\n"+
+			"      min-length: 50\n"+
+			"      size: 10\n"+
+			"      profile: archival\n"+
+			"      paired: interleaved\n"+
+			"\n"+
+			"Flags come before environment variables, and those before the config file.\n",
 	)
 	fmt.Fprintf(os.Stdout, fmt.Sprintf("\nOptions:\n\n"))
 	flags.PrintDefaults()
-	fmt.Fprintf(os.Stdout, fmt.Sprintf("\nEnvironment variables that can be used: EXPORT_DIR, SHOCK_URL\n\n"))
+	fmt.Fprintf(os.Stdout, fmt.Sprintf("\nEnvironment variables that can be used: EXPORT_DIR, SHOCK_URL, S3_ENDPOINT, EXPORT_CONFIG\n\n"))
 }
 
 func main() {
 	var exportDir string
 	var shockUrl string
+	var s3Endpoint string
 	var projectID string
+	var metagenomeID string
+	var fileNum int
+	var output string
+	var backend string
+	var against string
+	var volumeSize int64
+	var listing string
+	var listen string
+	var target string
+	var paired string
+	var seqType string
 	var stageName string
 	var fileSize int64
+	var wrap int
+	var compressThreads int
+	var profileName string
+	var headerTemplate string
+	var alphabet string
+	var minLength int
+	var maxLength int
+	var replaceInvalid bool
+	var noValidate bool
+	var noMetadata bool
+	var sampleFraction float64
+	var maxReads int
+	var seed int64
+	var dedup string
+	var dedupScope string
+	var dedupMemory int
+	var readIndex bool
+	var onError string
+	var retryFailed bool
+	var timeout time.Duration
+	var nodeTimeout time.Duration
+	var idleTimeout time.Duration
 	var count int
 	var force bool
+	var tombstone bool
 	var debug bool
 	var help bool
+	var configPath string
+	var configProfile string
 	var err error
 
 	flags = flag.NewFlagSet("name", flag.ContinueOnError)
 
-	flags.StringVar(&exportDir, "directory", exportDirDefault, "export directory path")
+	flags.StringVar(&exportDir, "directory", exportDirDefault, "export directory path, or s3://bucket/prefix")
 	flags.StringVar(&shockUrl, "shock", shockUrlDefault, "url of Shock server")
+	flags.StringVar(&s3Endpoint, "s3-endpoint", s3EndpointDefault, "url of s3 compatible server (default AWS)")
 	flags.StringVar(&projectID, "project", "", "project ID to export")
-	flags.StringVar(&stageName, "stage", stageNameDefault, "pipeline stage name for export file")
+	flags.StringVar(&metagenomeID, "metagenome", "", "metagenome ID to list or extract")
+	flags.IntVar(&fileNum, "file", 0, "export file number to list")
+	flags.StringVar(&output, "output", "", "output file path for list, extract and diff (default stdout), or bundle")
+	flags.StringVar(&backend, "backend", "", fmt.Sprintf("index backend, one of: %s", strings.Join(index.BACKENDS, ", ")))
+	flags.Int64Var(&volumeSize, "volume-size", 0, "bundle volume size in GB, 0 is a single volume")
+	flags.StringVar(&against, "against", "", "older index file or export directory to diff against")
+	flags.StringVar(&listing, "listing", "", "json file of shock nodes to diff against")
+	flags.StringVar(&listen, "listen", exporter.SERVE_ADDR_DEFAULT, "address for serve to listen on")
+	flags.StringVar(&target, "target", "", fmt.Sprintf("export layout, one of: %s (default %s, or as stored in index)", strings.Join(exporter.TARGETS, ", "), exporter.TARGET_DEFAULT))
+	flags.StringVar(&paired, "paired", "", fmt.Sprintf("read pair layout, one of: %s (default %s, or as stored in index)", strings.Join(exporter.PAIRED_LAYOUTS, ", "), exporter.PAIRED_NONE))
+	flags.StringVar(&stageName, "stage", stageNameDefault, "pipeline stage name for export file, comma separated list for export of several")
+	flags.StringVar(&seqType, "seq-type", "", fmt.Sprintf("sequence type, one of: %s (default by stage, or as stored in index)", strings.Join(file.SeqTypeNames(), ", ")))
 	flags.Int64Var(&fileSize, "size", fileSizeDefault, "export file size in GB")
+	flags.IntVar(&wrap, "wrap", 0, "wrap sequence lines at N columns, 0 is no wrapping")
+	flags.IntVar(&compressThreads, "compress-threads", 1, "number of threads for gzip compression")
+	flags.StringVar(&profileName, "profile", "", fmt.Sprintf("compression profile, one of: %s (default %s, or as stored in index)", strings.Join(file.ProfileNames(), ", "), file.DEFAULT_PROFILE))
+	flags.StringVar(&headerTemplate, "header-template", headerTemplateDefault, "record header template, fields: {project} {metagenome} {id} {len}")
+	flags.StringVar(&alphabet, "alphabet", "", "allowed sequence characters (default IUPAC nucleotides or amino acids, by sequence type)")
+	flags.IntVar(&minLength, "min-length", 1, "minimum sequence length")
+	flags.IntVar(&maxLength, "max-length", 0, "maximum sequence length, 0 is unlimited")
+	flags.BoolVar(&replaceInvalid, "replace-invalid", false, "replace invalid characters with N (X for protein) instead of rejecting record")
+	flags.BoolVar(&noValidate, "no-validate", false, "skip sequence validation")
+	flags.BoolVar(&noMetadata, "no-metadata", false, "do not write metadata sidecar files on export")
+	flags.Float64Var(&sampleFraction, "sample-fraction", 0, "keep this fraction (0 to 1) of records, 0 is no sampling")
+	flags.IntVar(&maxReads, "max-reads-per-metagenome", 0, "keep at most N records per metagenome, 0 is unlimited")
+	flags.Int64Var(&seed, "seed", 0, "seed for sampling, same seed keeps same records")
+	flags.StringVar(&dedup, "dedup", "", fmt.Sprintf("drop duplicate sequences, one of: %s", strings.Join(file.DEDUP_MODES, ", ")))
+	flags.StringVar(&dedupScope, "dedup-scope", "metagenome", "find duplicates within: metagenome, project")
+	flags.IntVar(&dedupMemory, "dedup-memory", 256, "memory in MB for duplicate detection, more is fewer false duplicates")
+	flags.BoolVar(&readIndex, "read-index", false, "keep index of record IDs next to each export file, for lookup")
+	flags.StringVar(&onError, "on-error", exporter.POLICY_FAIL, fmt.Sprintf("on failed node or record, one of: %s", strings.Join(exporter.POLICIES, ", ")))
+	flags.BoolVar(&retryFailed, "retry-failed", false, "export again projects in failure ledger")
+	flags.DurationVar(&timeout, "timeout", 0, "stop export after this time, e.g. 12h, 0 is no deadline")
+	flags.DurationVar(&nodeTimeout, "node-timeout", 0, "fail node of metagenome not downloaded within this time, 0 is no timeout")
+	flags.DurationVar(&idleTimeout, "idle-timeout", 0, "fail shock call or stream with no data within this time, 0 is no timeout")
 	flags.IntVar(&count, "count", 1, "number of indexes to remove, in reverse order of creation")
+	flags.BoolVar(&tombstone, "tombstone", false, "mark project removed in index instead of rewriting files")
 	flags.BoolVar(&force, "force", false, "force build index if already exists")
 	flags.BoolVar(&debug, "debug", false, "print debug messages")
 	flags.BoolVar(&help, "help", false, "this message")
+	flags.StringVar(&configPath, "config", configDefault, fmt.Sprintf("config file of options, one of: %s", strings.Join(config.FORMATS, ", ")))
+	flags.StringVar(&configProfile, "config-profile", "", "named profile of config file, top level settings only if not set")
 
 	if len(os.Args) < 2 {
 		flags.Parse(os.Args)
 		usage()
 		os.Exit(1)
 	}
-	flags.Parse(os.Args[2:])
+	// commands may have a subcommand before options
+	args := os.Args[2:]
+	subcommand := ""
+	if (len(args) > 0) && !strings.HasPrefix(args[0], "-") {
+		subcommand = args[0]
+		args = args[1:]
+	}
+	flags.Parse(args)
+
+	// config settings fill in options not given by flag or environment
+	source := optionSources()
+	if configPath != "" {
+		err = applyConfig(configPath, configProfile, source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	} else if configProfile != "" {
+		fmt.Fprintf(os.Stderr, "config profile given without config file\n")
+		os.Exit(1)
+	}
+	if os.Args[1] == "config" {
+		if subcommand != "show" {
+			fmt.Fprintf(os.Stderr, fmt.Sprintf("\"%s\" unknown config command \n", subcommand))
+			os.Exit(1)
+		}
+		showConfig(source)
+		os.Exit(0)
+	}
+
+	// settings stored in index metadata are only checked if given
+	isSet := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { isSet[f.Name] = true })
+	if !isSet["stage"] {
+		stageName = ""
+	}
+	if !isSet["size"] {
+		fileSize = 0
+	}
 
 	if os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "-help" {
 		help = true
@@ -92,11 +326,68 @@ func main() {
 		fmt.Fprintf(os.Stderr, fmt.Sprintf("export directory must be set\n"))
 		os.Exit(1)
 	}
-	fmt.Fprintf(os.Stdout, fmt.Sprintf("export dir path: %s\n", exportDir))
-	os.MkdirAll(exportDir, 0777)
-
-	exportTool := exporter.NewExporter(exportDir, stageName, fileSize, debug)
 	command := os.Args[1]
+	if ((command != "extract") && (command != "lookup")) || (output != "") {
+		fmt.Fprintf(os.Stdout, fmt.Sprintf("export dir path: %s\n", exportDir))
+	}
+
+	opts := exporter.NewOptions()
+	opts.Path = exportDir
+	opts.Stage = stageName
+	opts.Size = fileSize
+	opts.Debug = debug
+	opts.S3Endpoint = s3Endpoint
+	if isSet["header-template"] {
+		opts.Header, err = file.NewHeaderFormat(headerTemplate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, fmt.Sprintf("invalid header template: %s\n", err.Error()))
+			os.Exit(1)
+		}
+	}
+	if isSet["wrap"] {
+		opts.Wrap = wrap
+	}
+	if compressThreads > 1 {
+		opts.Threads = compressThreads
+	}
+	if profileName != "" {
+		opts.Profile, err = file.GetProfile(profileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	opts.Backend = backend
+	if seqType != "" {
+		opts.SeqType, err = file.GetSeqType(seqType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	opts.Target = target
+	opts.Paired = paired
+	if (sampleFraction < 0) || (sampleFraction > 1) || (maxReads < 0) {
+		fmt.Fprintf(os.Stderr, "sample fraction must be between 0 and 1, max reads can not be negative\n")
+		os.Exit(1)
+	}
+	if (sampleFraction > 0) || (maxReads > 0) {
+		opts.Sample = &file.Sampling{Fraction: sampleFraction, MaxReads: maxReads, Seed: seed}
+	}
+
+	exportTool := exporter.New(opts)
+
+	// list and extract output
+	outHandle := os.Stdout
+	if (output != "") && (command != "bundle") {
+		outHandle, err = os.Create(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, fmt.Sprintf("unable to create output file %s: %s\n", output, err.Error()))
+			os.Exit(1)
+		}
+		defer outHandle.Close()
+	}
+	query := index.Query{Project: projectID, Metagenome: metagenomeID, File: fileNum}
 
 	switch command {
 	case "export":
@@ -120,13 +411,52 @@ func main() {
 		} else {
 			fmt.Fprintf(os.Stdout, "exporting all projects\n")
 		}
+		if !noValidate {
+			exportTool.Valid = file.NewValidator(alphabet, minLength, maxLength, replaceInvalid)
+		}
+		exportTool.Metadata = !noMetadata
+		exportTool.ReadIndex = readIndex
+		if dedup != "" {
+			if (dedupScope != "metagenome") && (dedupScope != "project") {
+				fmt.Fprintf(os.Stderr, fmt.Sprintf("unknown dedup scope %s, must be metagenome or project\n", dedupScope))
+				os.Exit(1)
+			}
+			exportTool.Dedup, err = file.NewDedup(dedup, dedupMemory)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			exportTool.DedupScope = dedupScope
+		}
 		// init and run
 		err = exportTool.Init(projectID, shockHost.String())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, fmt.Sprintf("unable to initalize exporter: %s\n", shockUrl, err.Error()))
 			os.Exit(1)
 		}
-		err = exportTool.Export()
+		exportTool.OnError = onError
+		exportTool.NodeTimeout = nodeTimeout
+		exportTool.IdleTimeout = idleTimeout
+		// interrupt or deadline stops export, it resumes on next run
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		stages := strings.Split(stageName, ",")
+		if retryFailed && (len(stages) > 1) {
+			fmt.Fprintf(os.Stderr, "retry of failed projects is run per stage directory, not for several stages\n")
+			os.Exit(1)
+		}
+		if retryFailed {
+			err = exportTool.RetryFailed(ctx)
+		} else if len(stages) > 1 {
+			err = exportTool.ExportStages(ctx, stages)
+		} else {
+			err = exportTool.Export(ctx)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
 			os.Exit(1)
@@ -140,14 +470,112 @@ func main() {
 		}
 		break
 	case "remove":
-		err = exportTool.Remove(count)
+		if projectID != "" {
+			err = exportTool.RemoveProject(projectID, tombstone)
+		} else {
+			err = exportTool.Remove(count)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		break
+	case "diff":
+		if (against == "") && (listing == "") && (shockUrl != "") {
+			shockHost, err := url.Parse(shockUrl)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, fmt.Sprintf("shock url %s cannot be parsed: %s\n", shockUrl, err.Error()))
+				os.Exit(1)
+			}
+			if shockHost.Scheme == "" {
+				shockHost.Scheme = "http"
+			}
+			exportTool.Init(projectID, shockHost.String())
+		}
+		exportTool.IdleTimeout = idleTimeout
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = exportTool.Diff(ctx, against, listing, outHandle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		break
+	case "bundle":
+		err = exportTool.Bundle(output, volumeSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		break
+	case "repack":
+		err = exportTool.Repack(fileSize)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
 			os.Exit(1)
 		}
 		break
 	case "index":
-		err = exportTool.Index(force)
+		if subcommand == "convert" {
+			if backend == "" {
+				fmt.Fprintf(os.Stderr, "backend must be set for index convert\n")
+				os.Exit(1)
+			}
+			exportTool.Backend = ""
+			err = exportTool.ConvertIndex(backend)
+		} else if subcommand == "ids" {
+			err = exportTool.IndexReads()
+		} else if subcommand != "" {
+			fmt.Fprintf(os.Stderr, fmt.Sprintf("\"%s\" unknown index command \n", subcommand))
+			os.Exit(1)
+		} else {
+			err = exportTool.Index(force)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		break
+	case "list":
+		err = exportTool.List(query, outHandle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		break
+	case "extract":
+		err = exportTool.Extract(query, outHandle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		break
+	case "lookup":
+		// first ID is taken as subcommand
+		var ids []string
+		if subcommand != "" {
+			ids = append(ids, subcommand)
+		}
+		for _, id := range flags.Args() {
+			if id != "-" {
+				ids = append(ids, id)
+				continue
+			}
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" {
+					ids = append(ids, line)
+				}
+			}
+		}
+		err = exportTool.Lookup(ids, outHandle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		break
+	case "serve":
+		err = exportTool.Serve(listen)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
 			os.Exit(1)
@@ -162,3 +590,65 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// options given by flag or environment, flags first
+func optionSources() map[string]string {
+	source := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) { source[f.Name] = "flag" })
+	for name, env := range envOptions {
+		if (source[name] == "") && (os.Getenv(env) != "") {
+			source[name] = "env " + env
+		}
+	}
+	return source
+}
+
+// set options from config file and profile, source records where each is from
+func applyConfig(path string, profile string, source map[string]string) (err error) {
+	conf, err := config.Load(path)
+	if err != nil {
+		return
+	}
+	settings, err := conf.Resolve(profile)
+	if err != nil {
+		return
+	}
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if (flags.Lookup(name) == nil) || noConfig[name] {
+			err = fmt.Errorf("unknown option %s in config %s", name, path)
+			return
+		}
+		if source[name] != "" {
+			continue
+		}
+		if err = flags.Set(name, settings[name]); err != nil {
+			err = fmt.Errorf("option %s in config %s: %s", name, path, err.Error())
+			return
+		}
+		source[name] = "config " + path
+		if _, ok := conf.Profiles[profile][name]; ok {
+			source[name] = fmt.Sprintf("config %s, profile %s", path, profile)
+		}
+	}
+	return
+}
+
+// effective options, in name order
+func showConfig(source map[string]string) {
+	fmt.Fprintf(os.Stdout, "option\tvalue\tsource\n")
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "help" {
+			return
+		}
+		from := source[f.Name]
+		if from == "" {
+			from = "default"
+		}
+		fmt.Fprintf(os.Stdout, "%s\t%s\t%s\n", f.Name, f.Value.String(), from)
+	})
+}
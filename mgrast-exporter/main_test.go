@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// options are taken from flag, then environment, then config profile,
+// then config top level
+func TestConfigPrecedence(t *testing.T) {
+	t.Setenv("EXPORT_DIR", "/env/export")
+	t.Setenv("SHOCK_URL", "")
+	path := filepath.Join(t.TempDir(), "export.yaml")
+	conf := "directory: /top/export\nshock: http://top\nstage: top\nsize: 100\n" +
+		"profiles:\n  nightly:\n    directory: /profile/export\n    shock: http://profile\n    stage: profile\n    threads: 8\n"
+	if err := ioutil.WriteFile(path, []byte(conf), 0666); err != nil {
+		t.Fatal(err)
+	}
+	flags = flag.NewFlagSet("name", flag.ContinueOnError)
+	var dir, shock, stage, s3 string
+	var size, threads int
+	flags.StringVar(&dir, "directory", os.Getenv("EXPORT_DIR"), "")
+	flags.StringVar(&shock, "shock", os.Getenv("SHOCK_URL"), "")
+	flags.StringVar(&s3, "s3-endpoint", os.Getenv("S3_ENDPOINT"), "")
+	flags.StringVar(&stage, "stage", "", "")
+	flags.IntVar(&size, "size", 0, "")
+	flags.IntVar(&threads, "threads", 1, "")
+	if err := flags.Parse([]string{"-stage", "flag"}); err != nil {
+		t.Fatal(err)
+	}
+	source := optionSources()
+	if err := applyConfig(path, "nightly", source); err != nil {
+		t.Fatal(err)
+	}
+	profile := "config " + path + ", profile nightly"
+	expected := map[string][2]string{
+		"stage":     {"flag", "flag"},
+		"directory": {"/env/export", "env EXPORT_DIR"},
+		"shock":     {"http://profile", profile},
+		"threads":   {"8", profile},
+		"size":      {"100", "config " + path},
+	}
+	for name, e := range expected {
+		if value := flags.Lookup(name).Value.String(); (value != e[0]) || (source[name] != e[1]) {
+			t.Errorf("option %s is %s from %s, expected %s from %s", name, value, source[name], e[0], e[1])
+		}
+	}
+	if source["s3-endpoint"] != "" {
+		t.Errorf("unset option from %s", source["s3-endpoint"])
+	}
+}
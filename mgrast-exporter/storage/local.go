@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// export set in a local directory
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) (s *LocalStorage, err error) {
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return
+	}
+	s = &LocalStorage{dir: dir}
+	return
+}
+
+func (s *LocalStorage) Name() string {
+	return "local"
+}
+
+func (s *LocalStorage) Location(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// matching names in lexical order
+func (s *LocalStorage) List(pattern string) (names []string, err error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, pattern))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	return
+}
+
+func (s *LocalStorage) Exists(name string) bool {
+	_, err := os.Stat(s.Location(name))
+	return err == nil
+}
+
+func (s *LocalStorage) Size(name string) (size int64, err error) {
+	info, err := os.Stat(s.Location(name))
+	if err != nil {
+		return
+	}
+	size = info.Size()
+	return
+}
+
+func (s *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.Location(name))
+}
+
+func (s *LocalStorage) Create(name string) (Writer, error) {
+	return s.openFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+}
+
+func (s *LocalStorage) Append(name string) (Writer, error) {
+	return s.openFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
+}
+
+func (s *LocalStorage) openFile(name string, flag int) (w Writer, err error) {
+	fh, err := os.OpenFile(s.Location(name), flag, 0666)
+	if err != nil {
+		return
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return
+	}
+	w = &localWriter{File: fh, size: info.Size()}
+	return
+}
+
+func (s *LocalStorage) Rename(from string, to string) error {
+	return os.Rename(s.Location(from), s.Location(to))
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	return os.Remove(s.Location(name))
+}
+
+func (s *LocalStorage) LocalDir() (string, bool) {
+	return s.dir, true
+}
+
+type localWriter struct {
+	*os.File
+	size int64
+}
+
+func (w *localWriter) Write(p []byte) (n int, err error) {
+	n, err = w.File.Write(p)
+	w.size += int64(n)
+	return
+}
+
+func (w *localWriter) Size() int64 {
+	return w.size
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var S3_ENDPOINT_DEFAULT = "https://s3.amazonaws.com"
+var S3_PART_SIZE uint64 = 16 * 1024 * 1024
+
+// export set under a prefix of an s3 compatible bucket.
+// credentials are read from AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY
+// or MINIO_ROOT_USER / MINIO_ROOT_PASSWORD.
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	ctx    context.Context
+}
+
+func NewS3Storage(location string, endpoint string) (s *S3Storage, err error) {
+	bucket, prefix, err := parseS3Location(location)
+	if err != nil {
+		return
+	}
+	if endpoint == "" {
+		endpoint = S3_ENDPOINT_DEFAULT
+	}
+	eurl, err := url.Parse(endpoint)
+	if err != nil {
+		return
+	}
+	if eurl.Host == "" {
+		// host:port without scheme
+		eurl = &url.URL{Scheme: "https", Host: endpoint}
+	}
+	client, err := minio.New(eurl.Host, &minio.Options{
+		Creds:  credentials.NewChainCredentials([]credentials.Provider{&credentials.EnvAWS{}, &credentials.EnvMinio{}}),
+		Secure: eurl.Scheme != "http",
+	})
+	if err != nil {
+		return
+	}
+	s = &S3Storage{client: client, bucket: bucket, prefix: prefix, ctx: context.Background()}
+	exists, err := client.BucketExists(s.ctx, bucket)
+	if err != nil {
+		err = fmt.Errorf("unable to access bucket %s at %s: %s", bucket, eurl.Host, err.Error())
+		return
+	}
+	if !exists {
+		err = fmt.Errorf("bucket %s does not exist at %s", bucket, eurl.Host)
+	}
+	return
+}
+
+// s3://bucket/some/prefix -> bucket, some/prefix
+func parseS3Location(location string) (bucket string, prefix string, err error) {
+	trimmed := strings.Trim(strings.TrimPrefix(location, S3_SCHEME), "/")
+	parts := strings.SplitN(trimmed, "/", 2)
+	bucket = parts[0]
+	if len(parts) > 1 {
+		prefix = parts[1]
+	}
+	if bucket == "" {
+		err = fmt.Errorf("s3 location %s has no bucket", location)
+	}
+	return
+}
+
+func (s *S3Storage) Name() string {
+	return "s3"
+}
+
+func (s *S3Storage) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *S3Storage) Location(name string) string {
+	return S3_SCHEME + path.Join(s.bucket, s.key(name))
+}
+
+// matching names in lexical order, only objects directly under prefix
+func (s *S3Storage) List(pattern string) (names []string, err error) {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	for obj := range s.client.ListObjects(s.ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			err = obj.Err
+			return
+		}
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if matched, _ := path.Match(pattern, name); matched {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+func (s *S3Storage) Exists(name string) bool {
+	_, err := s.client.StatObject(s.ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	return err == nil
+}
+
+func (s *S3Storage) Size(name string) (size int64, err error) {
+	info, err := s.client.StatObject(s.ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return
+	}
+	size = info.Size
+	return
+}
+
+func (s *S3Storage) Open(name string) (r io.ReadCloser, err error) {
+	obj, err := s.client.GetObject(s.ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return
+	}
+	// get is lazy, stat to fail on missing object here
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		return
+	}
+	r = obj
+	return
+}
+
+// streamed as multipart upload, object is complete on Close
+func (s *S3Storage) Create(name string) (Writer, error) {
+	return s.create(name), nil
+}
+
+func (s *S3Storage) create(name string) *s3Writer {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := s.client.PutObject(s.ctx, s.bucket, s.key(name), pr, -1, minio.PutObjectOptions{PartSize: S3_PART_SIZE})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+// objects can not be appended to, existing content is copied into the new upload first.
+// this downloads and uploads the whole object again, resuming into a large
+// numbered file costs its full size in transfer.
+func (s *S3Storage) Append(name string) (w Writer, err error) {
+	if !s.Exists(name) {
+		return s.Create(name)
+	}
+	r, err := s.Open(name)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	sw := s.create(name)
+	if _, err = io.Copy(sw, r); err != nil {
+		// upload is not completed, existing object stays
+		sw.abort(err)
+		return
+	}
+	w = sw
+	return
+}
+
+// server side copy, then delete source
+func (s *S3Storage) Rename(from string, to string) (err error) {
+	_, err = s.client.ComposeObject(
+		s.ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.key(to)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.key(from)},
+	)
+	if err != nil {
+		return
+	}
+	err = s.Delete(from)
+	return
+}
+
+func (s *S3Storage) Delete(name string) error {
+	return s.client.RemoveObject(s.ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) LocalDir() (string, bool) {
+	return "", false
+}
+
+type s3Writer struct {
+	pw     *io.PipeWriter
+	size   int64
+	done   chan error
+	closed bool
+	err    error
+}
+
+func (w *s3Writer) Write(p []byte) (n int, err error) {
+	n, err = w.pw.Write(p)
+	w.size += int64(n)
+	return
+}
+
+func (w *s3Writer) Size() int64 {
+	return w.size
+}
+
+// a plain eof from the pipe would complete the upload, so error is wrapped
+func (w *s3Writer) abort(err error) {
+	w.closed = true
+	w.pw.CloseWithError(fmt.Errorf("upload aborted: %s", err.Error()))
+	w.err = <-w.done
+}
+
+// finish upload and wait for it to complete, later calls return same result
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	w.pw.Close()
+	w.err = <-w.done
+	return w.err
+}
@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-process s3 server with path style buckets, enough for the minio client
+type fakeS3 struct {
+	sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// body without aws-chunked framing of streaming uploads
+func s3Body(r *http.Request) (data []byte, err error) {
+	data, err = ioutil.ReadAll(r.Body)
+	if err != nil || !strings.HasPrefix(r.Header.Get("x-amz-content-sha256"), "STREAMING") {
+		return
+	}
+	var out []byte
+	for {
+		pos := bytes.Index(data, []byte("\r\n"))
+		if pos < 0 {
+			err = fmt.Errorf("bad chunk")
+			return
+		}
+		size, perr := strconv.ParseInt(strings.SplitN(string(data[:pos]), ";", 2)[0], 16, 64)
+		if perr != nil {
+			err = perr
+			return
+		}
+		data = data[pos+2:]
+		if size == 0 {
+			break
+		}
+		out = append(out, data[:size]...)
+		data = data[size+2:]
+	}
+	data = out
+	return
+}
+
+func (f *fakeS3) xml(w http.ResponseWriter, format string, a ...interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+format, a...)
+}
+
+func (f *fakeS3) noKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>no such key</Message><Key>%s</Key></Error>`, r.URL.Path)
+	}
+}
+
+// source object of copy, with optional byte range
+func (f *fakeS3) copySource(r *http.Request) (data []byte, ok bool) {
+	src, _ := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+	parts := strings.SplitN(strings.TrimPrefix(strings.SplitN(src, "?", 2)[0], "/"), "/", 2)
+	if len(parts) < 2 {
+		return
+	}
+	data, ok = f.objects[parts[1]]
+	if rng := r.Header.Get("x-amz-copy-source-range"); ok && (rng != "") {
+		var start, end int
+		fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+		data = data[start : end+1]
+	}
+	return
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := ""
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+	q := r.URL.Query()
+	body, err := s3Body(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC().Format(http.TimeFormat)
+
+	switch {
+	case (r.Method == http.MethodGet) && (key == "") && q.Has("location"):
+		f.xml(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+	case (r.Method == http.MethodHead) && (key == ""):
+		w.WriteHeader(http.StatusOK)
+	case (r.Method == http.MethodGet) && (key == ""):
+		prefix, delim := q.Get("prefix"), q.Get("delimiter")
+		var keys []string
+		for k := range f.objects {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var contents, prefixes strings.Builder
+		seen := make(map[string]bool)
+		count := 0
+		for _, k := range keys {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			rest := strings.TrimPrefix(k, prefix)
+			if (delim != "") && strings.Contains(rest, delim) {
+				cp := prefix + strings.SplitN(rest, delim, 2)[0] + delim
+				if !seen[cp] {
+					seen[cp] = true
+					fmt.Fprintf(&prefixes, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", cp)
+				}
+				continue
+			}
+			count += 1
+			fmt.Fprintf(&contents, "<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size><StorageClass>STANDARD</StorageClass></Contents>",
+				k, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), etag(f.objects[k]), len(f.objects[k]))
+		}
+		f.xml(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>1000</MaxKeys><Delimiter>%s</Delimiter><IsTruncated>false</IsTruncated>%s%s</ListBucketResult>`,
+			f.bucket, prefix, count, delim, contents.String(), prefixes.String())
+	case (r.Method == http.MethodHead) || (r.Method == http.MethodGet):
+		data, ok := f.objects[key]
+		if !ok {
+			f.noKey(w, r)
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", now)
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end := 0, len(data)-1
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case (r.Method == http.MethodPost) && q.Has("uploads"):
+		f.nextID += 1
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		f.xml(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, f.bucket, key, id)
+	case (r.Method == http.MethodPost) && q.Has("uploadId"):
+		up, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		var nums []int
+		for n := range up {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		var data []byte
+		for _, n := range nums {
+			data = append(data, up[n]...)
+		}
+		f.objects[key] = data
+		f.xml(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, f.bucket, key, etag(data))
+	case (r.Method == http.MethodPut) && q.Has("uploadId"):
+		up, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		num, _ := strconv.Atoi(q.Get("partNumber"))
+		if r.Header.Get("x-amz-copy-source") != "" {
+			data, ok := f.copySource(r)
+			if !ok {
+				f.noKey(w, r)
+				return
+			}
+			up[num] = data
+			f.xml(w, `<CopyPartResult><LastModified>%s</LastModified><ETag>%s</ETag></CopyPartResult>`, time.Now().UTC().Format(time.RFC3339), etag(data))
+			return
+		}
+		up[num] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-amz-copy-source") != "" {
+			data, ok := f.copySource(r)
+			if !ok {
+				f.noKey(w, r)
+				return
+			}
+			f.objects[key] = data
+			f.xml(w, `<CopyObjectResult><LastModified>%s</LastModified><ETag>%s</ETag></CopyObjectResult>`, time.Now().UTC().Format(time.RFC3339), etag(data))
+			return
+		}
+		f.objects[key] = body
+		w.Header().Set("ETag", etag(body))
+	case (r.Method == http.MethodDelete) && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func testS3(t *testing.T) (*S3Storage, *fakeS3) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "testsecret")
+	fake := newFakeS3("test")
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	s, err := NewS3Storage("s3://test/set", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func writeS3(t *testing.T, w Writer, err error, data string) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readS3(t *testing.T, s *S3Storage, name string) string {
+	r, err := s.Open(name)
+	if err != nil {
+		t.Fatalf("open %s: %s", name, err.Error())
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestS3Storage(t *testing.T) {
+	s, fake := testS3(t)
+	if s.Location("1.fasta.gz") != "s3://test/set/1.fasta.gz" {
+		t.Errorf("location is %s", s.Location("1.fasta.gz"))
+	}
+
+	// create
+	w, err := s.Create("1.fasta.gz")
+	writeS3(t, w, err, "first")
+	if w.Size() != 5 {
+		t.Errorf("writer size is %d, expected 5", w.Size())
+	}
+	if got := readS3(t, s, "1.fasta.gz"); got != "first" {
+		t.Errorf("created object holds %q", got)
+	}
+	if !s.Exists("1.fasta.gz") || s.Exists("2.fasta.gz") {
+		t.Errorf("exists is wrong")
+	}
+	if size, err := s.Size("1.fasta.gz"); (err != nil) || (size != 5) {
+		t.Errorf("size is %d %v, expected 5", size, err)
+	}
+	if _, err := s.Size("2.fasta.gz"); err == nil {
+		t.Errorf("size of missing object has no error")
+	}
+	if _, err := s.Open("2.fasta.gz"); err == nil {
+		t.Errorf("open of missing object has no error")
+	}
+
+	// append copies existing content into new upload, or creates
+	w, err = s.Append("1.fasta.gz")
+	writeS3(t, w, err, "+second")
+	if w.Size() != 12 {
+		t.Errorf("appended writer size is %d, expected 12", w.Size())
+	}
+	if got := readS3(t, s, "1.fasta.gz"); got != "first+second" {
+		t.Errorf("appended object holds %q", got)
+	}
+	w, err = s.Append("2.fasta.gz")
+	writeS3(t, w, err, "new")
+	if got := readS3(t, s, "2.fasta.gz"); got != "new" {
+		t.Errorf("append to missing object holds %q", got)
+	}
+
+	// rename
+	if err = s.Rename("2.fasta.gz", "3.fasta.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("2.fasta.gz") || (readS3(t, s, "3.fasta.gz") != "new") {
+		t.Errorf("rename did not move object")
+	}
+	if err = s.Rename("2.fasta.gz", "4.fasta.gz"); err == nil {
+		t.Errorf("rename of missing object has no error")
+	}
+
+	// list only matches objects directly under prefix
+	fake.objects["set/sub/5.fasta.gz"] = []byte("nested")
+	fake.objects["other/6.fasta.gz"] = []byte("other")
+	fake.objects["set/export.index"] = []byte("{}")
+	names, err := s.List("*.fasta.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.fasta.gz", "3.fasta.gz"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("list is %v, expected %v", names, want)
+	}
+
+	// delete
+	if err = s.Delete("3.fasta.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("3.fasta.gz") {
+		t.Errorf("deleted object still exists")
+	}
+}
+
+// upload larger than a part goes through multipart upload
+func TestS3StorageMultipart(t *testing.T) {
+	s, _ := testS3(t)
+	partSize := S3_PART_SIZE
+	S3_PART_SIZE = 5 * 1024 * 1024
+	defer func() { S3_PART_SIZE = partSize }()
+
+	data := bytes.Repeat([]byte("ACGT"), int(S3_PART_SIZE)/2)
+	w, err := s.Create("1.fasta.gz")
+	writeS3(t, w, err, string(data))
+	if size, _ := s.Size("1.fasta.gz"); size != int64(len(data)) {
+		t.Errorf("size is %d, expected %d", size, len(data))
+	}
+	if got := readS3(t, s, "1.fasta.gz"); got != string(data) {
+		t.Errorf("multipart object differs")
+	}
+}
+
+// failed upload leaves existing object as it was
+func TestS3StorageAbort(t *testing.T) {
+	s, _ := testS3(t)
+	w, err := s.Create("1.fasta.gz")
+	writeS3(t, w, err, "kept")
+	sw := s.create("1.fasta.gz")
+	sw.Write([]byte("lost"))
+	sw.abort(io.ErrUnexpectedEOF)
+	if sw.Close() == nil {
+		t.Errorf("aborted upload closed without error")
+	}
+	if got := readS3(t, s, "1.fasta.gz"); got != "kept" {
+		t.Errorf("object after aborted upload holds %q", got)
+	}
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"io"
+	"strings"
+)
+
+var S3_SCHEME = "s3://"
+
+// where an export set keeps its files, names are relative to the export set
+type Storage interface {
+	Name() string
+	Location(name string) string
+	List(pattern string) ([]string, error)
+	Exists(name string) bool
+	Size(name string) (int64, error)
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (Writer, error)
+	Append(name string) (Writer, error)
+	Rename(from string, to string) error
+	Delete(name string) error
+	LocalDir() (string, bool)
+}
+
+// file being written, content is only complete after Close.
+// Size is total length so far, including content it was appended to.
+type Writer interface {
+	io.WriteCloser
+	Size() int64
+}
+
+// s3://bucket/prefix or local directory, endpoint is only used for s3
+func NewStorage(location string, endpoint string) (Storage, error) {
+	if IsRemote(location) {
+		return NewS3Storage(location, endpoint)
+	}
+	return NewLocalStorage(location)
+}
+
+func IsRemote(location string) bool {
+	return strings.HasPrefix(location, S3_SCHEME)
+}